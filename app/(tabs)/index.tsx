@@ -119,7 +119,7 @@ export default function HomeScreen() {
     if (!verificationResult.isValid) {
       // Create a complete sample medication with full tracking chain (rich mockup)
       const sampleMed = {
-        gtin: '7501001234567',
+        gtin: '7501001234560',
         batch: 'PCT2024001',
         serialNumber: medicationId,
         expiryDate: '2025-12-31',
@@ -203,7 +203,7 @@ export default function HomeScreen() {
   const addSampleMedication = async () => {
     try {
       const sampleMed = {
-        gtin: '7501001234567',
+        gtin: '7501001234560',
         batch: 'PCT2024001',
         serialNumber: '123456789',
         expiryDate: '2025-12-31',
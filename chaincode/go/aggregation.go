@@ -0,0 +1,1003 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+
+	"drug-traceability/gs1"
+)
+
+// Composite key object types for the aggregation hierarchy
+const (
+	containerKeyType      = "container~sscc"
+	containerChildKeyType = "containerChild~parentSscc~kind~childId"
+)
+
+// Kinds of container children
+const (
+	childKindUnit      = "unit"
+	childKindContainer = "container"
+)
+
+// Container types
+const (
+	ContainerTypeCase   = "case"
+	ContainerTypePallet = "pallet"
+)
+
+// Container statuses besides the lifecycle statuses propagated from container events
+const (
+	ContainerStatusPacked   = "packed"
+	ContainerStatusUnpacked = "unpacked"
+)
+
+// maxContainerDepth bounds how deep containers may nest (unit in case in pallet ...)
+const maxContainerDepth = 8
+
+// Container is a logistic unit identified by an SSCC. Its children are indexed under
+// containerChild~parentSscc~kind~childId; units and child containers point back through ParentSSCC.
+// The holder is the packer until a container event moves the container.
+type Container struct {
+	SSCC           string             `json:"sscc"`
+	Type           string             `json:"type"`
+	ParentSSCC     string             `json:"parentSscc,omitempty"`
+	Status         string             `json:"status"`
+	Location       string             `json:"location"`
+	Holder         string             `json:"holder,omitempty"`
+	HolderMSPID    string             `json:"holderMspId,omitempty"`
+	UnitCount      int                `json:"unitCount"`
+	ContainerCount int                `json:"containerCount"`
+	PackedBy       *SubmitterIdentity `json:"packedBy"`
+	PackedAt       int64              `json:"packedAt"`
+	UpdatedAt      int64              `json:"updatedAt"`
+	LastTxID       string             `json:"lastTxId,omitempty"` // transaction that last changed the container
+}
+
+// ContainerChild is an entry of a container's contents
+type ContainerChild struct {
+	Kind string `json:"kind"`
+	ID   string `json:"id"`
+}
+
+// containerEvents are the lifecycle events that can be applied to a whole container
+var containerEvents = map[string]bool{
+	EventShip:    true,
+	EventReceive: true,
+	EventReturn:  true,
+	EventDestroy: true,
+}
+
+// holderMSP returns the MSP holding a container, falling back to the packer for containers
+// stored before holders were recorded
+func (container *Container) holderMSP() string {
+	if container.HolderMSPID != "" {
+		return container.HolderMSPID
+	}
+	if container.PackedBy != nil {
+		return container.PackedBy.MSPID
+	}
+	return ""
+}
+
+// isPackable reports whether children can be added to or taken from the container
+func (container *Container) isPackable() bool {
+	switch container.Status {
+	case ContainerStatusUnpacked, StatusInTransit, StatusDestroyed:
+		return false
+	}
+	return true
+}
+
+// aggregationTx caches the containers and units touched by one aggregation transaction,
+// since reads do not see writes made earlier in the same transaction
+type aggregationTx struct {
+	s          *SmartContract
+	stub       shim.ChaincodeStubInterface
+	submitter  *SubmitterIdentity
+	txTime     int64
+	location   string
+	containers map[string]*Container
+	units      map[string]*MedicationData
+	dirty      []string
+}
+
+func (s *SmartContract) newAggregationTx(stub shim.ChaincodeStubInterface, location string) (*aggregationTx, error) {
+	submitter, err := getSubmitterIdentity(stub)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve submitter identity: %s", err)
+	}
+
+	txTime, err := getTxTime(stub)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read transaction timestamp: %s", err)
+	}
+
+	return &aggregationTx{
+		s:          s,
+		stub:       stub,
+		submitter:  submitter,
+		txTime:     txTime,
+		location:   location,
+		containers: make(map[string]*Container),
+		units:      make(map[string]*MedicationData),
+	}, nil
+}
+
+// container returns a cached container, loading it on first use. It returns nil if the SSCC is unknown.
+func (tx *aggregationTx) container(sscc string) (*Container, error) {
+	if container, ok := tx.containers[sscc]; ok {
+		return container, nil
+	}
+
+	container, err := tx.s.readContainer(tx.stub, sscc)
+	if err != nil {
+		return nil, err
+	}
+	if container != nil {
+		tx.containers[sscc] = container
+	}
+	return container, nil
+}
+
+// unit returns a cached unit by any of its IDs, loading it on first use
+func (tx *aggregationTx) unit(medicationID string) (*MedicationData, error) {
+	medicationID, err := tx.s.resolveMedicationID(tx.stub, medicationID)
+	if err != nil {
+		return nil, err
+	}
+	if medication, ok := tx.units[medicationID]; ok {
+		return medication, nil
+	}
+
+	medication, err := tx.s.readMedication(tx.stub, medicationID)
+	if err != nil {
+		return nil, err
+	}
+	tx.units[medication.ID] = medication
+	return medication, nil
+}
+
+// resolveChildIDs resolves unit IDs to their current keys, keeping the SSCCs of known
+// containers, and rejects a child listed twice under different IDs
+func (tx *aggregationTx) resolveChildIDs(childIDs []string) ([]string, error) {
+	resolvedIDs := make([]string, 0, len(childIDs))
+	listedAs := make(map[string]string, len(childIDs))
+	for _, childID := range childIDs {
+		container, err := tx.container(childID)
+		if err != nil {
+			return nil, err
+		}
+
+		resolvedID := childID
+		if container == nil {
+			resolvedID, err = tx.s.resolveMedicationID(tx.stub, childID)
+			if err != nil {
+				return nil, fmt.Errorf("failed to resolve medication ID %s: %s", childID, err)
+			}
+		}
+
+		if first, ok := listedAs[resolvedID]; ok {
+			return nil, fmt.Errorf("child IDs %s and %s refer to the same unit", first, childID)
+		}
+		listedAs[resolvedID] = childID
+		resolvedIDs = append(resolvedIDs, resolvedID)
+	}
+
+	return resolvedIDs, nil
+}
+
+// track adds a new container to the cache and marks it for writing
+func (tx *aggregationTx) track(container *Container) {
+	tx.containers[container.SSCC] = container
+	tx.markDirty(container)
+}
+
+func (tx *aggregationTx) markDirty(container *Container) {
+	for _, sscc := range tx.dirty {
+		if sscc == container.SSCC {
+			return
+		}
+	}
+	container.UpdatedAt = tx.txTime
+	container.LastTxID = tx.stub.GetTxID()
+	tx.dirty = append(tx.dirty, container.SSCC)
+}
+
+// flush writes every modified container
+func (tx *aggregationTx) flush() error {
+	for _, sscc := range tx.dirty {
+		err := tx.s.putContainer(tx.stub, tx.containers[sscc])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkContainerCustody checks that the submitter holds a container
+func (tx *aggregationTx) checkContainerCustody(container *Container, event string) error {
+	return checkCustody("container "+container.SSCC, container.holderMSP(), event, tx.submitter)
+}
+
+// checkUnitCustody checks that the submitter holds a unit, as of its latest custody event
+func (tx *aggregationTx) checkUnitCustody(medication *MedicationData, event string) error {
+	trackingHistory, err := tx.s.getTrackingEventsForMedication(tx.stub, medication.ID)
+	if err != nil {
+		return err
+	}
+
+	_, holderMSPID := getCurrentHolder(medication, trackingHistory)
+	return checkCustody("medication "+medication.ID, holderMSPID, event, tx.submitter)
+}
+
+// addChild puts a unit or container into parent. A child already in another container is
+// moved out of it when move is set, otherwise it must be loose. The submitter must hold the child.
+func (tx *aggregationTx) addChild(parent *Container, childID, event string, move bool) error {
+	childContainer, err := tx.container(childID)
+	if err != nil {
+		return err
+	}
+
+	if childContainer != nil {
+		if childContainer.SSCC == parent.SSCC {
+			return fmt.Errorf("container %s cannot contain itself", parent.SSCC)
+		}
+		if !childContainer.isPackable() {
+			return fmt.Errorf("container %s is %s and cannot be packed", childID, childContainer.Status)
+		}
+		err = tx.checkContainerCustody(childContainer, event)
+		if err != nil {
+			return err
+		}
+
+		// Reject cycles: the child must not be the parent's ancestor
+		ancestor := parent.ParentSSCC
+		for depth := 1; ancestor != ""; depth++ {
+			if ancestor == childID {
+				return fmt.Errorf("container %s already contains %s", childID, parent.SSCC)
+			}
+			if depth >= maxContainerDepth {
+				return fmt.Errorf("containers may not nest more than %d levels", maxContainerDepth)
+			}
+			ancestorContainer, err := tx.container(ancestor)
+			if err != nil {
+				return err
+			}
+			if ancestorContainer == nil {
+				break
+			}
+			ancestor = ancestorContainer.ParentSSCC
+		}
+
+		if childContainer.ParentSSCC != "" {
+			if !move || childContainer.ParentSSCC == parent.SSCC {
+				return fmt.Errorf("container %s is already packed in %s", childID, childContainer.ParentSSCC)
+			}
+			err = tx.removeChildIndex(childContainer.ParentSSCC, childKindContainer, childID)
+			if err != nil {
+				return err
+			}
+		}
+
+		childContainer.ParentSSCC = parent.SSCC
+		tx.markDirty(childContainer)
+		parent.ContainerCount++
+		tx.markDirty(parent)
+		return tx.putChildIndex(parent.SSCC, childKindContainer, childID)
+	}
+
+	medication, err := tx.unit(childID)
+	if err != nil {
+		return err
+	}
+
+	status, err := tx.s.currentStatus(tx.stub, medication)
+	if err != nil {
+		return err
+	}
+	if status != StatusCommissioned && status != StatusReceived {
+		return fmt.Errorf("medication %s is %s and cannot be packed", childID, status)
+	}
+
+	err = tx.checkUnitCustody(medication, event)
+	if err != nil {
+		return err
+	}
+
+	if medication.ParentSSCC != "" {
+		if !move || medication.ParentSSCC == parent.SSCC {
+			return fmt.Errorf("medication %s is already packed in %s", childID, medication.ParentSSCC)
+		}
+		err = tx.removeChildIndex(medication.ParentSSCC, childKindUnit, medication.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	medication.ParentSSCC = parent.SSCC
+	err = tx.putUnitEvent(medication, event, parent.SSCC)
+	if err != nil {
+		return err
+	}
+
+	parent.UnitCount++
+	tx.markDirty(parent)
+	return tx.putChildIndex(parent.SSCC, childKindUnit, medication.ID)
+}
+
+// removeChild takes a unit or container out of parent. The submitter must hold the child.
+func (tx *aggregationTx) removeChild(parent *Container, child ContainerChild) error {
+	if child.Kind == childKindContainer {
+		childContainer, err := tx.container(child.ID)
+		if err != nil {
+			return err
+		}
+		if childContainer != nil && childContainer.ParentSSCC == parent.SSCC {
+			err = tx.checkContainerCustody(childContainer, EventUnpack)
+			if err != nil {
+				return err
+			}
+			childContainer.ParentSSCC = ""
+			tx.markDirty(childContainer)
+		}
+	} else {
+		medication, err := tx.unit(child.ID)
+		if err != nil {
+			return err
+		}
+		if medication.ParentSSCC == parent.SSCC {
+			err = tx.checkUnitCustody(medication, EventUnpack)
+			if err != nil {
+				return err
+			}
+			medication.ParentSSCC = ""
+			err = tx.putUnitEvent(medication, EventUnpack, parent.SSCC)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return tx.removeChildIndex(parent.SSCC, child.Kind, child.ID)
+}
+
+// removeChildIndex drops a child from its parent's index and counts
+func (tx *aggregationTx) removeChildIndex(parentSSCC, kind, childID string) error {
+	parent, err := tx.container(parentSSCC)
+	if err != nil {
+		return err
+	}
+	if parent != nil {
+		if kind == childKindContainer {
+			parent.ContainerCount--
+		} else {
+			parent.UnitCount--
+		}
+		tx.markDirty(parent)
+	}
+
+	childKey, err := tx.stub.CreateCompositeKey(containerChildKeyType, []string{parentSSCC, kind, childID})
+	if err != nil {
+		return err
+	}
+	return tx.stub.DelState(childKey)
+}
+
+func (tx *aggregationTx) putChildIndex(parentSSCC, kind, childID string) error {
+	childKey, err := tx.stub.CreateCompositeKey(containerChildKeyType, []string{parentSSCC, kind, childID})
+	if err != nil {
+		return err
+	}
+	return tx.stub.PutState(childKey, []byte{0x00})
+}
+
+// putUnitEvent records an aggregation event on a unit and saves the unit
+func (tx *aggregationTx) putUnitEvent(medication *MedicationData, event, sscc string) error {
+	trackingEvent := TrackingEvent{
+		ID:            newEventID(tx.stub, medication),
+		Event:         event,
+		Location:      tx.location,
+		Timestamp:     tx.txTime,
+		Actor:         tx.submitter.displayLabel(""),
+		Submitter:     tx.submitter,
+		MedicationID:  medication.ID,
+		ContainerSSCC: sscc,
+		Signature:     "",
+	}
+
+	err := tx.s.putTrackingEvent(tx.stub, medication, trackingEvent)
+	if err != nil {
+		return err
+	}
+
+	if tx.location != "" {
+		medication.Location = tx.location
+	}
+	return tx.s.putMedication(tx.stub, medication)
+}
+
+// packContainer creates a case or pallet with an SSCC and packs loose units or containers into it.
+// The submitter must hold every child and becomes the holder of the container.
+// Args: [sscc, containerType, location, childIdsJSON]
+func (s *SmartContract) packContainer(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 4 {
+		return shim.Error("Incorrect number of arguments. Expecting 4: sscc, containerType, location, childIds")
+	}
+
+	sscc := args[0]
+	err := gs1.ValidateSSCC(sscc)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	containerType := args[1]
+	if containerType != ContainerTypeCase && containerType != ContainerTypePallet {
+		return shim.Error("Invalid container type " + containerType + ", expecting case or pallet")
+	}
+
+	childIDs, err := parseChildIDs(args[3])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if len(childIDs) == 0 {
+		return shim.Error("A container must be packed with at least one child")
+	}
+
+	tx, err := s.newAggregationTx(stub, args[2])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	existing, err := tx.container(sscc)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if existing != nil {
+		return shim.Error("Container already exists with SSCC: " + sscc)
+	}
+
+	container := &Container{
+		SSCC:        sscc,
+		Type:        containerType,
+		Status:      ContainerStatusPacked,
+		Location:    args[2],
+		Holder:      tx.submitter.displayLabel(""),
+		HolderMSPID: tx.submitter.MSPID,
+		PackedBy:    tx.submitter,
+		PackedAt:    tx.txTime,
+	}
+	tx.track(container)
+
+	childIDs, err = tx.resolveChildIDs(childIDs)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	for _, childID := range childIDs {
+		err = tx.addChild(container, childID, EventPack, false)
+		if err != nil {
+			return shim.Error("Cannot pack " + childID + " into " + sscc + ": " + err.Error())
+		}
+	}
+
+	err = tx.flush()
+	if err != nil {
+		return shim.Error("Failed to put containers to world state: " + err.Error())
+	}
+
+	err = s.emitEvent(stub, EventNameContainerPacked, ContainerAggregationEvent{
+		SSCC:           sscc,
+		ContainerType:  containerType,
+		Location:       container.Location,
+		Children:       childIDs,
+		SubmitterMSPID: tx.submitter.MSPID,
+	})
+	if err != nil {
+		return shim.Error("Failed to emit chaincode event: " + err.Error())
+	}
+
+	fmt.Printf("Container %s packed with %d children\n", sscc, len(childIDs))
+	return containerResponse(container)
+}
+
+// unpackContainer takes children out of a container. Without child IDs the container is
+// emptied and retired, and is removed from its own parent. The submitter must hold the
+// container and the children taken out.
+// Args: [sscc, location, childIdsJSON]
+func (s *SmartContract) unpackContainer(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 3: sscc, location, childIds")
+	}
+
+	childIDs, err := parseChildIDs(args[2])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	tx, err := s.newAggregationTx(stub, args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	container, err := tx.container(args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if container == nil {
+		return shim.Error("Container not found: " + args[0])
+	}
+	if !container.isPackable() {
+		return shim.Error("Container " + container.SSCC + " is " + container.Status + " and cannot be unpacked")
+	}
+	err = tx.checkContainerCustody(container, EventUnpack)
+	if err != nil {
+		return shim.Error("Access denied: " + err.Error())
+	}
+
+	children, err := s.getContainerChildren(stub, container.SSCC)
+	if err != nil {
+		return shim.Error("Failed to get container contents: " + err.Error())
+	}
+
+	unpackAll := len(childIDs) == 0
+	if !unpackAll {
+		childIDs, err = tx.resolveChildIDs(childIDs)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		selected := make([]ContainerChild, 0, len(childIDs))
+		for _, childID := range childIDs {
+			found := false
+			for _, child := range children {
+				if child.ID == childID {
+					selected = append(selected, child)
+					found = true
+					break
+				}
+			}
+			if !found {
+				return shim.Error(childID + " is not packed in container " + container.SSCC)
+			}
+		}
+		children = selected
+	}
+
+	for _, child := range children {
+		err = tx.removeChild(container, child)
+		if err != nil {
+			return shim.Error("Cannot unpack " + child.ID + " from " + container.SSCC + ": " + err.Error())
+		}
+	}
+
+	if unpackAll {
+		if container.ParentSSCC != "" {
+			err = tx.removeChildIndex(container.ParentSSCC, childKindContainer, container.SSCC)
+			if err != nil {
+				return shim.Error("Failed to remove container from its parent: " + err.Error())
+			}
+			container.ParentSSCC = ""
+		}
+		container.Status = ContainerStatusUnpacked
+	}
+	if args[1] != "" {
+		container.Location = args[1]
+	}
+	tx.markDirty(container)
+
+	err = tx.flush()
+	if err != nil {
+		return shim.Error("Failed to put containers to world state: " + err.Error())
+	}
+
+	removed := make([]string, 0, len(children))
+	for _, child := range children {
+		removed = append(removed, child.ID)
+	}
+
+	err = s.emitEvent(stub, EventNameContainerUnpacked, ContainerAggregationEvent{
+		SSCC:           container.SSCC,
+		ContainerType:  container.Type,
+		Location:       container.Location,
+		Children:       removed,
+		SubmitterMSPID: tx.submitter.MSPID,
+	})
+	if err != nil {
+		return shim.Error("Failed to emit chaincode event: " + err.Error())
+	}
+
+	fmt.Printf("Unpacked %d children from container %s\n", len(removed), container.SSCC)
+	return containerResponse(container)
+}
+
+// repackContainer moves units or containers into an existing container, taking them out of
+// whatever container they were in before. The submitter must hold the container and every child.
+// Args: [sscc, location, childIdsJSON]
+func (s *SmartContract) repackContainer(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 3: sscc, location, childIds")
+	}
+
+	childIDs, err := parseChildIDs(args[2])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if len(childIDs) == 0 {
+		return shim.Error("Missing child IDs to repack")
+	}
+
+	tx, err := s.newAggregationTx(stub, args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	container, err := tx.container(args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if container == nil {
+		return shim.Error("Container not found: " + args[0])
+	}
+	if !container.isPackable() {
+		return shim.Error("Container " + container.SSCC + " is " + container.Status + " and cannot be repacked")
+	}
+	err = tx.checkContainerCustody(container, EventRepack)
+	if err != nil {
+		return shim.Error("Access denied: " + err.Error())
+	}
+
+	childIDs, err = tx.resolveChildIDs(childIDs)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	for _, childID := range childIDs {
+		err = tx.addChild(container, childID, EventRepack, true)
+		if err != nil {
+			return shim.Error("Cannot repack " + childID + " into " + container.SSCC + ": " + err.Error())
+		}
+	}
+
+	err = tx.flush()
+	if err != nil {
+		return shim.Error("Failed to put containers to world state: " + err.Error())
+	}
+
+	err = s.emitEvent(stub, EventNameContainerRepacked, ContainerAggregationEvent{
+		SSCC:           container.SSCC,
+		ContainerType:  container.Type,
+		Location:       container.Location,
+		Children:       childIDs,
+		SubmitterMSPID: tx.submitter.MSPID,
+	})
+	if err != nil {
+		return shim.Error("Failed to emit chaincode event: " + err.Error())
+	}
+
+	fmt.Printf("Repacked %d children into container %s\n", len(childIDs), container.SSCC)
+	return containerResponse(container)
+}
+
+// addContainerEvent applies a ship, receive, return or destroy event to a top-level container
+// and propagates it to every nested container and unit. The actor is a participant GLN as in addTrackingEvent.
+// As for units, the submitter must hold the container and everything in it, except to receive it.
+// Args: [sscc, event, location, actor, signature]
+func (s *SmartContract) addContainerEvent(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 5 {
+		return shim.Error("Incorrect number of arguments. Expecting 5: sscc, event, location, actor, signature")
+	}
+
+	event := args[1]
+	if !containerEvents[event] {
+		return shim.Error("Event " + event + " cannot be applied to a container")
+	}
+
+	tx, err := s.newAggregationTx(stub, args[2])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	container, err := tx.container(args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if container == nil {
+		return shim.Error("Container not found: " + args[0])
+	}
+	if container.Status == ContainerStatusUnpacked {
+		return shim.Error("Container " + container.SSCC + " has been unpacked")
+	}
+	if container.ParentSSCC != "" {
+		return shim.Error("Container " + container.SSCC + " is packed in " + container.ParentSSCC + "; apply the event to the outer container")
+	}
+	err = tx.checkContainerCustody(container, event)
+	if err != nil {
+		return shim.Error("Access denied: " + err.Error())
+	}
+
+	participant, err := s.resolveActingParticipant(stub, args[3], tx.submitter, "")
+	if err != nil {
+		return shim.Error("Invalid actor: " + err.Error())
+	}
+
+	// Signed events must carry a valid signature of the acting participant
+	err = s.checkNewEventSignature(stub, SigningPayload{Actor: participant.GLN, Event: event, Location: args[2], Previous: container.LastTxID, Subject: container.SSCC}, args[4])
+	if err != nil {
+		return shim.Error("Invalid signature: " + err.Error())
+	}
+
+	actor := participant.GLN
+	signedTxID := container.LastTxID
+	status := lifecycle[event].To
+	units := 0
+	containers := 0
+
+	// Walk the hierarchy breadth first
+	level := []*Container{container}
+	for depth := 0; len(level) > 0; depth++ {
+		if depth > maxContainerDepth {
+			return shim.Error("Container hierarchy of " + container.SSCC + " is deeper than allowed")
+		}
+
+		var next []*Container
+		for _, current := range level {
+			err = tx.checkContainerCustody(current, event)
+			if err != nil {
+				return shim.Error("Access denied: " + err.Error())
+			}
+			current.Status = status
+			current.Location = args[2]
+			current.Holder = actor
+			current.HolderMSPID = tx.submitter.MSPID
+			tx.markDirty(current)
+			containers++
+
+			children, err := s.getContainerChildren(stub, current.SSCC)
+			if err != nil {
+				return shim.Error("Failed to get container contents: " + err.Error())
+			}
+
+			for _, child := range children {
+				if child.Kind == childKindContainer {
+					childContainer, err := tx.container(child.ID)
+					if err != nil {
+						return shim.Error(err.Error())
+					}
+					if childContainer != nil {
+						next = append(next, childContainer)
+					}
+					continue
+				}
+
+				medication, err := tx.unit(child.ID)
+				if err != nil {
+					return shim.Error(err.Error())
+				}
+
+				err = tx.checkUnitCustody(medication, event)
+				if err != nil {
+					return shim.Error("Access denied: " + err.Error())
+				}
+
+				unitStatus, err := s.currentStatus(stub, medication)
+				if err != nil {
+					return shim.Error("Failed to get tracking history: " + err.Error())
+				}
+
+				medication.Status, err = nextStatus(unitStatus, event)
+				if err != nil {
+					return shim.Error("Cannot apply event to medication " + medication.ID + " in container " + current.SSCC + ": " + err.Error())
+				}
+				medication.Location = args[2]
+
+				trackingEvent := TrackingEvent{
+					ID:            newEventID(stub, medication),
+					Event:         event,
+					Location:      args[2],
+					Timestamp:     tx.txTime,
+					Actor:         actor,
+					Submitter:     tx.submitter,
+					MedicationID:  medication.ID,
+					ContainerSSCC: container.SSCC,
+					ContainerTxID: signedTxID,
+					Signature:     args[4],
+				}
+
+				err = s.putTrackingEvent(stub, medication, trackingEvent)
+				if err != nil {
+					return shim.Error("Failed to put tracking event to world state: " + err.Error())
+				}
+
+				err = s.putMedication(stub, medication)
+				if err != nil {
+					return shim.Error("Failed to update medication in world state: " + err.Error())
+				}
+				units++
+			}
+		}
+		level = next
+	}
+
+	err = tx.flush()
+	if err != nil {
+		return shim.Error("Failed to put containers to world state: " + err.Error())
+	}
+
+	err = s.emitEvent(stub, EventNameContainerTrackingEventAdded, ContainerTrackingEventAddedEvent{
+		SSCC:           container.SSCC,
+		Event:          event,
+		Location:       args[2],
+		Actor:          actor,
+		SubmitterMSPID: tx.submitter.MSPID,
+		Status:         status,
+		UnitCount:      units,
+		ContainerCount: containers,
+	})
+	if err != nil {
+		return shim.Error("Failed to emit chaincode event: " + err.Error())
+	}
+
+	fmt.Printf("Event %s applied to container %s: %d units in %d containers\n", event, container.SSCC, units, containers)
+	return containerResponse(container)
+}
+
+// getContainer returns a container and its direct contents
+// Args: [sscc]
+func (s *SmartContract) getContainer(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1: sscc")
+	}
+
+	container, err := s.readContainer(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if container == nil {
+		return shim.Error("Container not found: " + args[0])
+	}
+
+	children, err := s.getContainerChildren(stub, container.SSCC)
+	if err != nil {
+		return shim.Error("Failed to get container contents: " + err.Error())
+	}
+
+	var response = struct {
+		Container *Container       `json:"container"`
+		Children  []ContainerChild `json:"children"`
+	}{
+		Container: container,
+		Children:  children,
+	}
+
+	responseJSON, err := json.Marshal(response)
+	if err != nil {
+		return shim.Error("Failed to marshal container: " + err.Error())
+	}
+
+	return shim.Success(responseJSON)
+}
+
+// Helper function to return a container as the transaction payload
+func containerResponse(container *Container) pb.Response {
+	containerJSON, err := json.Marshal(container)
+	if err != nil {
+		return shim.Error("Failed to marshal container: " + err.Error())
+	}
+
+	return shim.Success(containerJSON)
+}
+
+// Helper function to list the direct children of a container
+func (s *SmartContract) getContainerChildren(stub shim.ChaincodeStubInterface, sscc string) ([]ContainerChild, error) {
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(containerChildKeyType, []string{sscc})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	children := []ContainerChild{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		_, keyParts, err := stub.SplitCompositeKey(queryResponse.Key)
+		if err != nil || len(keyParts) != 3 {
+			continue // Skip malformed index entries
+		}
+
+		children = append(children, ContainerChild{Kind: keyParts[1], ID: keyParts[2]})
+	}
+
+	return children, nil
+}
+
+// Helper function to get the chain of containers enclosing a unit, innermost first
+func (s *SmartContract) getContainerChain(stub shim.ChaincodeStubInterface, parentSSCC string) ([]Container, error) {
+	var chain []Container
+	for sscc := parentSSCC; sscc != "" && len(chain) < maxContainerDepth; {
+		container, err := s.readContainer(stub, sscc)
+		if err != nil {
+			return nil, err
+		}
+		if container == nil {
+			break
+		}
+
+		chain = append(chain, *container)
+		sscc = container.ParentSSCC
+	}
+
+	return chain, nil
+}
+
+// Helper function to read a container, returning nil if the SSCC is unknown
+func (s *SmartContract) readContainer(stub shim.ChaincodeStubInterface, sscc string) (*Container, error) {
+	containerKey, err := stub.CreateCompositeKey(containerKeyType, []string{sscc})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create container key: %s", err)
+	}
+
+	containerJSON, err := stub.GetState(containerKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read container from world state: %s", err)
+	}
+	if containerJSON == nil {
+		return nil, nil
+	}
+
+	var container Container
+	err = json.Unmarshal(containerJSON, &container)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal container: %s", err)
+	}
+
+	return &container, nil
+}
+
+// Helper function to store a container
+func (s *SmartContract) putContainer(stub shim.ChaincodeStubInterface, container *Container) error {
+	containerKey, err := stub.CreateCompositeKey(containerKeyType, []string{container.SSCC})
+	if err != nil {
+		return err
+	}
+
+	containerJSON, err := json.Marshal(container)
+	if err != nil {
+		return err
+	}
+
+	return stub.PutState(containerKey, containerJSON)
+}
+
+// parseChildIDs decodes a JSON array of unit IDs or SSCCs, rejecting duplicates.
+// An empty string is treated as an empty list. A unit listed under both its legacy ID
+// and its SGTIN is only caught once the IDs are resolved, by resolveChildIDs.
+func parseChildIDs(childIDsJSON string) ([]string, error) {
+	if childIDsJSON == "" {
+		return nil, nil
+	}
+
+	var childIDs []string
+	err := json.Unmarshal([]byte(childIDsJSON), &childIDs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal child IDs: %s", err)
+	}
+
+	seen := make(map[string]bool, len(childIDs))
+	for _, childID := range childIDs {
+		if childID == "" {
+			return nil, fmt.Errorf("child IDs must not be empty")
+		}
+		if seen[childID] {
+			return nil, fmt.Errorf("duplicate child ID %s", childID)
+		}
+		seen[childID] = true
+	}
+
+	return childIDs, nil
+}
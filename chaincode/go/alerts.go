@@ -0,0 +1,384 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+
+	"drug-traceability/gs1"
+)
+
+// Composite key object type of clone alerts
+const alertKeyType = "alert~medicationId~alertId"
+
+// cloneDetectionWindow is how long, in seconds, a unit is expected to stay at one place and
+// with one participant; observations of it elsewhere within the window raise an alert
+const cloneDetectionWindow = 24 * 60 * 60
+
+// Clone alert types
+const (
+	AlertIncompatibleScan      = "incompatible_scan"
+	AlertScanAfterDispense     = "scan_after_dispense"
+	AlertScanAfterDecommission = "scan_after_decommission"
+)
+
+// Clone alert statuses
+const (
+	AlertStatusOpen     = "open"
+	AlertStatusResolved = "resolved"
+)
+
+// CloneAlert records a verification or tracking event suggesting that a serial has been copied
+// onto more than one pack. Open alerts make a unit suspect and count as active alerts in the stats.
+type CloneAlert struct {
+	ID                  string             `json:"id"`
+	MedicationID        string             `json:"medicationId"`
+	Type                string             `json:"type"`
+	Detail              string             `json:"detail"`
+	VerificationID      string             `json:"verificationId,omitempty"` // verification that raised the alert
+	EventID             string             `json:"eventId,omitempty"`        // or tracking event that raised it
+	Location            string             `json:"location"`
+	ConflictingID       string             `json:"conflictingId,omitempty"` // verification or tracking event observed elsewhere
+	ConflictingLocation string             `json:"conflictingLocation,omitempty"`
+	Status              string             `json:"status"`
+	RaisedAt            int64              `json:"raisedAt"`
+	Resolution          string             `json:"resolution,omitempty"`
+	ResolvedBy          *SubmitterIdentity `json:"resolvedBy,omitempty"`
+	ResolvedAt          int64              `json:"resolvedAt,omitempty"`
+}
+
+// observation is a sighting of a unit: a recorded verification or a tracking event.
+// GLN is empty when the observer did not identify as a participant.
+type observation struct {
+	ID        string
+	Timestamp int64
+	Location  string
+	GLN       string
+}
+
+// incompatibleWith describes why two observations cannot both be of one pack, or returns
+// an empty string. Observers are only compared when both have a GLN: the submitting MSP alone
+// does not say who holds the pack, e.g. when a regulator inspects a pharmacy's stock.
+func (a observation) incompatibleWith(b observation) string {
+	var differences []string
+	if normalizeLocation(a.Location) != normalizeLocation(b.Location) {
+		differences = append(differences, fmt.Sprintf("location %q against %q", a.Location, b.Location))
+	}
+	if a.GLN != "" && b.GLN != "" && a.GLN != b.GLN {
+		differences = append(differences, fmt.Sprintf("participant %s against %s", a.GLN, b.GLN))
+	}
+	return strings.Join(differences, " and ")
+}
+
+func normalizeLocation(location string) string {
+	return strings.ToLower(strings.TrimSpace(location))
+}
+
+// Helper function to check a verification being recorded for signs of a cloned serial: a unit
+// seen at an incompatible place or participant within cloneDetectionWindow of another
+// sighting since its last custody event, or verified after it was dispensed or destroyed.
+// The alerts are returned unsaved, at most one of each type.
+func detectCloneAlerts(medication *MedicationData, trackingHistory []TrackingEvent, previous []VerificationRecord, record *VerificationRecord) []CloneAlert {
+	newAlert := func(alertType, detail string) CloneAlert {
+		return CloneAlert{
+			ID:             fmt.Sprintf("alert_%s_%s", record.ID, alertType),
+			MedicationID:   medication.ID,
+			Type:           alertType,
+			Detail:         detail,
+			VerificationID: record.ID,
+			Location:       record.Location,
+			Status:         AlertStatusOpen,
+			RaisedAt:       record.Timestamp,
+		}
+	}
+
+	var alerts []CloneAlert
+
+	// A dispensed or destroyed pack has left the supply chain for good
+	status := medication.Status
+	if status == statusLegacyActive {
+		status = resolveLegacyStatus(trackingHistory)
+	}
+	for i := len(trackingHistory) - 1; i >= 0; i-- {
+		event := trackingHistory[i]
+		if status == StatusDispensed && event.Event == EventDispense {
+			alerts = append(alerts, newAlert(AlertScanAfterDispense, fmt.Sprintf("verified at %s after it was dispensed at %s on %s",
+				record.Location, event.Location, time.Unix(event.Timestamp, 0).UTC().Format(time.RFC3339))))
+			break
+		}
+		if status == StatusDestroyed && event.Event == EventDestroy {
+			alerts = append(alerts, newAlert(AlertScanAfterDecommission, fmt.Sprintf("verified at %s after it was destroyed at %s on %s",
+				record.Location, event.Location, time.Unix(event.Timestamp, 0).UTC().Format(time.RFC3339))))
+			break
+		}
+	}
+
+	// Where a pack that left the supply chain turns up says nothing more
+	if len(alerts) > 0 {
+		return alerts
+	}
+
+	current := observation{ID: record.ID, Timestamp: record.Timestamp, Location: record.Location, GLN: record.VerifierGLN}
+	if sighting, reason := findConflictingSighting(trackingHistory, previous, current); sighting != nil {
+		alert := newAlert(AlertIncompatibleScan, fmt.Sprintf("verified within %s of being seen elsewhere since its last custody event: %s",
+			time.Duration(current.Timestamp-sighting.Timestamp)*time.Second, reason))
+		alert.ConflictingID = sighting.ID
+		alert.ConflictingLocation = sighting.Location
+		alerts = append(alerts, alert)
+	}
+
+	return alerts
+}
+
+// Helper function to check a tracking event being added for signs of a cloned serial: the
+// actor at an incompatible place within cloneDetectionWindow of another sighting since the
+// previous custody event. Which events may follow a dispense or destroy is up to the
+// lifecycle, so those are not checked. trackingHistory must not include the new event.
+// The alert is returned unsaved.
+func detectEventCloneAlerts(medication *MedicationData, trackingHistory []TrackingEvent, previous []VerificationRecord, event *TrackingEvent) []CloneAlert {
+	current := observation{ID: event.ID, Timestamp: event.Timestamp, Location: event.Location, GLN: event.Actor}
+	sighting, reason := findConflictingSighting(trackingHistory, previous, current)
+	if sighting == nil {
+		return nil
+	}
+
+	return []CloneAlert{{
+		ID:           fmt.Sprintf("alert_%s_%s", event.ID, AlertIncompatibleScan),
+		MedicationID: medication.ID,
+		Type:         AlertIncompatibleScan,
+		Detail: fmt.Sprintf("%s recorded within %s of the pack being seen elsewhere since its last custody event: %s",
+			event.Event, time.Duration(current.Timestamp-sighting.Timestamp)*time.Second, reason),
+		EventID:             event.ID,
+		Location:            event.Location,
+		ConflictingID:       sighting.ID,
+		ConflictingLocation: sighting.Location,
+		Status:              AlertStatusOpen,
+		RaisedAt:            event.Timestamp,
+	}}
+}
+
+// findConflictingSighting returns the most recent sighting of a unit since its latest custody
+// event, within cloneDetectionWindow of current, that is incompatible with current, and why
+func findConflictingSighting(trackingHistory []TrackingEvent, previous []VerificationRecord, current observation) (*observation, string) {
+	// After its latest custody event a pack stays with that holder at that place, so every
+	// sighting since then must be compatible with this one. A shipped or returned pack may be
+	// anywhere until it is received, so those events set no expectation of their own.
+	var sightings []observation
+	var since int64
+	for i := len(trackingHistory) - 1; i >= 0; i-- {
+		event := trackingHistory[i]
+		// Recalls are issued from wherever the manufacturer or regulator is
+		if event.Event == EventRecall || event.Event == EventLiftRecall {
+			continue
+		}
+
+		since = event.Timestamp
+		if event.Event != EventShip && event.Event != EventReturn {
+			sighting := observation{ID: event.ID, Timestamp: event.Timestamp, Location: event.Location}
+			if gs1.ValidateGLN(event.Actor) == nil {
+				sighting.GLN = event.Actor
+			}
+			sightings = append(sightings, sighting)
+		}
+		break
+	}
+	for _, verification := range previous {
+		if !verification.Found || verification.Timestamp < since {
+			continue
+		}
+		sightings = append(sightings, observation{
+			ID:        verification.ID,
+			Timestamp: verification.Timestamp,
+			Location:  verification.Location,
+			GLN:       verification.VerifierGLN,
+		})
+	}
+
+	// Report the most recent conflicting sighting within the window
+	for i := len(sightings) - 1; i >= 0; i-- {
+		sighting := sightings[i]
+		if current.Timestamp-sighting.Timestamp > cloneDetectionWindow {
+			continue
+		}
+		if reason := current.incompatibleWith(sighting); reason != "" {
+			return &sighting, reason
+		}
+	}
+	return nil, ""
+}
+
+// resolveAlert closes a clone alert after investigation, e.g. as a false positive or once the
+// counterfeit packs are seized. Only regulators or members of the manufacturer's MSP may resolve.
+// Args: [medicationId, alertId, resolution]
+func (s *SmartContract) resolveAlert(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 3: medicationId, alertId, resolution")
+	}
+
+	if args[2] == "" {
+		return shim.Error("Missing resolution")
+	}
+
+	medication, err := s.readMedication(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	alert, err := s.readAlert(stub, medication.ID, args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if alert.Status == AlertStatusResolved {
+		return shim.Error("Alert " + alert.ID + " is already resolved")
+	}
+
+	submitter, err := getSubmitterIdentity(stub)
+	if err != nil {
+		return shim.Error("Failed to resolve submitter identity: " + err.Error())
+	}
+
+	isRegulator, err := s.callerHasRole(stub, RoleRegulator)
+	if err != nil {
+		return shim.Error("Access denied: " + err.Error())
+	}
+	if !isRegulator && medication.ManufacturerMSP != submitter.MSPID {
+		return shim.Error("Access denied: only regulators or the manufacturer may resolve alerts of medication " + medication.ID)
+	}
+
+	txTime, err := getTxTime(stub)
+	if err != nil {
+		return shim.Error("Failed to read transaction timestamp: " + err.Error())
+	}
+
+	alert.Status = AlertStatusResolved
+	alert.Resolution = args[2]
+	alert.ResolvedBy = submitter
+	alert.ResolvedAt = txTime
+
+	err = s.putAlert(stub, alert)
+	if err != nil {
+		return shim.Error("Failed to put alert to world state: " + err.Error())
+	}
+
+	err = s.emitEvent(stub, EventNameAlertResolved, AlertResolvedEvent{
+		MedicationID:   alert.MedicationID,
+		AlertID:        alert.ID,
+		AlertType:      alert.Type,
+		Resolution:     alert.Resolution,
+		SubmitterMSPID: submitter.MSPID,
+	})
+	if err != nil {
+		return shim.Error("Failed to emit chaincode event: " + err.Error())
+	}
+
+	alertJSON, err := json.Marshal(alert)
+	if err != nil {
+		return shim.Error("Failed to marshal alert: " + err.Error())
+	}
+
+	fmt.Printf("Alert %s of medication %s resolved\n", alert.ID, alert.MedicationID)
+	return shim.Success(alertJSON)
+}
+
+// Helper function to read the clone alerts of a unit, oldest first
+func (s *SmartContract) getAlertsForMedication(stub shim.ChaincodeStubInterface, medicationID string) ([]CloneAlert, error) {
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(alertKeyType, []string{medicationID})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	alerts := []CloneAlert{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		var alert CloneAlert
+		err = json.Unmarshal(queryResponse.Value, &alert)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal alert %s: %s", queryResponse.Key, err)
+		}
+		alerts = append(alerts, alert)
+	}
+
+	// Alert IDs embed transaction IDs, which do not sort by time
+	sort.SliceStable(alerts, func(i, j int) bool {
+		return alerts[i].RaisedAt < alerts[j].RaisedAt
+	})
+
+	return alerts, nil
+}
+
+// Helper function to count the open clone alerts of all units
+func (s *SmartContract) countOpenAlerts(stub shim.ChaincodeStubInterface) (int, error) {
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(alertKeyType, []string{})
+	if err != nil {
+		return 0, err
+	}
+	defer resultsIterator.Close()
+
+	open := 0
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return 0, err
+		}
+
+		var alert CloneAlert
+		err = json.Unmarshal(queryResponse.Value, &alert)
+		if err != nil {
+			continue // Skip invalid records
+		}
+		if alert.Status == AlertStatusOpen {
+			open++
+		}
+	}
+
+	return open, nil
+}
+
+// Helper function to read an alert that must exist
+func (s *SmartContract) readAlert(stub shim.ChaincodeStubInterface, medicationID string, alertID string) (*CloneAlert, error) {
+	alertKey, err := stub.CreateCompositeKey(alertKeyType, []string{medicationID, alertID})
+	if err != nil {
+		return nil, err
+	}
+
+	alertJSON, err := stub.GetState(alertKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read alert from world state: %s", err)
+	}
+	if alertJSON == nil {
+		return nil, fmt.Errorf("alert not found: %s", alertID)
+	}
+
+	var alert CloneAlert
+	err = json.Unmarshal(alertJSON, &alert)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal alert: %s", err)
+	}
+
+	return &alert, nil
+}
+
+// Helper function to store an alert
+func (s *SmartContract) putAlert(stub shim.ChaincodeStubInterface, alert *CloneAlert) error {
+	alertKey, err := stub.CreateCompositeKey(alertKeyType, []string{alert.MedicationID, alert.ID})
+	if err != nil {
+		return err
+	}
+
+	alertJSON, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+
+	return stub.PutState(alertKey, alertJSON)
+}
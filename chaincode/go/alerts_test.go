@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFindConflictingSighting(t *testing.T) {
+	at := func(offset time.Duration) int64 {
+		return testStartTime.Add(offset).Unix()
+	}
+	commission := TrackingEvent{ID: "commission", Event: EventCommission, Location: "Plant A", Actor: testManufacturerGLN, Timestamp: at(0)}
+	ship := TrackingEvent{ID: "ship", Event: EventShip, Location: "Plant A", Actor: testManufacturerGLN, Timestamp: at(time.Hour)}
+	receive := TrackingEvent{ID: "receive", Event: EventReceive, Location: "Warehouse B", Actor: testDistributorGLN, Timestamp: at(3 * time.Hour)}
+	recall := TrackingEvent{ID: "recall", Event: EventRecall, Location: "Health Authority", Actor: testRegulatorGLN, Timestamp: at(time.Hour)}
+	verification := func(id, location, gln string, offset time.Duration) VerificationRecord {
+		return VerificationRecord{ID: id, Location: location, VerifierGLN: gln, Timestamp: at(offset), Found: true}
+	}
+
+	tests := []struct {
+		name     string
+		history  []TrackingEvent
+		previous []VerificationRecord
+		current  observation
+		want     string // ID of the conflicting sighting, empty if none
+	}{
+		{
+			name:    "same place",
+			history: []TrackingEvent{commission},
+			current: observation{ID: "v", Location: " plant a ", Timestamp: at(time.Hour)},
+		},
+		{
+			name:    "other place within the window",
+			history: []TrackingEvent{commission},
+			current: observation{ID: "v", Location: "Street Market", Timestamp: at(time.Hour)},
+			want:    "commission",
+		},
+		{
+			name:    "other place after the window",
+			history: []TrackingEvent{commission},
+			current: observation{ID: "v", Location: "Street Market", Timestamp: at(25 * time.Hour)},
+		},
+		{
+			name:    "other participant at the same place",
+			history: []TrackingEvent{commission},
+			current: observation{ID: "v", Location: "Plant A", GLN: testPharmacyGLN, Timestamp: at(time.Hour)},
+			want:    "commission",
+		},
+		{
+			name:    "shipped pack may be anywhere",
+			history: []TrackingEvent{commission, ship},
+			current: observation{ID: "v", Location: "Street Market", Timestamp: at(2 * time.Hour)},
+		},
+		{
+			name:     "shipped pack seen at two places",
+			history:  []TrackingEvent{commission, ship},
+			previous: []VerificationRecord{verification("v1", "Warehouse B", "", 2*time.Hour)},
+			current:  observation{ID: "v", Location: "Street Market", Timestamp: at(2*time.Hour + time.Minute)},
+			want:     "v1",
+		},
+		{
+			name:    "recall is not a custody event",
+			history: []TrackingEvent{commission, recall},
+			current: observation{ID: "v", Location: "Street Market", Timestamp: at(2 * time.Hour)},
+			want:    "commission",
+		},
+		{
+			name:     "verifications before the last custody event are ignored",
+			history:  []TrackingEvent{commission, ship, receive},
+			previous: []VerificationRecord{verification("v1", "Plant A", "", 30*time.Minute)},
+			current:  observation{ID: "v", Location: "Warehouse B", Timestamp: at(4 * time.Hour)},
+		},
+		{
+			name:     "verifications of unknown IDs are ignored",
+			history:  []TrackingEvent{commission},
+			previous: []VerificationRecord{{ID: "v1", Location: "Street Market", Timestamp: at(time.Minute)}},
+			current:  observation{ID: "v", Location: "Plant A", Timestamp: at(time.Hour)},
+		},
+		{
+			name:    "most recent conflict",
+			history: []TrackingEvent{commission},
+			previous: []VerificationRecord{
+				verification("v1", "Warehouse B", "", time.Hour),
+				verification("v2", "Street Market", "", 2*time.Hour),
+			},
+			current: observation{ID: "v", Location: "Plant A", Timestamp: at(3 * time.Hour)},
+			want:    "v2",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sighting, reason := findConflictingSighting(test.history, test.previous, test.current)
+			got := ""
+			if sighting != nil {
+				got = sighting.ID
+			}
+			if got != test.want {
+				t.Errorf("findConflictingSighting() = %q (%s), want %q", got, reason, test.want)
+			}
+			if sighting != nil && reason == "" {
+				t.Errorf("findConflictingSighting() returned %q without a reason", got)
+			}
+		})
+	}
+}
+
+func TestDetectCloneAlerts(t *testing.T) {
+	at := func(offset time.Duration) int64 {
+		return testStartTime.Add(offset).Unix()
+	}
+	received := []TrackingEvent{
+		{ID: "commission", Event: EventCommission, Location: "Plant A", Actor: testManufacturerGLN, Timestamp: at(0)},
+		{ID: "ship", Event: EventShip, Location: "Plant A", Actor: testManufacturerGLN, Timestamp: at(time.Hour)},
+		{ID: "receive", Event: EventReceive, Location: "Pharmacy C", Actor: testPharmacyGLN, Timestamp: at(2 * time.Hour)},
+	}
+	dispensed := append(received[:len(received):len(received)],
+		TrackingEvent{ID: "dispense", Event: EventDispense, Location: "Pharmacy C", Actor: testPharmacyGLN, Timestamp: at(3 * time.Hour)})
+	destroyed := append(received[:len(received):len(received)],
+		TrackingEvent{ID: "destroy", Event: EventDestroy, Location: "Pharmacy C", Actor: testPharmacyGLN, Timestamp: at(3 * time.Hour)})
+
+	tests := []struct {
+		name     string
+		status   string
+		history  []TrackingEvent
+		location string
+		want     []string // alert types
+	}{
+		{name: "compatible scan", status: StatusReceived, history: received, location: "Pharmacy C"},
+		{name: "incompatible scan", status: StatusReceived, history: received, location: "Street Market", want: []string{AlertIncompatibleScan}},
+		{name: "scan after dispense", status: StatusDispensed, history: dispensed, location: "Street Market", want: []string{AlertScanAfterDispense}},
+		{name: "scan after destroy", status: StatusDestroyed, history: destroyed, location: "Pharmacy C", want: []string{AlertScanAfterDecommission}},
+		{name: "legacy dispensed unit", status: statusLegacyActive, history: dispensed, location: "Pharmacy C", want: []string{AlertScanAfterDispense}},
+		{name: "returned after dispense", status: StatusReturned, history: append(dispensed[:len(dispensed):len(dispensed)],
+			TrackingEvent{ID: "return", Event: EventReturn, Location: "Pharmacy C", Actor: testPharmacyGLN, Timestamp: at(4 * time.Hour)}),
+			location: "Street Market"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			medication := &MedicationData{ID: "medication X", Status: test.status}
+			record := &VerificationRecord{ID: "tx1", Location: test.location, Timestamp: at(5 * time.Hour), Found: true}
+
+			alerts := detectCloneAlerts(medication, test.history, nil, record)
+			var got []string
+			for _, alert := range alerts {
+				got = append(got, alert.Type)
+				if alert.ID != "alert_tx1_"+alert.Type || alert.MedicationID != medication.ID || alert.VerificationID != record.ID || alert.Status != AlertStatusOpen {
+					t.Errorf("alert is not an open alert of verification tx1 of medication X: %+v", alert)
+				}
+			}
+			if fmt.Sprint(got) != fmt.Sprint(test.want) {
+				t.Errorf("detectCloneAlerts() raised %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestCloneAlertsAreRaisedAndResolved(t *testing.T) {
+	network := newTestNetwork(t)
+	medicationID := network.commission("BATCH001", "SN001")
+
+	network.advance(time.Hour)
+	network.mustInvoke(network.manufacturer, "addTrackingEvent", medicationID, EventShip, "Manufacturing Plant A", testManufacturerGLN, "")
+	network.advance(time.Hour)
+	network.mustInvoke(network.distributor, "addTrackingEvent", medicationID, EventReceive, "Warehouse B", testDistributorGLN, "")
+
+	// Seen in a street market ten minutes after it was received at the warehouse
+	network.advance(10 * time.Minute)
+	verdict := network.mustInvoke(network.pharmacy, "recordVerification", medicationID, "Street Market", "")
+	if !strings.Contains(string(verdict), `"`+VerdictSuspect+`"`) {
+		t.Errorf("verification at the street market is not suspect: %s", verdict)
+	}
+	verificationID := fmt.Sprintf("tx%04d", network.txCount)
+
+	// and shipped from the warehouse shortly after
+	network.advance(10 * time.Minute)
+	network.mustInvoke(network.distributor, "addTrackingEvent", medicationID, EventShip, "Warehouse B", testDistributorGLN, "")
+
+	alerts, err := network.cc.getAlertsForMedication(network, medicationID)
+	if err != nil {
+		t.Fatalf("failed to get alerts: %s", err)
+	}
+	if len(alerts) != 2 {
+		t.Fatalf("%d alerts raised, want 2: %+v", len(alerts), alerts)
+	}
+	var verificationAlert, eventAlert *CloneAlert
+	for i := range alerts {
+		if alerts[i].VerificationID != "" {
+			verificationAlert = &alerts[i]
+		} else {
+			eventAlert = &alerts[i]
+		}
+	}
+	if verificationAlert == nil || verificationAlert.Type != AlertIncompatibleScan || verificationAlert.ConflictingLocation != "Warehouse B" {
+		t.Errorf("verification alert = %+v, want an incompatible scan against Warehouse B", verificationAlert)
+	}
+	if eventAlert == nil || eventAlert.EventID == "" || eventAlert.ConflictingID != verificationID {
+		t.Fatalf("tracking event alert = %+v, want one conflicting with verification %s", eventAlert, verificationID)
+	}
+
+	if response := network.invoke(network.distributor, "resolveAlert", medicationID, eventAlert.ID, "False positive"); response.Status == 200 {
+		t.Errorf("resolveAlert accepted a distributor")
+	}
+	network.mustInvoke(network.manufacturer, "resolveAlert", medicationID, eventAlert.ID, "Packs seized")
+	if response := network.invoke(network.regulator, "resolveAlert", medicationID, eventAlert.ID, "Packs seized"); response.Status == 200 {
+		t.Errorf("resolveAlert resolved alert %s twice", eventAlert.ID)
+	}
+	if stats := network.stats("1"); stats.AlertsActive != 1 {
+		t.Errorf("%d active alerts after one of two was resolved, want 1", stats.AlertsActive)
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+
+	"drug-traceability/gs1"
+)
+
+// FieldChange is one field that differs from the previous version of a record.
+// From is absent for fields that were added and To for fields that were removed.
+type FieldChange struct {
+	Field string      `json:"field"`
+	From  interface{} `json:"from,omitempty"`
+	To    interface{} `json:"to,omitempty"`
+}
+
+// MedicationVersion is one historical version of a medication record as written by a transaction
+type MedicationVersion struct {
+	Key       string          `json:"key"`
+	TxID      string          `json:"txId"`
+	Timestamp int64           `json:"timestamp"`
+	IsDelete  bool            `json:"isDelete"`
+	Value     *MedicationData `json:"value,omitempty"`
+	Changes   []FieldChange   `json:"changes"`
+}
+
+// MedicationAudit is the ledger history of a medication record, oldest version first
+type MedicationAudit struct {
+	MedicationID string              `json:"medicationId"`
+	Versions     []MedicationVersion `json:"versions"`
+}
+
+// getMedicationAudit returns every version of a medication record from the ledger history,
+// each with a field-level diff against the version before it. For a record migrated from a
+// legacy batch-serial ID and looked up by that ID, the history of the legacy key comes first.
+// Args: [medicationId]
+func (s *SmartContract) getMedicationAudit(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1: medicationId")
+	}
+
+	if args[0] == "" {
+		return shim.Error("Missing medication ID")
+	}
+
+	// Accept SGTIN and EPC forms, and legacy batch-serial IDs
+	medicationID, err := s.resolveMedicationID(stub, args[0])
+	if err != nil {
+		return shim.Error("Failed to resolve medication ID: " + err.Error())
+	}
+
+	keys := []string{medicationID}
+	if _, err := gs1.ParseSGTIN(args[0]); err != nil && args[0] != medicationID {
+		keys = []string{args[0], medicationID}
+	}
+
+	audit := MedicationAudit{MedicationID: medicationID, Versions: []MedicationVersion{}}
+	var previous map[string]interface{}
+	for _, key := range keys {
+		versions, err := s.getKeyHistory(stub, key)
+		if err != nil {
+			return shim.Error("Failed to get history for " + key + ": " + err.Error())
+		}
+
+		for _, version := range versions {
+			if version.IsDelete {
+				version.Changes = []FieldChange{}
+				audit.Versions = append(audit.Versions, version)
+				continue
+			}
+
+			current, err := toFieldMap(version.Value)
+			if err != nil {
+				return shim.Error("Failed to read version " + version.TxID + ": " + err.Error())
+			}
+			version.Changes = diffFields(previous, current)
+			previous = current
+
+			audit.Versions = append(audit.Versions, version)
+		}
+	}
+
+	if len(audit.Versions) == 0 {
+		return shim.Error("Medication not found: " + medicationID)
+	}
+
+	auditJSON, err := json.Marshal(audit)
+	if err != nil {
+		return shim.Error("Failed to marshal medication audit: " + err.Error())
+	}
+
+	return shim.Success(auditJSON)
+}
+
+// Helper function to read the history of one key, oldest version first.
+// Peers do not agree on the order GetHistoryForKey returns, so it is normalized here.
+func (s *SmartContract) getKeyHistory(stub shim.ChaincodeStubInterface, key string) ([]MedicationVersion, error) {
+	resultsIterator, err := stub.GetHistoryForKey(key)
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	var versions []MedicationVersion
+	var nanos []int64
+	for resultsIterator.HasNext() {
+		modification, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		version := MedicationVersion{
+			Key:      key,
+			TxID:     modification.TxId,
+			IsDelete: modification.IsDelete,
+		}
+		var nano int64
+		if modification.Timestamp != nil {
+			version.Timestamp = modification.Timestamp.Seconds
+			nano = modification.Timestamp.Seconds*1e9 + int64(modification.Timestamp.Nanos)
+		}
+
+		if !modification.IsDelete {
+			var medication MedicationData
+			err = json.Unmarshal(modification.Value, &medication)
+			if err != nil {
+				return nil, fmt.Errorf("failed to unmarshal medication in tx %s: %s", modification.TxId, err)
+			}
+			version.Value = &medication
+		}
+
+		versions = append(versions, version)
+		nanos = append(nanos, nano)
+	}
+
+	if len(versions) > 1 && nanos[0] > nanos[len(nanos)-1] {
+		for i, j := 0, len(versions)-1; i < j; i, j = i+1, j-1 {
+			versions[i], versions[j] = versions[j], versions[i]
+		}
+	}
+
+	return versions, nil
+}
+
+// toFieldMap turns a record into its JSON fields, so versions are compared by their stored form
+func toFieldMap(record interface{}) (map[string]interface{}, error) {
+	recordJSON, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+
+	var fields map[string]interface{}
+	err = json.Unmarshal(recordJSON, &fields)
+	if err != nil {
+		return nil, err
+	}
+	return fields, nil
+}
+
+// diffFields lists the fields that differ between two versions, in field name order.
+// Against no previous version every field counts as added.
+func diffFields(previous, current map[string]interface{}) []FieldChange {
+	names := make(map[string]bool)
+	for name := range previous {
+		names[name] = true
+	}
+	for name := range current {
+		names[name] = true
+	}
+
+	sortedNames := make([]string, 0, len(names))
+	for name := range names {
+		sortedNames = append(sortedNames, name)
+	}
+	sort.Strings(sortedNames)
+
+	changes := []FieldChange{}
+	for _, name := range sortedNames {
+		from, hadField := previous[name]
+		to, hasField := current[name]
+		if hadField && hasField && reflect.DeepEqual(from, to) {
+			continue
+		}
+		changes = append(changes, FieldChange{Field: name, From: from, To: to})
+	}
+	return changes
+}
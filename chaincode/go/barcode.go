@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+
+	"drug-traceability/gs1"
+)
+
+// commissionFromBarcode commissions a medication from a scanned GS1 element string carrying
+// AIs (01) GTIN, (10) batch, (21) serial number and optionally (17) expiry date
+// Args: [elementString, manufacturer, productName, location]
+func (s *SmartContract) commissionFromBarcode(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 4 {
+		return shim.Error("Incorrect number of arguments. Expecting 4: elementString, manufacturer, productName, location")
+	}
+
+	elements, err := parseMedicationBarcode(args[0])
+	if err != nil {
+		return shim.Error("Invalid barcode: " + err.Error())
+	}
+	if elements.Batch == "" {
+		return shim.Error("Invalid barcode: missing AI (10) batch")
+	}
+
+	return s.commissionMedication(stub, []string{
+		elements.GTIN,
+		elements.Batch,
+		elements.Serial,
+		elements.Expiry,
+		args[1],
+		args[2],
+		args[3],
+	})
+}
+
+// verifyByBarcode verifies the medication identified by the SGTIN in a scanned GS1 element string.
+// A pack whose batch or expiry date differ from the commissioned record is reported as suspect.
+// Args: [elementString]
+func (s *SmartContract) verifyByBarcode(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1: elementString")
+	}
+
+	elements, err := parseMedicationBarcode(args[0])
+	if err != nil {
+		return shim.Error("Invalid barcode: " + err.Error())
+	}
+
+	sgtin, err := gs1.NewSGTIN(elements.GTIN, elements.Serial)
+	if err != nil {
+		return shim.Error("Invalid barcode: " + err.Error())
+	}
+	medication, err := s.readMedication(stub, sgtin.String())
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	verificationResult, err := s.buildVerificationResult(stub, medication)
+	if err != nil {
+		return shim.Error("Failed to verify medication: " + err.Error())
+	}
+
+	// Compare the printed attributes with the commissioned record
+	if elements.Batch != "" && elements.Batch != medication.Batch {
+		verificationResult.Mismatches = append(verificationResult.Mismatches,
+			fmt.Sprintf("batch: scanned %s, commissioned %s", elements.Batch, medication.Batch))
+	}
+	if elements.Expiry != "" && medication.ExpiryDate != "" {
+		expiryDate, err := gs1.NormalizeExpiry(elements.Expiry, time.Unix(verificationResult.VerificationTime, 0))
+		if err != nil {
+			return shim.Error("Invalid barcode: AI (17): " + err.Error())
+		}
+		if expiryDate != medication.ExpiryDate {
+			verificationResult.Mismatches = append(verificationResult.Mismatches,
+				fmt.Sprintf("expiryDate: scanned %s, commissioned %s", expiryDate, medication.ExpiryDate))
+		}
+	}
+	verificationResult.assessVerdict()
+
+	resultJSON, err := json.Marshal(verificationResult)
+	if err != nil {
+		return shim.Error("Failed to marshal verification result: " + err.Error())
+	}
+
+	return shim.Success(resultJSON)
+}
+
+// parseMedicationBarcode decodes a GS1 element string and checks that it carries an SGTIN
+func parseMedicationBarcode(elementString string) (*gs1.ElementString, error) {
+	elements, err := gs1.ParseElementString(elementString)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case elements.GTIN == "":
+		return nil, fmt.Errorf("missing AI (01) GTIN")
+	case elements.Serial == "":
+		return nil, fmt.Errorf("missing AI (21) serial number")
+	}
+
+	return elements, nil
+}
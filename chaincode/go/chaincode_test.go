@@ -0,0 +1,218 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// GS1 identifiers of the test network. The GTIN falls under the manufacturer's company prefix.
+const (
+	testCompanyPrefix   = "7501001"
+	testGTIN            = "07501001234560"
+	testManufacturerGLN = "7501001000004"
+	testDistributorGLN  = "7501002000003"
+	testPharmacyGLN     = "7501003000002"
+	testRegulatorGLN    = "7501009000006"
+)
+
+// testStartTime is the transaction time of the first transaction of a test network
+var testStartTime = time.Date(2030, time.March, 10, 9, 0, 0, 0, time.UTC)
+
+// testStub is a MockStub whose transactions are submitted by a chosen identity. The fabric
+// MockStub has no creator, and only sets the arguments of the transactions it invokes itself.
+type testStub struct {
+	*shim.MockStub
+	t       *testing.T
+	cc      *SmartContract
+	creator []byte
+	args    [][]byte
+	txCount int
+	txTime  time.Time // transaction time of the next transaction
+}
+
+func (stub *testStub) GetCreator() ([]byte, error) {
+	return stub.creator, nil
+}
+
+func (stub *testStub) GetArgs() [][]byte {
+	return stub.args
+}
+
+func (stub *testStub) GetStringArgs() []string {
+	args := make([]string, 0, len(stub.args))
+	for _, arg := range stub.args {
+		args = append(args, string(arg))
+	}
+	return args
+}
+
+func (stub *testStub) GetFunctionAndParameters() (string, []string) {
+	args := stub.GetStringArgs()
+	if len(args) == 0 {
+		return "", []string{}
+	}
+	return args[0], args[1:]
+}
+
+// transact runs fn as a transaction submitted by identity at the stub's transaction time,
+// and discards the chaincode event it emits
+func (stub *testStub) transact(identity []byte, fn func()) {
+	stub.txCount++
+	txID := fmt.Sprintf("tx%04d", stub.txCount)
+
+	stub.creator = identity
+	stub.MockTransactionStart(txID)
+	stub.TxTimestamp.Seconds = stub.txTime.Unix()
+	defer stub.MockTransactionEnd(txID)
+
+	fn()
+
+	select {
+	case <-stub.ChaincodeEventsChannel:
+	default:
+	}
+}
+
+// invoke submits a chaincode function as identity
+func (stub *testStub) invoke(identity []byte, function string, args ...string) pb.Response {
+	stub.args = [][]byte{[]byte(function)}
+	for _, arg := range args {
+		stub.args = append(stub.args, []byte(arg))
+	}
+
+	var response pb.Response
+	stub.transact(identity, func() {
+		response = stub.cc.Invoke(stub)
+	})
+	return response
+}
+
+// mustInvoke submits a chaincode function as identity and fails the test unless it succeeds
+func (stub *testStub) mustInvoke(identity []byte, function string, args ...string) []byte {
+	stub.t.Helper()
+	response := stub.invoke(identity, function, args...)
+	if response.Status != shim.OK {
+		stub.t.Fatalf("%s(%q) failed: %s", function, args, response.Message)
+	}
+	return response.Payload
+}
+
+// newTestIdentity returns the serialized identity of a member of an MSP, as the peer hands it
+// to the chaincode: an msp.SerializedIdentity holding a self-signed certificate
+func newTestIdentity(t *testing.T, mspID, commonName string) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName, Organization: []string{mspID}},
+		NotBefore:    testStartTime.AddDate(-1, 0, 0),
+		NotAfter:     testStartTime.AddDate(1, 0, 0),
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %s", err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER})
+
+	// Protobuf encoding of msp.SerializedIdentity{Mspid: mspID, IdBytes: certPEM}
+	var identity []byte
+	for field, value := range [][]byte{[]byte(mspID), certPEM} {
+		identity = append(identity, byte((field+1)<<3|2))
+		identity = binary.AppendUvarint(identity, uint64(len(value)))
+		identity = append(identity, value...)
+	}
+	return identity
+}
+
+// testNetwork is a chaincode with a manufacturer, a distributor, a pharmacy and a regulator,
+// each in its own MSP and registered as a participant, and one registered product
+type testNetwork struct {
+	*testStub
+	manufacturer []byte
+	distributor  []byte
+	pharmacy     []byte
+	regulator    []byte
+}
+
+func newTestNetwork(t *testing.T) *testNetwork {
+	stub := &testStub{t: t, cc: new(SmartContract), txTime: testStartTime}
+	stub.MockStub = shim.NewMockStub("drug-traceability", stub.cc)
+
+	network := &testNetwork{
+		testStub:     stub,
+		manufacturer: newTestIdentity(t, "ManufacturerMSP", "manufacturer-admin"),
+		distributor:  newTestIdentity(t, "DistributorMSP", "distributor-admin"),
+		pharmacy:     newTestIdentity(t, "PharmacyMSP", "pharmacy-admin"),
+		regulator:    newTestIdentity(t, "RegulatorMSP", "regulator-admin"),
+	}
+
+	policy := `{"mspRoles":{"ManufacturerMSP":"manufacturer","DistributorMSP":"distributor","PharmacyMSP":"pharmacy","RegulatorMSP":"regulator"}}`
+	stub.args = [][]byte{[]byte("init"), []byte(policy)}
+	stub.transact(network.regulator, func() {
+		response := stub.cc.Init(stub)
+		if response.Status != shim.OK {
+			t.Fatalf("Init failed: %s", response.Message)
+		}
+	})
+
+	for _, participant := range []struct{ gln, name, role, mspID string }{
+		{testManufacturerGLN, "PharmaCorp", RoleManufacturer, "ManufacturerMSP"},
+		{testDistributorGLN, "MedDistrib", RoleDistributor, "DistributorMSP"},
+		{testPharmacyGLN, "Farmacia Central", RolePharmacy, "PharmacyMSP"},
+		{testRegulatorGLN, "Health Authority", RoleRegulator, "RegulatorMSP"},
+	} {
+		participantJSON, _ := json.Marshal(Participant{GLN: participant.gln, LegalName: participant.name, Role: participant.role, MSPID: participant.mspID})
+		network.mustInvoke(network.regulator, "registerParticipant", string(participantJSON))
+	}
+
+	network.mustInvoke(network.regulator, "registerCompanyPrefix", testCompanyPrefix, testManufacturerGLN)
+	network.mustInvoke(network.manufacturer, "registerProduct",
+		`{"gtin":"`+testGTIN+`","name":"Paracetamol 500mg","strength":"500 mg","dosageForm":"tablet","packSize":20,"marketingAuthorization":"MA-TEST-001","manufacturerGln":"`+testManufacturerGLN+`"}`)
+
+	return network
+}
+
+// advance moves the transaction time of the next transactions forward
+func (network *testNetwork) advance(duration time.Duration) {
+	network.txTime = network.txTime.Add(duration)
+}
+
+// commission commissions a unit of the test product expiring two years after the current
+// transaction time, and returns its medication ID
+func (network *testNetwork) commission(batch, serial string) string {
+	expiry := network.txTime.AddDate(2, 0, 0).Format(expiryDateLayout)
+	return string(network.mustInvoke(network.manufacturer, "commissionMedication",
+		testGTIN, batch, serial, expiry, testManufacturerGLN, "", "Manufacturing Plant A"))
+}
+
+// medication reads a medication record straight from the world state
+func (network *testNetwork) medication(medicationID string) *MedicationData {
+	network.t.Helper()
+	medicationJSON := network.State[medicationID]
+	if medicationJSON == nil {
+		network.t.Fatalf("medication %s not found", medicationID)
+	}
+
+	var medication MedicationData
+	err := json.Unmarshal(medicationJSON, &medication)
+	if err != nil {
+		network.t.Fatalf("failed to unmarshal medication %s: %s", medicationID, err)
+	}
+	return &medication
+}
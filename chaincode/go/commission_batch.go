@@ -0,0 +1,276 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+
+	"drug-traceability/gs1"
+)
+
+// maxCommissionBatchSize bounds the units written by one commissionBatch transaction.
+// Larger production lots are split across transactions by the client.
+const maxCommissionBatchSize = 1000
+
+// SerialRange generates the serial numbers Prefix+Start .. Prefix+(Start+Count-1),
+// with the number left-padded with zeros to Width digits
+type SerialRange struct {
+	Prefix string `json:"prefix"`
+	Start  int64  `json:"start"`
+	Count  int    `json:"count"`
+	Width  int    `json:"width,omitempty"`
+}
+
+// CommissionBatchRequest commissions many serials of one GTIN, batch and expiry date.
+// Exactly one of Serials and SerialRange must be given.
+type CommissionBatchRequest struct {
+	GTIN         string       `json:"gtin"`
+	Batch        string       `json:"batch"`
+	ExpiryDate   string       `json:"expiryDate"`
+	Manufacturer string       `json:"manufacturer"`          // GLN of a registered manufacturer participant
+	ProductName  string       `json:"productName,omitempty"` // optional, must match the registered product
+	Location     string       `json:"location"`
+	Serials      []string     `json:"serials,omitempty"`
+	SerialRange  *SerialRange `json:"serialRange,omitempty"`
+}
+
+// CommissionUnitResult reports the outcome for one serial of a batch
+type CommissionUnitResult struct {
+	SerialNumber string `json:"serialNumber"`
+	MedicationID string `json:"medicationId,omitempty"`
+	EventID      string `json:"eventId,omitempty"`
+	RecallID     string `json:"recallId,omitempty"`
+	Error        string `json:"error,omitempty"`
+}
+
+// serials expands the request into the list of serial numbers to commission
+func (request *CommissionBatchRequest) serials() ([]string, error) {
+	if (len(request.Serials) > 0) == (request.SerialRange != nil) {
+		return nil, fmt.Errorf("expecting exactly one of serials and serialRange")
+	}
+	if request.SerialRange == nil {
+		return request.Serials, nil
+	}
+
+	serialRange := request.SerialRange
+	if serialRange.Count <= 0 {
+		return nil, fmt.Errorf("serialRange count must be positive")
+	}
+	if serialRange.Start < 0 {
+		return nil, fmt.Errorf("serialRange start must not be negative")
+	}
+	if serialRange.Count > maxCommissionBatchSize {
+		return nil, fmt.Errorf("serialRange count %d exceeds the maximum of %d units per transaction", serialRange.Count, maxCommissionBatchSize)
+	}
+
+	serials := make([]string, serialRange.Count)
+	for i := range serials {
+		serials[i] = fmt.Sprintf("%s%0*d", serialRange.Prefix, serialRange.Width, serialRange.Start+int64(i))
+	}
+	return serials, nil
+}
+
+// commissionBatch commissions a list or range of serials of one production lot in a single
+// transaction. Every unit is validated first; if any is rejected nothing is written and the
+// error lists the rejected serials. Otherwise the per-unit results are returned.
+// Args: [batchRequestJSON]
+func (s *SmartContract) commissionBatch(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1: batchRequest")
+	}
+
+	var request CommissionBatchRequest
+	err := json.Unmarshal([]byte(args[0]), &request)
+	if err != nil {
+		return shim.Error("Failed to unmarshal batch request: " + err.Error())
+	}
+
+	if request.GTIN == "" || request.Batch == "" || request.Manufacturer == "" {
+		return shim.Error("Missing required fields: gtin, batch, manufacturer")
+	}
+
+	serials, err := request.serials()
+	if err != nil {
+		return shim.Error("Invalid batch request: " + err.Error())
+	}
+	if len(serials) > maxCommissionBatchSize {
+		return shim.Error("Batch of " + strconv.Itoa(len(serials)) + " units exceeds the maximum of " + strconv.Itoa(maxCommissionBatchSize) + " units per transaction")
+	}
+
+	txTime, err := getTxTime(stub)
+	if err != nil {
+		return shim.Error("Failed to read transaction timestamp: " + err.Error())
+	}
+
+	// Validate the fields shared by every unit
+	gtin, err := gs1.NormalizeGTIN(request.GTIN)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = gs1.ValidateBatch(request.Batch)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	expiryDate := request.ExpiryDate
+	if expiryDate != "" {
+		expiryDate, err = gs1.NormalizeExpiry(expiryDate, time.Unix(txTime, 0))
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	submitter, err := getSubmitterIdentity(stub)
+	if err != nil {
+		return shim.Error("Failed to resolve submitter identity: " + err.Error())
+	}
+
+	// Units can only be commissioned under the submitting organization's company prefixes
+	_, err = s.checkCompanyPrefixOwner(stub, gtin, submitter.MSPID)
+	if err != nil {
+		return shim.Error("Access denied: " + err.Error())
+	}
+
+	manufacturer, err := s.resolveActingParticipant(stub, request.Manufacturer, submitter, RoleManufacturer)
+	if err != nil {
+		return shim.Error("Invalid manufacturer: " + err.Error())
+	}
+
+	product, err := s.resolveCommissionedProduct(stub, gtin, manufacturer, request.ProductName)
+	if err != nil {
+		return shim.Error("Invalid product: " + err.Error())
+	}
+
+	// Validate every unit before writing anything
+	results := make([]CommissionUnitResult, len(serials))
+	var rejected []CommissionUnitResult
+	seen := make(map[string]bool, len(serials))
+	for i, serial := range serials {
+		results[i] = CommissionUnitResult{SerialNumber: serial}
+
+		sgtin, err := gs1.NewSGTIN(gtin, serial)
+		switch {
+		case err != nil:
+			results[i].Error = err.Error()
+		case seen[serial]:
+			results[i].Error = "duplicate serial number in batch"
+		default:
+			seen[serial] = true
+			results[i].MedicationID = sgtin.String()
+
+			existingData, err := stub.GetState(results[i].MedicationID)
+			if err != nil {
+				return shim.Error("Failed to read from world state: " + err.Error())
+			}
+			if existingData != nil {
+				results[i].Error = "medication already exists"
+			}
+		}
+
+		if results[i].Error != "" {
+			rejected = append(rejected, results[i])
+		}
+	}
+
+	if len(rejected) > 0 {
+		rejectedJSON, err := json.Marshal(rejected)
+		if err != nil {
+			return shim.Error("Failed to marshal rejected units: " + err.Error())
+		}
+		return shim.Error(fmt.Sprintf("Batch rejected, %d of %d units are invalid: %s", len(rejected), len(serials), rejectedJSON))
+	}
+
+	// Open recalls are loaded once and updated in memory while the units are written
+	recalls, err := s.getActiveRecallsForGTIN(stub, gtin)
+	if err != nil {
+		return shim.Error("Failed to get open recalls: " + err.Error())
+	}
+
+	recalledUnits := 0
+	touchedRecalls := make(map[string]*Recall)
+	for i := range results {
+		medication := MedicationData{
+			ID:              results[i].MedicationID,
+			GTIN:            gtin,
+			Batch:           request.Batch,
+			SerialNumber:    results[i].SerialNumber,
+			ExpiryDate:      expiryDate,
+			Manufacturer:    manufacturer.LegalName,
+			ManufacturerMSP: submitter.MSPID,
+			ManufacturerGLN: manufacturer.GLN,
+			ProductName:     product.Name,
+			ProductVersion:  product.Version,
+			Location:        request.Location,
+			Timestamp:       txTime,
+			TransactionHash: stub.GetTxID(),
+			Status:          StatusCommissioned,
+			CommissionTime:  txTime,
+		}
+
+		commissionEvent, recall, err := s.commissionUnit(stub, &medication, submitter, recalls)
+		if err != nil {
+			return shim.Error("Failed to commission medication " + medication.ID + ": " + err.Error())
+		}
+
+		results[i].EventID = commissionEvent.ID
+		if recall != nil {
+			results[i].RecallID = recall.ID
+			touchedRecalls[recall.ID] = recall
+			recalledUnits++
+		}
+	}
+
+	for _, recall := range recalls {
+		if touchedRecalls[recall.ID] == nil {
+			continue
+		}
+		err = s.putRecall(stub, recall)
+		if err != nil {
+			return shim.Error("Failed to update recall: " + err.Error())
+		}
+	}
+
+	var response = struct {
+		GTIN          string                 `json:"gtin"`
+		Batch         string                 `json:"batch"`
+		UnitCount     int                    `json:"unitCount"`
+		RecalledUnits int                    `json:"recalledUnits"`
+		Results       []CommissionUnitResult `json:"results"`
+	}{
+		GTIN:          gtin,
+		Batch:         request.Batch,
+		UnitCount:     len(results),
+		RecalledUnits: recalledUnits,
+		Results:       results,
+	}
+
+	responseJSON, err := json.Marshal(response)
+	if err != nil {
+		return shim.Error("Failed to marshal batch results: " + err.Error())
+	}
+
+	err = s.emitEvent(stub, EventNameMedicationBatchCommissioned, MedicationBatchCommissionedEvent{
+		GTIN:              gtin,
+		Batch:             request.Batch,
+		ExpiryDate:        expiryDate,
+		Manufacturer:      manufacturer.LegalName,
+		ManufacturerMSP:   submitter.MSPID,
+		ManufacturerGLN:   manufacturer.GLN,
+		Location:          request.Location,
+		UnitCount:         len(results),
+		FirstMedicationID: results[0].MedicationID,
+		LastMedicationID:  results[len(results)-1].MedicationID,
+		RecalledUnits:     recalledUnits,
+	})
+	if err != nil {
+		return shim.Error("Failed to emit chaincode event: " + err.Error())
+	}
+
+	fmt.Printf("Commissioned %d units of GTIN %s batch %s\n", len(results), gtin, request.Batch)
+	return shim.Success(responseJSON)
+}
@@ -0,0 +1,446 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+
+	"drug-traceability/gs1"
+)
+
+// Composite key object type of the company prefix registry
+const companyPrefixKeyType = "companyPrefix~prefix"
+
+// CompanyPrefix is a GS1 company prefix and the manufacturer that owns it. Products can only
+// be registered and units commissioned under GTINs whose prefix the submitting MSP owns.
+type CompanyPrefix struct {
+	Prefix       string                  `json:"prefix"`
+	OwnerGLN     string                  `json:"ownerGln"`
+	OwnerMSP     string                  `json:"ownerMspId"`
+	RegisteredBy *SubmitterIdentity      `json:"registeredBy"`
+	RegisteredAt int64                   `json:"registeredAt"`
+	Transfers    []CompanyPrefixTransfer `json:"transfers"` // oldest first
+}
+
+// CompanyPrefixTransfer records a change of ownership of a company prefix
+type CompanyPrefixTransfer struct {
+	FromGLN       string             `json:"fromGln"`
+	FromMSP       string             `json:"fromMspId"`
+	ToGLN         string             `json:"toGln"`
+	ToMSP         string             `json:"toMspId"`
+	Reason        string             `json:"reason"`
+	ProductsMoved int                `json:"productsMoved"`
+	TransferredBy *SubmitterIdentity `json:"transferredBy"`
+	TransferredAt int64              `json:"transferredAt"`
+	TransactionID string             `json:"transactionId"`
+}
+
+// registerCompanyPrefix records a GS1 company prefix as owned by a manufacturer participant.
+// Owning a prefix lets an MSP commission its GTINs, so only regulators may register prefixes,
+// after checking the licence with GS1. Prefixes may not overlap: a prefix that extends or is
+// extended by a registered prefix is rejected.
+// Args: [prefix, ownerGln]
+func (s *SmartContract) registerCompanyPrefix(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2: prefix, ownerGln")
+	}
+
+	isRegulator, err := s.callerHasRole(stub, RoleRegulator)
+	if err != nil {
+		return shim.Error("Access denied: " + err.Error())
+	}
+	if !isRegulator {
+		return shim.Error("Access denied: only regulators may register company prefixes")
+	}
+
+	prefix := args[0]
+	err = gs1.ValidateCompanyPrefix(prefix)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	registered, err := s.getCompanyPrefixes(stub)
+	if err != nil {
+		return shim.Error("Failed to get company prefixes: " + err.Error())
+	}
+	for _, existing := range registered {
+		if strings.HasPrefix(prefix, existing.Prefix) || strings.HasPrefix(existing.Prefix, prefix) {
+			return shim.Error("Company prefix " + prefix + " overlaps prefix " + existing.Prefix + " owned by " + existing.OwnerGLN)
+		}
+	}
+
+	submitter, err := getSubmitterIdentity(stub)
+	if err != nil {
+		return shim.Error("Failed to resolve submitter identity: " + err.Error())
+	}
+
+	owner, err := s.readParticipant(stub, args[1])
+	if err != nil {
+		return shim.Error("Invalid owner: " + err.Error())
+	}
+	if owner.Role != RoleManufacturer {
+		return shim.Error("Participant " + owner.GLN + " is a " + owner.Role + ", not a " + RoleManufacturer)
+	}
+	if owner.Status != ParticipantStatusActive {
+		return shim.Error("Participant " + owner.GLN + " is " + owner.Status)
+	}
+
+	txTime, err := getTxTime(stub)
+	if err != nil {
+		return shim.Error("Failed to read transaction timestamp: " + err.Error())
+	}
+
+	companyPrefix := CompanyPrefix{
+		Prefix:       prefix,
+		OwnerGLN:     owner.GLN,
+		OwnerMSP:     owner.MSPID,
+		RegisteredBy: submitter,
+		RegisteredAt: txTime,
+		Transfers:    []CompanyPrefixTransfer{},
+	}
+
+	err = s.putCompanyPrefix(stub, &companyPrefix)
+	if err != nil {
+		return shim.Error("Failed to put company prefix to world state: " + err.Error())
+	}
+
+	err = s.emitEvent(stub, EventNameCompanyPrefixRegistered, CompanyPrefixEvent{
+		Prefix:         prefix,
+		OwnerGLN:       owner.GLN,
+		OwnerMSPID:     owner.MSPID,
+		SubmitterMSPID: submitter.MSPID,
+	})
+	if err != nil {
+		return shim.Error("Failed to emit chaincode event: " + err.Error())
+	}
+
+	fmt.Printf("Company prefix %s registered to %s\n", prefix, owner.GLN)
+	return companyPrefixResponse(&companyPrefix)
+}
+
+// transferCompanyPrefix hands a company prefix to another manufacturer participant, e.g. when
+// a product line is acquired. The registered products under the prefix move with it; units
+// already commissioned keep their manufacturer. Only the owning MSP or a regulator may transfer.
+// Args: [prefix, newOwnerGln, reason]
+func (s *SmartContract) transferCompanyPrefix(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 3: prefix, newOwnerGln, reason")
+	}
+
+	if args[2] == "" {
+		return shim.Error("Missing transfer reason")
+	}
+
+	companyPrefix, err := s.readCompanyPrefix(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	submitter, err := getSubmitterIdentity(stub)
+	if err != nil {
+		return shim.Error("Failed to resolve submitter identity: " + err.Error())
+	}
+
+	isRegulator, err := s.callerHasRole(stub, RoleRegulator)
+	if err != nil {
+		return shim.Error("Access denied: " + err.Error())
+	}
+	if !isRegulator && companyPrefix.OwnerMSP != submitter.MSPID {
+		return shim.Error("Access denied: only the owning MSP or a regulator may transfer company prefix " + companyPrefix.Prefix)
+	}
+
+	newOwner, err := s.readParticipant(stub, args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if newOwner.Role != RoleManufacturer {
+		return shim.Error("Participant " + newOwner.GLN + " is a " + newOwner.Role + ", not a " + RoleManufacturer)
+	}
+	if newOwner.Status != ParticipantStatusActive {
+		return shim.Error("Participant " + newOwner.GLN + " is " + newOwner.Status)
+	}
+	if newOwner.GLN == companyPrefix.OwnerGLN {
+		return shim.Error("Company prefix " + companyPrefix.Prefix + " is already owned by " + newOwner.GLN)
+	}
+
+	txTime, err := getTxTime(stub)
+	if err != nil {
+		return shim.Error("Failed to read transaction timestamp: " + err.Error())
+	}
+
+	productsMoved, err := s.moveProductsUnderPrefix(stub, companyPrefix.Prefix, newOwner.GLN, submitter, txTime)
+	if err != nil {
+		return shim.Error("Failed to transfer products: " + err.Error())
+	}
+
+	transfer := CompanyPrefixTransfer{
+		FromGLN:       companyPrefix.OwnerGLN,
+		FromMSP:       companyPrefix.OwnerMSP,
+		ToGLN:         newOwner.GLN,
+		ToMSP:         newOwner.MSPID,
+		Reason:        args[2],
+		ProductsMoved: productsMoved,
+		TransferredBy: submitter,
+		TransferredAt: txTime,
+		TransactionID: stub.GetTxID(),
+	}
+	companyPrefix.Transfers = append(companyPrefix.Transfers, transfer)
+	companyPrefix.OwnerGLN = newOwner.GLN
+	companyPrefix.OwnerMSP = newOwner.MSPID
+
+	err = s.putCompanyPrefix(stub, companyPrefix)
+	if err != nil {
+		return shim.Error("Failed to put company prefix to world state: " + err.Error())
+	}
+
+	err = s.emitEvent(stub, EventNameCompanyPrefixTransferred, CompanyPrefixEvent{
+		Prefix:             companyPrefix.Prefix,
+		OwnerGLN:           transfer.ToGLN,
+		OwnerMSPID:         transfer.ToMSP,
+		PreviousOwnerGLN:   transfer.FromGLN,
+		PreviousOwnerMSPID: transfer.FromMSP,
+		ProductsMoved:      productsMoved,
+		SubmitterMSPID:     submitter.MSPID,
+	})
+	if err != nil {
+		return shim.Error("Failed to emit chaincode event: " + err.Error())
+	}
+
+	fmt.Printf("Company prefix %s transferred from %s to %s with %d products\n", companyPrefix.Prefix, transfer.FromGLN, transfer.ToGLN, productsMoved)
+	return companyPrefixResponse(companyPrefix)
+}
+
+// revokeCompanyPrefix removes a company prefix from the registry, e.g. one registered in error
+// or whose GS1 licence lapsed. Units already commissioned under it are kept, but no more can
+// be commissioned until a regulator registers it again. Only regulators may revoke.
+// Args: [prefix, reason]
+func (s *SmartContract) revokeCompanyPrefix(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2: prefix, reason")
+	}
+
+	if args[1] == "" {
+		return shim.Error("Missing revocation reason")
+	}
+
+	isRegulator, err := s.callerHasRole(stub, RoleRegulator)
+	if err != nil {
+		return shim.Error("Access denied: " + err.Error())
+	}
+	if !isRegulator {
+		return shim.Error("Access denied: only regulators may revoke company prefixes")
+	}
+
+	companyPrefix, err := s.readCompanyPrefix(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	submitter, err := getSubmitterIdentity(stub)
+	if err != nil {
+		return shim.Error("Failed to resolve submitter identity: " + err.Error())
+	}
+
+	companyPrefixKey, err := stub.CreateCompositeKey(companyPrefixKeyType, []string{companyPrefix.Prefix})
+	if err != nil {
+		return shim.Error("Failed to create company prefix key: " + err.Error())
+	}
+
+	err = stub.DelState(companyPrefixKey)
+	if err != nil {
+		return shim.Error("Failed to delete company prefix from world state: " + err.Error())
+	}
+
+	err = s.emitEvent(stub, EventNameCompanyPrefixRevoked, CompanyPrefixEvent{
+		Prefix:         companyPrefix.Prefix,
+		OwnerGLN:       companyPrefix.OwnerGLN,
+		OwnerMSPID:     companyPrefix.OwnerMSP,
+		Reason:         args[1],
+		SubmitterMSPID: submitter.MSPID,
+	})
+	if err != nil {
+		return shim.Error("Failed to emit chaincode event: " + err.Error())
+	}
+
+	fmt.Printf("Company prefix %s of %s revoked\n", companyPrefix.Prefix, companyPrefix.OwnerGLN)
+	return companyPrefixResponse(companyPrefix)
+}
+
+// getCompanyPrefix returns a company prefix with its owner and transfer history
+// Args: [prefix]
+func (s *SmartContract) getCompanyPrefix(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1: prefix")
+	}
+
+	companyPrefix, err := s.readCompanyPrefix(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return companyPrefixResponse(companyPrefix)
+}
+
+func companyPrefixResponse(companyPrefix *CompanyPrefix) pb.Response {
+	companyPrefixJSON, err := json.Marshal(companyPrefix)
+	if err != nil {
+		return shim.Error("Failed to marshal company prefix: " + err.Error())
+	}
+	return shim.Success(companyPrefixJSON)
+}
+
+// Helper function to check that a GTIN falls under a company prefix owned by an MSP
+func (s *SmartContract) checkCompanyPrefixOwner(stub shim.ChaincodeStubInterface, gtin string, mspID string) (*CompanyPrefix, error) {
+	companyPrefix, err := s.findCompanyPrefixForGTIN(stub, gtin)
+	if err != nil {
+		return nil, err
+	}
+	if companyPrefix == nil {
+		return nil, fmt.Errorf("GTIN %s is not under a registered company prefix", gtin)
+	}
+	if companyPrefix.OwnerMSP != mspID {
+		return nil, fmt.Errorf("GTIN %s is under company prefix %s owned by MSP %s", gtin, companyPrefix.Prefix, companyPrefix.OwnerMSP)
+	}
+	return companyPrefix, nil
+}
+
+// Helper function to find the registered company prefix a GTIN falls under, or nil
+func (s *SmartContract) findCompanyPrefixForGTIN(stub shim.ChaincodeStubInterface, gtin string) (*CompanyPrefix, error) {
+	candidates, err := gs1.CompanyPrefixCandidates(gtin)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, candidate := range candidates {
+		companyPrefix, err := s.findCompanyPrefix(stub, candidate)
+		if err != nil {
+			return nil, err
+		}
+		if companyPrefix != nil {
+			return companyPrefix, nil
+		}
+	}
+	return nil, nil
+}
+
+// Helper function to hand the registered products under a company prefix to a new owner
+func (s *SmartContract) moveProductsUnderPrefix(stub shim.ChaincodeStubInterface, prefix string, ownerGLN string, submitter *SubmitterIdentity, txTime int64) (int, error) {
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(productKeyType, []string{})
+	if err != nil {
+		return 0, err
+	}
+	defer resultsIterator.Close()
+
+	var products []Product
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return 0, err
+		}
+
+		var product Product
+		err = json.Unmarshal(queryResponse.Value, &product)
+		if err != nil {
+			return 0, fmt.Errorf("failed to unmarshal product %s: %s", queryResponse.Key, err)
+		}
+
+		// The company prefix follows the indicator digit of the GTIN-14
+		if strings.HasPrefix(product.GTIN[1:], prefix) {
+			products = append(products, product)
+		}
+	}
+
+	for i := range products {
+		products[i].ManufacturerGLN = ownerGLN
+		products[i].Version++
+		products[i].UpdatedBy = submitter
+		products[i].UpdatedAt = txTime
+
+		err = s.putProduct(stub, &products[i])
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return len(products), nil
+}
+
+// Helper function to list every registered company prefix
+func (s *SmartContract) getCompanyPrefixes(stub shim.ChaincodeStubInterface) ([]CompanyPrefix, error) {
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(companyPrefixKeyType, []string{})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	var companyPrefixes []CompanyPrefix
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		var companyPrefix CompanyPrefix
+		err = json.Unmarshal(queryResponse.Value, &companyPrefix)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal company prefix %s: %s", queryResponse.Key, err)
+		}
+		companyPrefixes = append(companyPrefixes, companyPrefix)
+	}
+
+	return companyPrefixes, nil
+}
+
+// Helper function to find a company prefix, or nil
+func (s *SmartContract) findCompanyPrefix(stub shim.ChaincodeStubInterface, prefix string) (*CompanyPrefix, error) {
+	companyPrefixKey, err := stub.CreateCompositeKey(companyPrefixKeyType, []string{prefix})
+	if err != nil {
+		return nil, err
+	}
+
+	companyPrefixJSON, err := stub.GetState(companyPrefixKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read company prefix from world state: %s", err)
+	}
+	if companyPrefixJSON == nil {
+		return nil, nil
+	}
+
+	var companyPrefix CompanyPrefix
+	err = json.Unmarshal(companyPrefixJSON, &companyPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal company prefix: %s", err)
+	}
+
+	return &companyPrefix, nil
+}
+
+// Helper function to read a company prefix that must exist
+func (s *SmartContract) readCompanyPrefix(stub shim.ChaincodeStubInterface, prefix string) (*CompanyPrefix, error) {
+	companyPrefix, err := s.findCompanyPrefix(stub, prefix)
+	if err != nil {
+		return nil, err
+	}
+	if companyPrefix == nil {
+		return nil, fmt.Errorf("company prefix not found: %s", prefix)
+	}
+	return companyPrefix, nil
+}
+
+// Helper function to store a company prefix
+func (s *SmartContract) putCompanyPrefix(stub shim.ChaincodeStubInterface, companyPrefix *CompanyPrefix) error {
+	companyPrefixKey, err := stub.CreateCompositeKey(companyPrefixKeyType, []string{companyPrefix.Prefix})
+	if err != nil {
+		return err
+	}
+
+	companyPrefixJSON, err := json.Marshal(companyPrefix)
+	if err != nil {
+		return err
+	}
+
+	return stub.PutState(companyPrefixKey, companyPrefixJSON)
+}
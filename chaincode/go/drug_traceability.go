@@ -1,13 +1,27 @@
 package main
 
 import (
-	"bytes"
 	"encoding/json"
 	"fmt"
+	"sort"
+	"strconv"
 	"time"
 
 	"github.com/hyperledger/fabric/core/chaincode/shim"
 	pb "github.com/hyperledger/fabric/protos/peer"
+
+	"drug-traceability/eventchain"
+	"drug-traceability/gs1"
+)
+
+// Composite key object types used to index the world state
+const (
+	eventKeyType         = "event~medicationId~seq"
+	manufacturerKeyType  = "manufacturer~medicationId"
+	gtinKeyType          = "gtin~batch~medicationId"
+	statusKeyType        = "status~medicationId"
+	expiryKeyType        = "expiry~date~medicationId"
+	legacyTrackingPrefix = "tracking_"
 )
 
 // SmartContract defines the chaincode structure
@@ -16,43 +30,99 @@ type SmartContract struct {
 
 // MedicationData represents a medication record
 type MedicationData struct {
-	ID              string `json:"id"`
-	GTIN            string `json:"gtin"`
-	Batch           string `json:"batch"`
-	SerialNumber    string `json:"serialNumber"`
-	ExpiryDate      string `json:"expiryDate"`
-	Manufacturer    string `json:"manufacturer"`
-	ProductName     string `json:"productName"`
-	Location        string `json:"location"`
-	Timestamp       int64  `json:"timestamp"`
-	TransactionHash string `json:"transactionHash"`
-	Status          string `json:"status"`
-	CommissionTime  int64  `json:"commissionTime"`
-	RecallReason    string `json:"recallReason,omitempty"`
+	ID              string             `json:"id"`
+	GTIN            string             `json:"gtin"`
+	Batch           string             `json:"batch"`
+	SerialNumber    string             `json:"serialNumber"`
+	ExpiryDate      string             `json:"expiryDate"`
+	Manufacturer    string             `json:"manufacturer"`
+	ManufacturerMSP string             `json:"manufacturerMspId,omitempty"`
+	ManufacturerGLN string             `json:"manufacturerGln,omitempty"`
+	ProductName     string             `json:"productName"`
+	ProductVersion  int                `json:"productVersion,omitempty"` // version of the product master data commissioned under
+	Location        string             `json:"location"`
+	Timestamp       int64              `json:"timestamp"`
+	TransactionHash string             `json:"transactionHash"`
+	Status          string             `json:"status"`
+	CommissionTime  int64              `json:"commissionTime"`
+	RecallReason    string             `json:"recallReason,omitempty"`
+	RecalledBy      *SubmitterIdentity `json:"recalledBy,omitempty"`
+	RecallID        string             `json:"recallId,omitempty"`
+	PreRecallStatus string             `json:"preRecallStatus,omitempty"`
+	ParentSSCC      string             `json:"parentSscc,omitempty"`
+	EventCount      int                `json:"eventCount"`
+	HeadHash        string             `json:"headHash,omitempty"` // hash of the latest tracking event
 }
 
 // TrackingEvent represents a tracking event for medication
+// Actor is a display label only; Submitter is the identity that actually signed the transaction.
 type TrackingEvent struct {
-	ID           string `json:"id"`
-	Event        string `json:"event"` // commission, ship, receive, dispense, recall
-	Location     string `json:"location"`
-	Timestamp    int64  `json:"timestamp"`
-	Actor        string `json:"actor"`
-	MedicationID string `json:"medicationId"`
-	Signature    string `json:"signature,omitempty"`
+	ID             string             `json:"id"`
+	Event          string             `json:"event"` // commission, ship, receive, dispense, recall, destroy, return, lift_recall, pack, unpack, repack
+	Location       string             `json:"location"`
+	Timestamp      int64              `json:"timestamp"`
+	Actor          string             `json:"actor"`
+	Submitter      *SubmitterIdentity `json:"submitter,omitempty"`
+	MedicationID   string             `json:"medicationId"`
+	RecallID       string             `json:"recallId,omitempty"`
+	ContainerSSCC  string             `json:"containerSscc,omitempty"`
+	ContainerTxID  string             `json:"containerTxId,omitempty"` // lastTxId of the container when a container event was signed
+	Signature      string             `json:"signature,omitempty"`
+	SignedSubject  string             `json:"signedSubject,omitempty"`  // medicationId the signature covers, if a migration changed it
+	SignedPrevious string             `json:"signedPrevious,omitempty"` // prevHash the signature covers, set with SignedSubject
+	PrevHash       string             `json:"prevHash,omitempty"`       // hash of the previous event of the medication
+	Hash           string             `json:"hash,omitempty"`           // see package eventchain
 }
 
 // VerificationResult represents the result of medication verification
 type VerificationResult struct {
-	IsValid          bool            `json:"isValid"`
-	MedicationData   *MedicationData `json:"medicationData"`
-	TrackingHistory  []TrackingEvent `json:"trackingHistory"`
-	CurrentHolder    string          `json:"currentHolder,omitempty"`
-	VerificationTime int64           `json:"verificationTime"`
+	IsValid          bool              `json:"isValid"` // the verdict is authentic
+	Verdict          Verdict           `json:"verdict"`
+	MedicationData   *MedicationData   `json:"medicationData"`
+	TrackingHistory  []TrackingEvent   `json:"trackingHistory"`
+	Product          *Product          `json:"product,omitempty"` // master data of the GTIN, if registered
+	CurrentHolder    string            `json:"currentHolder,omitempty"`
+	ContainerChain   []Container       `json:"containerChain,omitempty"` // enclosing containers, innermost first
+	Mismatches       []string          `json:"mismatches,omitempty"`     // scanned attributes that differ from the record
+	EventChain       eventchain.Report `json:"eventChain"`
+	Signatures       []SignatureCheck  `json:"signatures"` // per tracking event, in history order
+	Alerts           []CloneAlert      `json:"alerts"`     // clone alerts raised by recorded verifications, oldest first
+	VerificationTime int64             `json:"verificationTime"`
 }
 
-// Init initializes the chaincode
+// Init initializes the chaincode and stores the access policy, merged with the default restrictions.
+// Without arguments an existing policy is kept, or the default policy is stored on first instantiation.
+// Args: [accessPolicyJSON] (optional)
 func (s *SmartContract) Init(stub shim.ChaincodeStubInterface) pb.Response {
+	_, args := stub.GetFunctionAndParameters()
+	if len(args) > 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 0 or 1: accessPolicy")
+	}
+
+	policy, err := s.getAccessPolicy(stub)
+	if err != nil {
+		return shim.Error("Failed to read access policy: " + err.Error())
+	}
+
+	if len(args) == 1 && args[0] != "" {
+		policy = &AccessPolicy{}
+		err = json.Unmarshal([]byte(args[0]), policy)
+		if err != nil {
+			return shim.Error("Failed to unmarshal access policy: " + err.Error())
+		}
+		policy.mergeDefaults()
+	}
+
+	err = policy.validate()
+	if err != nil {
+		return shim.Error("Invalid access policy: " + err.Error())
+	}
+
+	err = s.putAccessPolicy(stub, policy)
+	if err != nil {
+		return shim.Error("Failed to put access policy to world state: " + err.Error())
+	}
+
 	fmt.Println("Drug Traceability Chaincode initialized")
 	return shim.Success(nil)
 }
@@ -62,44 +132,179 @@ func (s *SmartContract) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
 	function, args := stub.GetFunctionAndParameters()
 	fmt.Printf("Function: %s, Args: %v\n", function, args)
 
+	err := s.authorize(stub, function, args)
+	if err != nil {
+		return shim.Error("Access denied: " + err.Error())
+	}
+
 	switch function {
 	case "commissionMedication":
 		return s.commissionMedication(stub, args)
+	case "commissionBatch":
+		return s.commissionBatch(stub, args)
 	case "addTrackingEvent":
 		return s.addTrackingEvent(stub, args)
 	case "verifyMedication":
 		return s.verifyMedication(stub, args)
+	case "commissionFromBarcode":
+		return s.commissionFromBarcode(stub, args)
+	case "verifyByBarcode":
+		return s.verifyByBarcode(stub, args)
 	case "issueMedicationRecall":
 		return s.issueMedicationRecall(stub, args)
+	case "issueRecall":
+		return s.issueRecall(stub, args)
+	case "getRecall":
+		return s.getRecall(stub, args)
+	case "updateRecall":
+		return s.updateRecall(stub, args)
+	case "acknowledgeRecall":
+		return s.acknowledgeRecall(stub, args)
+	case "getRecallAcknowledgements":
+		return s.getRecallAcknowledgements(stub, args)
+	case "liftRecall":
+		return s.liftRecall(stub, args)
+	case "getRecallEffectiveness":
+		return s.getRecallEffectiveness(stub, args)
+	case "packContainer":
+		return s.packContainer(stub, args)
+	case "unpackContainer":
+		return s.unpackContainer(stub, args)
+	case "repackContainer":
+		return s.repackContainer(stub, args)
+	case "addContainerEvent":
+		return s.addContainerEvent(stub, args)
+	case "getContainer":
+		return s.getContainer(stub, args)
 	case "getMedication":
 		return s.getMedication(stub, args)
 	case "getTrackingHistory":
 		return s.getTrackingHistory(stub, args)
+	case "getMedicationAudit":
+		return s.getMedicationAudit(stub, args)
 	case "getMedicationsByManufacturer":
 		return s.getMedicationsByManufacturer(stub, args)
+	case "getMedicationsByManufacturerPaged":
+		return s.getMedicationsByManufacturerPaged(stub, args)
+	case "getExpiringMedications":
+		return s.getExpiringMedications(stub, args)
+	case "recordVerification":
+		return s.recordVerification(stub, args)
+	case "getVerificationLog":
+		return s.getVerificationLog(stub, args)
+	case "resolveAlert":
+		return s.resolveAlert(stub, args)
 	case "getVerificationStats":
 		return s.getVerificationStats(stub, args)
 	case "searchMedications":
 		return s.searchMedications(stub, args)
+	case "searchMedicationsPaged":
+		return s.searchMedicationsPaged(stub, args)
+	case "migrateTrackingEvents":
+		return s.migrateTrackingEvents(stub, args)
+	case "migrateMedicationIDs":
+		return s.migrateMedicationIDs(stub, args)
+	case "registerSigningKey":
+		return s.registerSigningKey(stub, args)
+	case "revokeSigningKey":
+		return s.revokeSigningKey(stub, args)
+	case "getSigningKeys":
+		return s.getSigningKeys(stub, args)
+	case "registerParticipant":
+		return s.registerParticipant(stub, args)
+	case "updateParticipant":
+		return s.updateParticipant(stub, args)
+	case "setParticipantStatus":
+		return s.setParticipantStatus(stub, args)
+	case "getParticipant":
+		return s.getParticipant(stub, args)
+	case "registerProduct":
+		return s.registerProduct(stub, args)
+	case "updateProduct":
+		return s.updateProduct(stub, args)
+	case "getProduct":
+		return s.getProduct(stub, args)
+	case "registerCompanyPrefix":
+		return s.registerCompanyPrefix(stub, args)
+	case "transferCompanyPrefix":
+		return s.transferCompanyPrefix(stub, args)
+	case "revokeCompanyPrefix":
+		return s.revokeCompanyPrefix(stub, args)
+	case "getCompanyPrefix":
+		return s.getCompanyPrefix(stub, args)
+	case "getAccessPolicy":
+		return s.getAccessPolicyConfig(stub, args)
 	default:
 		return shim.Error("Received unknown function invocation: " + function)
 	}
 }
 
-// commissionMedication creates a new medication record
-// Args: [gtin, batch, serialNumber, expiryDate, manufacturer, productName, location]
+// commissionMedication creates a new medication record. The manufacturer is named by the GLN
+// of a registered manufacturer participant of the submitting MSP, and the GTIN must be a
+// registered product it owns under a company prefix of the submitting MSP. The product name is optional and must match the registered name.
+// Args: [gtin, batch, serialNumber, expiryDate, manufacturerGln, productName, location]
 func (s *SmartContract) commissionMedication(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	if len(args) != 7 {
 		return shim.Error("Incorrect number of arguments. Expecting 7: gtin, batch, serialNumber, expiryDate, manufacturer, productName, location")
 	}
 
 	// Validate required fields
-	if args[0] == "" || args[1] == "" || args[2] == "" || args[4] == "" || args[5] == "" {
-		return shim.Error("Missing required fields: gtin, batch, serialNumber, manufacturer, productName")
+	if args[0] == "" || args[1] == "" || args[2] == "" || args[4] == "" {
+		return shim.Error("Missing required fields: gtin, batch, serialNumber, manufacturer")
 	}
 
-	// Create medication ID (batch + serialNumber)
-	medicationID := args[1] + "-" + args[2]
+	txTime, err := getTxTime(stub)
+	if err != nil {
+		return shim.Error("Failed to read transaction timestamp: " + err.Error())
+	}
+
+	// Validate GS1 fields; GTINs are stored as GTIN-14 and expiry dates as YYYY-MM-DD
+	gtin, err := gs1.NormalizeGTIN(args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = gs1.ValidateBatch(args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	sgtin, err := gs1.NewSGTIN(gtin, args[2])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	expiryDate := args[3]
+	if expiryDate != "" {
+		expiryDate, err = gs1.NormalizeExpiry(expiryDate, time.Unix(txTime, 0))
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	submitter, err := getSubmitterIdentity(stub)
+	if err != nil {
+		return shim.Error("Failed to resolve submitter identity: " + err.Error())
+	}
+
+	// Units can only be commissioned under the submitting organization's company prefixes
+	_, err = s.checkCompanyPrefixOwner(stub, gtin, submitter.MSPID)
+	if err != nil {
+		return shim.Error("Access denied: " + err.Error())
+	}
+
+	manufacturer, err := s.resolveActingParticipant(stub, args[4], submitter, RoleManufacturer)
+	if err != nil {
+		return shim.Error("Invalid manufacturer: " + err.Error())
+	}
+
+	product, err := s.resolveCommissionedProduct(stub, gtin, manufacturer, args[5])
+	if err != nil {
+		return shim.Error("Invalid product: " + err.Error())
+	}
+
+	// Create medication ID from the SGTIN (GTIN + serialNumber), which is globally unique
+	medicationID := sgtin.String()
 
 	// Check if medication already exists
 	existingData, err := stub.GetState(medicationID)
@@ -113,58 +318,70 @@ func (s *SmartContract) commissionMedication(stub shim.ChaincodeStubInterface, a
 	// Create medication data
 	medication := MedicationData{
 		ID:              medicationID,
-		GTIN:            args[0],
+		GTIN:            gtin,
 		Batch:           args[1],
 		SerialNumber:    args[2],
-		ExpiryDate:      args[3],
-		Manufacturer:    args[4],
-		ProductName:     args[5],
+		ExpiryDate:      expiryDate,
+		Manufacturer:    manufacturer.LegalName,
+		ManufacturerMSP: submitter.MSPID,
+		ManufacturerGLN: manufacturer.GLN,
+		ProductName:     product.Name,
+		ProductVersion:  product.Version,
 		Location:        args[6],
-		Timestamp:       time.Now().Unix(),
-		TransactionHash: fmt.Sprintf("tx_%d", time.Now().UnixNano()),
-		Status:          "active",
-		CommissionTime:  time.Now().Unix(),
+		Timestamp:       txTime,
+		TransactionHash: stub.GetTxID(),
+		Status:          StatusCommissioned,
+		CommissionTime:  txTime,
 	}
 
-	// Marshal and store medication
-	medicationJSON, err := json.Marshal(medication)
+	// Flag units commissioned into an already recalled batch
+	recalls, err := s.getActiveRecallsForGTIN(stub, gtin)
 	if err != nil {
-		return shim.Error("Failed to marshal medication: " + err.Error())
+		return shim.Error("Failed to get open recalls: " + err.Error())
 	}
 
-	err = stub.PutState(medicationID, medicationJSON)
+	commissionEvent, recall, err := s.commissionUnit(stub, &medication, submitter, recalls)
 	if err != nil {
-		return shim.Error("Failed to put medication to world state: " + err.Error())
+		return shim.Error("Failed to commission medication: " + err.Error())
 	}
 
-	// Create initial commission event
-	commissionEvent := TrackingEvent{
-		ID:           fmt.Sprintf("evt_%d", time.Now().UnixNano()),
-		Event:        "commission",
-		Location:     args[6],
-		Timestamp:    time.Now().Unix(),
-		Actor:        args[4], // manufacturer
-		MedicationID: medicationID,
-		Signature:    "",
+	if recall != nil {
+		err = s.putRecall(stub, recall)
+		if err != nil {
+			return shim.Error("Failed to update recall: " + err.Error())
+		}
 	}
 
-	// Store tracking event
-	trackingKey := fmt.Sprintf("tracking_%s_%s", medicationID, commissionEvent.ID)
-	eventJSON, err := json.Marshal(commissionEvent)
+	err = s.emitEvent(stub, EventNameMedicationCommissioned, MedicationCommissionedEvent{
+		MedicationID:    medicationID,
+		GTIN:            medication.GTIN,
+		Batch:           medication.Batch,
+		SerialNumber:    medication.SerialNumber,
+		ExpiryDate:      medication.ExpiryDate,
+		Manufacturer:    medication.Manufacturer,
+		ManufacturerMSP: medication.ManufacturerMSP,
+		ManufacturerGLN: medication.ManufacturerGLN,
+		Location:        medication.Location,
+		EventID:         commissionEvent.ID,
+		RecallID:        medication.RecallID,
+	})
 	if err != nil {
-		return shim.Error("Failed to marshal tracking event: " + err.Error())
+		return shim.Error("Failed to emit chaincode event: " + err.Error())
 	}
 
-	err = stub.PutState(trackingKey, eventJSON)
-	if err != nil {
-		return shim.Error("Failed to put tracking event to world state: " + err.Error())
+	if recall != nil {
+		fmt.Printf("Medication %s commissioned under open recall %s\n", medicationID, recall.ID)
 	}
 
 	fmt.Printf("Medication commissioned successfully: %s\n", medicationID)
 	return shim.Success([]byte(medicationID))
 }
 
-// addTrackingEvent adds a tracking event for an existing medication
+// addTrackingEvent adds a tracking event for an existing medication.
+// The actor is the GLN of a registered participant of the submitting MSP; an empty actor
+// selects the MSP's only participant. The submitting MSP must hold the unit, unless it receives it.
+// The event is checked for signs of a cloned serial like a recorded verification, and any clone
+// alerts are stored; they do not stop the event.
 // Args: [medicationId, event, location, actor, signature]
 func (s *SmartContract) addTrackingEvent(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	if len(args) != 5 {
@@ -176,6 +393,12 @@ func (s *SmartContract) addTrackingEvent(stub shim.ChaincodeStubInterface, args
 		return shim.Error("Missing medication ID")
 	}
 
+	// Accept SGTIN and EPC forms, and legacy batch-serial IDs
+	medicationID, err := s.resolveMedicationID(stub, medicationID)
+	if err != nil {
+		return shim.Error("Failed to resolve medication ID: " + err.Error())
+	}
+
 	// Check if medication exists
 	medicationJSON, err := stub.GetState(medicationID)
 	if err != nil {
@@ -192,46 +415,120 @@ func (s *SmartContract) addTrackingEvent(stub shim.ChaincodeStubInterface, args
 		return shim.Error("Failed to unmarshal medication: " + err.Error())
 	}
 
+	// Recalls carry a reason and go through issueMedicationRecall
+	if args[1] == EventRecall {
+		return shim.Error("Recalls must be issued through issueMedicationRecall")
+	}
+
+	// Packed units move with their container
+	if medication.ParentSSCC != "" {
+		return shim.Error("Medication " + medicationID + " is packed in container " + medication.ParentSSCC + "; use addContainerEvent or unpack it first")
+	}
+
+	// Apply the lifecycle transition
+	status, err := s.currentStatus(stub, &medication)
+	if err != nil {
+		return shim.Error("Failed to get tracking history: " + err.Error())
+	}
+
+	newStatus, err := nextStatus(status, args[1])
+	if err != nil {
+		return shim.Error("Cannot apply event to medication " + medicationID + ": " + err.Error())
+	}
+
+	submitter, err := getSubmitterIdentity(stub)
+	if err != nil {
+		return shim.Error("Failed to resolve submitter identity: " + err.Error())
+	}
+
+	// Only the organization holding the unit may move it, except to receive it
+	trackingHistory, err := s.getTrackingEventsForMedication(stub, medicationID)
+	if err != nil {
+		return shim.Error("Failed to get tracking history: " + err.Error())
+	}
+	_, holderMSPID := getCurrentHolder(&medication, trackingHistory)
+	err = checkCustody("medication "+medicationID, holderMSPID, args[1], submitter)
+	if err != nil {
+		return shim.Error("Access denied: " + err.Error())
+	}
+
+	actor, err := s.resolveActingParticipant(stub, args[3], submitter, "")
+	if err != nil {
+		return shim.Error("Invalid actor: " + err.Error())
+	}
+
+	// Signed events must carry a valid signature of the acting participant
+	err = s.checkNewEventSignature(stub, SigningPayload{Actor: actor.GLN, Event: args[1], Location: args[2], Previous: medication.HeadHash, Subject: medicationID}, args[4])
+	if err != nil {
+		return shim.Error("Invalid signature: " + err.Error())
+	}
+
+	txTime, err := getTxTime(stub)
+	if err != nil {
+		return shim.Error("Failed to read transaction timestamp: " + err.Error())
+	}
+
 	// Create tracking event
 	trackingEvent := TrackingEvent{
-		ID:           fmt.Sprintf("evt_%d", time.Now().UnixNano()),
+		ID:           newEventID(stub, &medication),
 		Event:        args[1],
 		Location:     args[2],
-		Timestamp:    time.Now().Unix(),
-		Actor:        args[3],
+		Timestamp:    txTime,
+		Actor:        actor.GLN,
+		Submitter:    submitter,
 		MedicationID: medicationID,
 		Signature:    args[4],
 	}
 
-	// Store tracking event
-	trackingKey := fmt.Sprintf("tracking_%s_%s", medicationID, trackingEvent.ID)
-	eventJSON, err := json.Marshal(trackingEvent)
+	// Check this sighting against the earlier ones for signs of a cloned serial
+	verifications, err := s.getVerificationRecordsForMedication(stub, medicationID)
 	if err != nil {
-		return shim.Error("Failed to marshal tracking event: " + err.Error())
+		return shim.Error("Failed to get verification log: " + err.Error())
+	}
+	var alertTypes []string
+	for _, alert := range detectEventCloneAlerts(&medication, trackingHistory, verifications, &trackingEvent) {
+		err = s.putAlert(stub, &alert)
+		if err != nil {
+			return shim.Error("Failed to put alert to world state: " + err.Error())
+		}
+		alertTypes = append(alertTypes, alert.Type)
 	}
 
-	err = stub.PutState(trackingKey, eventJSON)
+	// Store tracking event
+	err = s.putTrackingEvent(stub, &medication, trackingEvent)
 	if err != nil {
 		return shim.Error("Failed to put tracking event to world state: " + err.Error())
 	}
 
-	// Update medication location
+	// Update medication location and status
 	medication.Location = args[2]
-	updatedMedicationJSON, err := json.Marshal(medication)
+	medication.Status = newStatus
+	err = s.putMedication(stub, &medication)
 	if err != nil {
-		return shim.Error("Failed to marshal updated medication: " + err.Error())
+		return shim.Error("Failed to update medication in world state: " + err.Error())
 	}
 
-	err = stub.PutState(medicationID, updatedMedicationJSON)
+	err = s.emitEvent(stub, EventNameTrackingEventAdded, TrackingEventAddedEvent{
+		MedicationID:   medicationID,
+		EventID:        trackingEvent.ID,
+		Event:          trackingEvent.Event,
+		Location:       trackingEvent.Location,
+		Actor:          trackingEvent.Actor,
+		SubmitterMSPID: submitter.MSPID,
+		Status:         medication.Status,
+		Alerts:         alertTypes,
+	})
 	if err != nil {
-		return shim.Error("Failed to update medication in world state: " + err.Error())
+		return shim.Error("Failed to emit chaincode event: " + err.Error())
 	}
 
 	fmt.Printf("Tracking event added successfully for medication: %s\n", medicationID)
 	return shim.Success([]byte(trackingEvent.ID))
 }
 
-// verifyMedication verifies medication authenticity and returns tracking history
+// verifyMedication verifies medication authenticity and returns tracking history.
+// The verdict says whether the unit is authentic, recalled, expired, suspect, dispensed or
+// decommissioned, with the reasons; expiry is judged at the transaction timestamp.
 // Args: [medicationId]
 func (s *SmartContract) verifyMedication(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	if len(args) != 1 {
@@ -243,6 +540,12 @@ func (s *SmartContract) verifyMedication(stub shim.ChaincodeStubInterface, args
 		return shim.Error("Missing medication ID")
 	}
 
+	// Accept SGTIN and EPC forms, and legacy batch-serial IDs
+	medicationID, err := s.resolveMedicationID(stub, medicationID)
+	if err != nil {
+		return shim.Error("Failed to resolve medication ID: " + err.Error())
+	}
+
 	// Get medication data
 	medicationJSON, err := stub.GetState(medicationID)
 	if err != nil {
@@ -258,34 +561,9 @@ func (s *SmartContract) verifyMedication(stub shim.ChaincodeStubInterface, args
 		return shim.Error("Failed to unmarshal medication: " + err.Error())
 	}
 
-	// Get all tracking events for this medication
-	trackingHistory, err := s.getTrackingEventsForMedication(stub, medicationID)
+	verificationResult, err := s.buildVerificationResult(stub, &medication)
 	if err != nil {
-		return shim.Error("Failed to get tracking history: " + err.Error())
-	}
-
-	// Determine current holder
-	currentHolder := medication.Manufacturer
-	if len(trackingHistory) > 0 {
-		currentHolder = trackingHistory[len(trackingHistory)-1].Actor
-	}
-
-	// Check if medication is valid (not recalled)
-	isValid := medication.Status != "recalled"
-	for _, event := range trackingHistory {
-		if event.Event == "recall" {
-			isValid = false
-			break
-		}
-	}
-
-	// Create verification result
-	verificationResult := VerificationResult{
-		IsValid:          isValid,
-		MedicationData:   &medication,
-		TrackingHistory:  trackingHistory,
-		CurrentHolder:    currentHolder,
-		VerificationTime: time.Now().Unix(),
+		return shim.Error("Failed to verify medication: " + err.Error())
 	}
 
 	resultJSON, err := json.Marshal(verificationResult)
@@ -296,7 +574,10 @@ func (s *SmartContract) verifyMedication(stub shim.ChaincodeStubInterface, args
 	return shim.Success(resultJSON)
 }
 
-// issueMedicationRecall issues a recall for a medication
+// issueMedicationRecall issues a recall for a single medication and stores it as a unit Recall record.
+// Use issueRecall to recall whole batches or GTINs.
+// The issuer argument is a display label; the recalling identity is taken from the transaction creator.
+// Only regulators or members of the manufacturer's MSP may recall a medication.
 // Args: [medicationId, reason, issuer]
 func (s *SmartContract) issueMedicationRecall(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	if len(args) != 3 {
@@ -311,6 +592,12 @@ func (s *SmartContract) issueMedicationRecall(stub shim.ChaincodeStubInterface,
 		return shim.Error("Missing medication ID")
 	}
 
+	// Accept SGTIN and EPC forms, and legacy batch-serial IDs
+	medicationID, err := s.resolveMedicationID(stub, medicationID)
+	if err != nil {
+		return shim.Error("Failed to resolve medication ID: " + err.Error())
+	}
+
 	// Get medication data
 	medicationJSON, err := stub.GetState(medicationID)
 	if err != nil {
@@ -326,42 +613,67 @@ func (s *SmartContract) issueMedicationRecall(stub shim.ChaincodeStubInterface,
 		return shim.Error("Failed to unmarshal medication: " + err.Error())
 	}
 
-	// Update medication status
-	medication.Status = "recalled"
-	medication.RecallReason = reason
+	submitter, err := getSubmitterIdentity(stub)
+	if err != nil {
+		return shim.Error("Failed to resolve submitter identity: " + err.Error())
+	}
 
-	// Save updated medication
-	updatedMedicationJSON, err := json.Marshal(medication)
+	// Manufacturers may only recall their own products
+	isRegulator, err := s.callerHasRole(stub, RoleRegulator)
 	if err != nil {
-		return shim.Error("Failed to marshal updated medication: " + err.Error())
+		return shim.Error("Access denied: " + err.Error())
+	}
+	if !isRegulator && (medication.ManufacturerMSP == "" || medication.ManufacturerMSP != submitter.MSPID) {
+		return shim.Error("Access denied: only the owning manufacturer or a regulator may recall medication " + medicationID)
 	}
 
-	err = stub.PutState(medicationID, updatedMedicationJSON)
+	txTime, err := getTxTime(stub)
 	if err != nil {
-		return shim.Error("Failed to update medication in world state: " + err.Error())
+		return shim.Error("Failed to read transaction timestamp: " + err.Error())
 	}
 
-	// Create recall tracking event
-	recallEvent := TrackingEvent{
-		ID:           fmt.Sprintf("evt_%d", time.Now().UnixNano()),
-		Event:        "recall",
-		Location:     medication.Location,
-		Timestamp:    time.Now().Unix(),
-		Actor:        issuer,
-		MedicationID: medicationID,
-		Signature:    "",
+	// Record a unit recall
+	recall := Recall{
+		ID:            "rcl_" + stub.GetTxID(),
+		Reason:        reason,
+		Selector:      RecallSelector{MedicationID: medicationID, GTIN: medication.GTIN},
+		Status:        RecallStatusOpen,
+		Issuer:        submitter.displayLabel(issuer),
+		IssuedBy:      submitter,
+		IssuedAt:      txTime,
+		TxID:          stub.GetTxID(),
+		AffectedUnits: 1,
 	}
 
-	// Store recall event
-	trackingKey := fmt.Sprintf("tracking_%s_%s", medicationID, recallEvent.ID)
-	eventJSON, err := json.Marshal(recallEvent)
+	// Update medication status and store recall event
+	recallEvent, err := s.recallUnit(stub, &medication, &recall, submitter, txTime)
 	if err != nil {
-		return shim.Error("Failed to marshal recall event: " + err.Error())
+		return shim.Error("Cannot recall medication " + medicationID + ": " + err.Error())
 	}
 
-	err = stub.PutState(trackingKey, eventJSON)
+	// Save updated medication
+	err = s.putMedication(stub, &medication)
+	if err != nil {
+		return shim.Error("Failed to update medication in world state: " + err.Error())
+	}
+
+	err = s.putRecall(stub, &recall)
+	if err != nil {
+		return shim.Error("Failed to put recall to world state: " + err.Error())
+	}
+
+	err = s.emitEvent(stub, EventNameMedicationRecalled, MedicationRecalledEvent{
+		RecallID:       recall.ID,
+		MedicationID:   medicationID,
+		GTIN:           medication.GTIN,
+		Batch:          medication.Batch,
+		Reason:         reason,
+		Issuer:         recallEvent.Actor,
+		SubmitterMSPID: submitter.MSPID,
+		EventID:        recallEvent.ID,
+	})
 	if err != nil {
-		return shim.Error("Failed to put recall event to world state: " + err.Error())
+		return shim.Error("Failed to emit chaincode event: " + err.Error())
 	}
 
 	fmt.Printf("Medication recall issued successfully for: %s\n", medicationID)
@@ -379,6 +691,12 @@ func (s *SmartContract) getMedication(stub shim.ChaincodeStubInterface, args []s
 		return shim.Error("Missing medication ID")
 	}
 
+	// Accept SGTIN and EPC forms, and legacy batch-serial IDs
+	medicationID, err := s.resolveMedicationID(stub, medicationID)
+	if err != nil {
+		return shim.Error("Failed to resolve medication ID: " + err.Error())
+	}
+
 	medicationJSON, err := stub.GetState(medicationID)
 	if err != nil {
 		return shim.Error("Failed to read medication from world state: " + err.Error())
@@ -400,6 +718,12 @@ func (s *SmartContract) getTrackingHistory(stub shim.ChaincodeStubInterface, arg
 		return shim.Error("Missing medication ID")
 	}
 
+	// Accept SGTIN and EPC forms, and legacy batch-serial IDs
+	medicationID, err := s.resolveMedicationID(stub, medicationID)
+	if err != nil {
+		return shim.Error("Failed to resolve medication ID: " + err.Error())
+	}
+
 	trackingHistory, err := s.getTrackingEventsForMedication(stub, medicationID)
 	if err != nil {
 		return shim.Error("Failed to get tracking history: " + err.Error())
@@ -423,9 +747,9 @@ func (s *SmartContract) getMedicationsByManufacturer(stub shim.ChaincodeStubInte
 		return shim.Error("Missing manufacturer name")
 	}
 
-	resultsIterator, err := stub.GetStateByRange("", "")
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(manufacturerKeyType, []string{manufacturer})
 	if err != nil {
-		return shim.Error("Failed to get state by range: " + err.Error())
+		return shim.Error("Failed to get manufacturer index: " + err.Error())
 	}
 	defer resultsIterator.Close()
 
@@ -436,20 +760,26 @@ func (s *SmartContract) getMedicationsByManufacturer(stub shim.ChaincodeStubInte
 			return shim.Error("Failed to get next result: " + err.Error())
 		}
 
-		// Skip tracking events (they have tracking_ prefix)
-		if len(queryResponse.Key) > 9 && queryResponse.Key[:9] == "tracking_" {
-			continue
+		_, keyParts, err := stub.SplitCompositeKey(queryResponse.Key)
+		if err != nil || len(keyParts) != 2 {
+			continue // Skip malformed index entries
+		}
+
+		medicationJSON, err := stub.GetState(keyParts[1])
+		if err != nil {
+			return shim.Error("Failed to read medication from world state: " + err.Error())
+		}
+		if medicationJSON == nil {
+			continue // Stale index entry
 		}
 
 		var medication MedicationData
-		err = json.Unmarshal(queryResponse.Value, &medication)
+		err = json.Unmarshal(medicationJSON, &medication)
 		if err != nil {
 			continue // Skip invalid records
 		}
 
-		if medication.Manufacturer == manufacturer {
-			medications = append(medications, medication)
-		}
+		medications = append(medications, medication)
 	}
 
 	medicationsJSON, err := json.Marshal(medications)
@@ -460,152 +790,623 @@ func (s *SmartContract) getMedicationsByManufacturer(stub shim.ChaincodeStubInte
 	return shim.Success(medicationsJSON)
 }
 
-func (s *SmartContract) getVerificationStats(stub shim.ChaincodeStubInterface, args []string) pb.Response {
-	if len(args) != 0 {
-		return shim.Error("Incorrect number of arguments. Expecting 0")
+// searchMedications returns the medications matching a structured search, or a free-text query
+// Args: [searchJSON or query]
+func (s *SmartContract) searchMedications(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1: search")
 	}
 
-	resultsIterator, err := stub.GetStateByRange("", "")
+	if args[0] == "" {
+		return shim.Error("Missing search query")
+	}
+
+	search, err := parseMedicationSearch(args[0])
 	if err != nil {
-		return shim.Error("Failed to get state by range: " + err.Error())
+		return shim.Error("Invalid search: " + err.Error())
 	}
-	defer resultsIterator.Close()
 
-	var stats = struct {
-		TotalVerifications   int `json:"totalVerifications"`
-		AuthenticMedications int `json:"authenticMedications"`
-		AlertsActive         int `json:"alertsActive"`
-	}{
-		TotalVerifications:   0,
-		AuthenticMedications: 0,
-		AlertsActive:         0,
+	scan, _, err := s.openMedicationSearch(stub, search, 0, "")
+	if err != nil {
+		return shim.Error("Failed to query medications: " + err.Error())
+	}
+	defer scan.close()
+
+	matchingMedications, err := collectSearchMatches(scan, search)
+	if err != nil {
+		return shim.Error("Failed to get next result: " + err.Error())
 	}
 
+	medicationsJSON, err := json.Marshal(matchingMedications)
+	if err != nil {
+		return shim.Error("Failed to marshal medications: " + err.Error())
+	}
+
+	return shim.Success(medicationsJSON)
+}
+
+// migrateTrackingEvents rewrites legacy tracking_<medicationId>_<eventId> records into
+// event~medicationId~seq composite keys and rebuilds the manufacturer, GTIN, status and
+// expiry indexes. Only regulators may run it.
+// Args: [maxEvents] (optional, 0 or omitted migrates everything in one transaction)
+func (s *SmartContract) migrateTrackingEvents(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) > 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 0 or 1: maxEvents")
+	}
+
+	isRegulator, err := s.callerHasRole(stub, RoleRegulator)
+	if err != nil {
+		return shim.Error("Access denied: " + err.Error())
+	}
+	if !isRegulator {
+		return shim.Error("Access denied: only regulators may migrate tracking events")
+	}
+
+	maxEvents := 0
+	if len(args) == 1 && args[0] != "" {
+		limit, err := strconv.Atoi(args[0])
+		if err != nil || limit < 0 {
+			return shim.Error("maxEvents must be a non-negative integer")
+		}
+		maxEvents = limit
+	}
+
+	resultsIterator, err := stub.GetStateByRange(legacyTrackingPrefix, "tracking`")
+	if err != nil {
+		return shim.Error("Failed to get legacy tracking events: " + err.Error())
+	}
+	defer resultsIterator.Close()
+
+	// Group legacy events by medication, preserving key order
+	legacyEvents := make(map[string][]TrackingEvent)
+	var medicationIDs []string
+	migrated := 0
+	remaining := false
 	for resultsIterator.HasNext() {
+		if maxEvents > 0 && migrated == maxEvents {
+			remaining = true
+			break
+		}
+
 		queryResponse, err := resultsIterator.Next()
 		if err != nil {
 			return shim.Error("Failed to get next result: " + err.Error())
 		}
 
-		// Skip tracking events
-		if len(queryResponse.Key) > 9 && queryResponse.Key[:9] == "tracking_" {
-			continue
+		var event TrackingEvent
+		err = json.Unmarshal(queryResponse.Value, &event)
+		if err != nil || event.MedicationID == "" {
+			continue // Leave unreadable records in place
+		}
+
+		if _, seen := legacyEvents[event.MedicationID]; !seen {
+			medicationIDs = append(medicationIDs, event.MedicationID)
+		}
+		legacyEvents[event.MedicationID] = append(legacyEvents[event.MedicationID], event)
+
+		err = stub.DelState(queryResponse.Key)
+		if err != nil {
+			return shim.Error("Failed to delete legacy tracking event: " + err.Error())
+		}
+		migrated++
+	}
+
+	for _, medicationID := range medicationIDs {
+		medicationJSON, err := stub.GetState(medicationID)
+		if err != nil {
+			return shim.Error("Failed to read medication from world state: " + err.Error())
+		}
+		if medicationJSON == nil {
+			return shim.Error("Medication not found for legacy tracking events: " + medicationID)
 		}
 
 		var medication MedicationData
-		err = json.Unmarshal(queryResponse.Value, &medication)
+		err = json.Unmarshal(medicationJSON, &medication)
 		if err != nil {
-			continue // Skip invalid records
+			return shim.Error("Failed to unmarshal medication: " + err.Error())
+		}
+
+		// Merge with events already stored under composite keys and renumber chronologically.
+		// Legacy events come first so they win ties on equal timestamps.
+		existingEvents, err := s.getTrackingEventsForMedication(stub, medicationID)
+		if err != nil {
+			return shim.Error("Failed to get tracking history: " + err.Error())
+		}
+		events := append(legacyEvents[medicationID], existingEvents...)
+		sort.SliceStable(events, func(i, j int) bool {
+			return events[i].Timestamp < events[j].Timestamp
+		})
+
+		medication.EventCount = 0
+		medication.HeadHash = ""
+		for _, event := range events {
+			event.keepSignedFields()
+			err = s.putTrackingEvent(stub, &medication, event)
+			if err != nil {
+				return shim.Error("Failed to put tracking event to world state: " + err.Error())
+			}
 		}
 
-		stats.TotalVerifications++
-		if medication.Status == "active" {
-			stats.AuthenticMedications++
-		} else if medication.Status == "recalled" {
-			stats.AlertsActive++
+		err = s.putMedication(stub, &medication)
+		if err != nil {
+			return shim.Error("Failed to update medication in world state: " + err.Error())
 		}
 	}
 
-	statsJSON, err := json.Marshal(stats)
+	// Rebuild the secondary indexes for every medication
+	indexed := 0
+	medicationsIterator, err := stub.GetStateByRange("", "")
 	if err != nil {
-		return shim.Error("Failed to marshal stats: " + err.Error())
+		return shim.Error("Failed to get state by range: " + err.Error())
 	}
+	defer medicationsIterator.Close()
 
-	return shim.Success(statsJSON)
-}
+	for medicationsIterator.HasNext() {
+		queryResponse, err := medicationsIterator.Next()
+		if err != nil {
+			return shim.Error("Failed to get next result: " + err.Error())
+		}
 
-func (s *SmartContract) searchMedications(stub shim.ChaincodeStubInterface, args []string) pb.Response {
-	if len(args) != 1 {
-		return shim.Error("Incorrect number of arguments. Expecting 1: query")
+		medication, ok := parseMedicationRecord(queryResponse.Key, queryResponse.Value)
+		if !ok {
+			continue // Skip records that are not medications
+		}
+
+		err = s.putMedicationIndexes(stub, medication)
+		if err != nil {
+			return shim.Error("Failed to put medication indexes to world state: " + err.Error())
+		}
+		indexed++
 	}
 
-	query := args[0]
-	if query == "" {
-		return shim.Error("Missing search query")
+	var summary = struct {
+		MigratedEvents      int  `json:"migratedEvents"`
+		MedicationsUpdated  int  `json:"medicationsUpdated"`
+		IndexedMedications  int  `json:"indexedMedications"`
+		RemainingLegacyKeys bool `json:"remainingLegacyKeys"`
+	}{
+		MigratedEvents:      migrated,
+		MedicationsUpdated:  len(medicationIDs),
+		IndexedMedications:  indexed,
+		RemainingLegacyKeys: remaining,
 	}
 
-	resultsIterator, err := stub.GetStateByRange("", "")
+	summaryJSON, err := json.Marshal(summary)
 	if err != nil {
-		return shim.Error("Failed to get state by range: " + err.Error())
+		return shim.Error("Failed to marshal migration summary: " + err.Error())
+	}
+
+	err = s.emitEvent(stub, EventNameTrackingEventsMigrated, TrackingEventsMigratedEvent{
+		MigratedEvents:      migrated,
+		MedicationsUpdated:  len(medicationIDs),
+		RemainingLegacyKeys: remaining,
+	})
+	if err != nil {
+		return shim.Error("Failed to emit chaincode event: " + err.Error())
+	}
+
+	fmt.Printf("Migrated %d legacy tracking events for %d medications\n", migrated, len(medicationIDs))
+	return shim.Success(summaryJSON)
+}
+
+// Helper function to get all tracking events for a medication, in sequence order
+func (s *SmartContract) getTrackingEventsForMedication(stub shim.ChaincodeStubInterface, medicationID string) ([]TrackingEvent, error) {
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(eventKeyType, []string{medicationID})
+	if err != nil {
+		return nil, err
 	}
 	defer resultsIterator.Close()
 
-	var matchingMedications []MedicationData
+	var trackingEvents []TrackingEvent
 	for resultsIterator.HasNext() {
 		queryResponse, err := resultsIterator.Next()
 		if err != nil {
-			return shim.Error("Failed to get next result: " + err.Error())
+			return nil, err
+		}
+
+		var event TrackingEvent
+		err = json.Unmarshal(queryResponse.Value, &event)
+		if err != nil {
+			continue // Skip invalid records
 		}
 
-		// Skip tracking events
-		if len(queryResponse.Key) > 9 && queryResponse.Key[:9] == "tracking_" {
+		trackingEvents = append(trackingEvents, event)
+	}
+
+	return trackingEvents, nil
+}
+
+// Helper function to verify a medication from its status, tracking history, container chain and expiry date
+func (s *SmartContract) buildVerificationResult(stub shim.ChaincodeStubInterface, medication *MedicationData) (*VerificationResult, error) {
+	// Get all tracking events for this medication
+	trackingHistory, err := s.getTrackingEventsForMedication(stub, medication.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get tracking history: %s", err)
+	}
+
+	// Determine current holder
+	currentHolder, _ := getCurrentHolder(medication, trackingHistory)
+
+	containerChain, err := s.getContainerChain(stub, medication.ParentSSCC)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get container chain: %s", err)
+	}
+
+	// Report the lifecycle status for records written before it existed
+	if medication.Status == statusLegacyActive {
+		medication.Status = resolveLegacyStatus(trackingHistory)
+	}
+
+	// A broken event chain means the history was altered or is incomplete
+	eventChain, err := s.verifyEventChain(stub, medication)
+	if err != nil {
+		return nil, fmt.Errorf("failed to verify event chain: %s", err)
+	}
+
+	signatures, err := s.checkEventSignatures(stub, trackingHistory)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check event signatures: %s", err)
+	}
+
+	product, err := s.findProduct(stub, medication.GTIN)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read product: %s", err)
+	}
+
+	alerts, err := s.getAlertsForMedication(stub, medication.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get alerts: %s", err)
+	}
+
+	txTime, err := getTxTime(stub)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read transaction timestamp: %s", err)
+	}
+
+	result := &VerificationResult{
+		MedicationData:   medication,
+		TrackingHistory:  trackingHistory,
+		CurrentHolder:    currentHolder,
+		Product:          product,
+		ContainerChain:   containerChain,
+		EventChain:       eventChain,
+		Signatures:       signatures,
+		Alerts:           alerts,
+		VerificationTime: txTime,
+	}
+	result.assessVerdict()
+
+	return result, nil
+}
+
+// Helper function to determine who holds a medication, as a display label and MSP ID.
+// The holder is the actor of the latest custody event; recall and lift events are
+// issued by manufacturers or regulators and do not move the unit.
+func getCurrentHolder(medication *MedicationData, trackingHistory []TrackingEvent) (string, string) {
+	for i := len(trackingHistory) - 1; i >= 0; i-- {
+		event := trackingHistory[i]
+		if event.Event == EventRecall || event.Event == EventLiftRecall {
 			continue
 		}
 
-		var medication MedicationData
-		err = json.Unmarshal(queryResponse.Value, &medication)
+		holderMSPID := ""
+		if event.Submitter != nil {
+			holderMSPID = event.Submitter.MSPID
+		}
+		return event.Actor, holderMSPID
+	}
+
+	if medication.ManufacturerGLN != "" {
+		return medication.ManufacturerGLN, medication.ManufacturerMSP
+	}
+	return medication.Manufacturer, medication.ManufacturerMSP
+}
+
+// Helper function to get the lifecycle status of a medication, replaying the tracking
+// history of records that still carry the legacy "active" status
+func (s *SmartContract) currentStatus(stub shim.ChaincodeStubInterface, medication *MedicationData) (string, error) {
+	if medication.Status != statusLegacyActive {
+		return medication.Status, nil
+	}
+
+	trackingHistory, err := s.getTrackingEventsForMedication(stub, medication.ID)
+	if err != nil {
+		return "", err
+	}
+
+	return resolveLegacyStatus(trackingHistory), nil
+}
+
+// Helper function to store a new medication with its commission event and index entries.
+// A unit matching one of the given open recalls is recalled straight away; the matching
+// recall is returned with AffectedUnits incremented and the caller persists it.
+func (s *SmartContract) commissionUnit(stub shim.ChaincodeStubInterface, medication *MedicationData, submitter *SubmitterIdentity, recalls []*Recall) (*TrackingEvent, *Recall, error) {
+	commissionEvent := TrackingEvent{
+		ID:           newEventID(stub, medication),
+		Event:        EventCommission,
+		Location:     medication.Location,
+		Timestamp:    medication.CommissionTime,
+		Actor:        submitter.displayLabel(medication.ManufacturerGLN),
+		Submitter:    submitter,
+		MedicationID: medication.ID,
+		Signature:    "",
+	}
+
+	err := s.putTrackingEvent(stub, medication, commissionEvent)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to put tracking event to world state: %s", err)
+	}
+
+	recall, err := s.applyMatchingRecall(stub, medication, recalls, submitter, medication.CommissionTime)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to apply open recalls: %s", err)
+	}
+
+	err = s.putMedication(stub, medication)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to put medication to world state: %s", err)
+	}
+
+	err = s.putMedicationIndexes(stub, medication)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to put medication indexes to world state: %s", err)
+	}
+
+	return &commissionEvent, recall, nil
+}
+
+// Helper function to read a medication record by any of its IDs
+func (s *SmartContract) readMedication(stub shim.ChaincodeStubInterface, medicationID string) (*MedicationData, error) {
+	medication, err := s.findMedication(stub, medicationID)
+	if err != nil {
+		return nil, err
+	}
+	if medication == nil {
+		return nil, fmt.Errorf("medication not found: %s", medicationID)
+	}
+	return medication, nil
+}
+
+// Helper function to find a medication record by any of its IDs, or nil
+func (s *SmartContract) findMedication(stub shim.ChaincodeStubInterface, medicationID string) (*MedicationData, error) {
+	medicationID, err := s.resolveMedicationID(stub, medicationID)
+	if err != nil {
+		return nil, err
+	}
+
+	medicationJSON, err := stub.GetState(medicationID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read medication from world state: %s", err)
+	}
+	if medicationJSON == nil {
+		return nil, nil
+	}
+
+	var medication MedicationData
+	err = json.Unmarshal(medicationJSON, &medication)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal medication: %s", err)
+	}
+
+	return &medication, nil
+}
+
+// Helper function to store a medication record and its status and expiry index entries,
+// moving the entries if the status or expiry date changed
+func (s *SmartContract) putMedication(stub shim.ChaincodeStubInterface, medication *MedicationData) error {
+	previousJSON, err := stub.GetState(medication.ID)
+	if err != nil {
+		return err
+	}
+	if previous, ok := parseMedicationRecord(medication.ID, previousJSON); ok {
+		err = s.deleteMedicationStateIndexes(stub, previous, medication)
 		if err != nil {
-			continue // Skip invalid records
+			return err
 		}
+	}
+
+	medicationJSON, err := json.Marshal(medication)
+	if err != nil {
+		return err
+	}
+
+	err = stub.PutState(medication.ID, medicationJSON)
+	if err != nil {
+		return err
+	}
+
+	return s.putMedicationStateIndexes(stub, medication)
+}
+
+// Helper function to write the status and expiry index entries of a medication
+func (s *SmartContract) putMedicationStateIndexes(stub shim.ChaincodeStubInterface, medication *MedicationData) error {
+	statusKey, err := stub.CreateCompositeKey(statusKeyType, []string{medication.Status, medication.ID})
+	if err != nil {
+		return err
+	}
+
+	err = stub.PutState(statusKey, []byte{0x00})
+	if err != nil {
+		return err
+	}
+
+	if medication.ExpiryDate == "" {
+		return nil
+	}
+
+	expiryKey, err := stub.CreateCompositeKey(expiryKeyType, []string{medication.ExpiryDate, medication.ID})
+	if err != nil {
+		return err
+	}
 
-		// Simple search implementation - check if query matches any field
-		searchableText := fmt.Sprintf("%s %s %s %s %s %s",
-			medication.ProductName, medication.Manufacturer, medication.Batch,
-			medication.GTIN, medication.SerialNumber, medication.Location)
+	return stub.PutState(expiryKey, []byte{0x00})
+}
+
+// Helper function to delete the status and expiry index entries of a stored medication that
+// the updated record no longer carries. A nil update deletes them all.
+func (s *SmartContract) deleteMedicationStateIndexes(stub shim.ChaincodeStubInterface, stored *MedicationData, updated *MedicationData) error {
+	var staleKeys [][]string
+	if updated == nil || updated.Status != stored.Status {
+		staleKeys = append(staleKeys, []string{statusKeyType, stored.Status, stored.ID})
+	}
+	if stored.ExpiryDate != "" && (updated == nil || updated.ExpiryDate != stored.ExpiryDate) {
+		staleKeys = append(staleKeys, []string{expiryKeyType, stored.ExpiryDate, stored.ID})
+	}
+
+	for _, staleKey := range staleKeys {
+		key, err := stub.CreateCompositeKey(staleKey[0], staleKey[1:])
+		if err != nil {
+			return err
+		}
 
-		if s.containsIgnoreCase(searchableText, query) {
-			matchingMedications = append(matchingMedications, medication)
+		err = stub.DelState(key)
+		if err != nil {
+			return err
 		}
 	}
 
-	medicationsJSON, err := json.Marshal(matchingMedications)
+	return nil
+}
+
+// Helper function to write the manufacturer, GTIN, status and expiry index entries of a medication
+func (s *SmartContract) putMedicationIndexes(stub shim.ChaincodeStubInterface, medication *MedicationData) error {
+	manufacturerKey, err := stub.CreateCompositeKey(manufacturerKeyType, []string{medication.Manufacturer, medication.ID})
 	if err != nil {
-		return shim.Error("Failed to marshal medications: " + err.Error())
+		return err
 	}
 
-	return shim.Success(medicationsJSON)
+	err = stub.PutState(manufacturerKey, []byte{0x00})
+	if err != nil {
+		return err
+	}
+
+	gtinKey, err := stub.CreateCompositeKey(gtinKeyType, []string{medication.GTIN, medication.Batch, medication.ID})
+	if err != nil {
+		return err
+	}
+
+	err = stub.PutState(gtinKey, []byte{0x00})
+	if err != nil {
+		return err
+	}
+
+	return s.putMedicationStateIndexes(stub, medication)
 }
 
-// Helper function to get all tracking events for a medication
-func (s *SmartContract) getTrackingEventsForMedication(stub shim.ChaincodeStubInterface, medicationID string) ([]TrackingEvent, error) {
-	resultsIterator, err := stub.GetStateByRange("", "")
+// Helper function to store a tracking event under the next sequence number of a medication.
+// The caller is responsible for persisting the medication afterwards, since EventCount changes.
+func (s *SmartContract) putTrackingEvent(stub shim.ChaincodeStubInterface, medication *MedicationData, event TrackingEvent) error {
+	eventKey, err := stub.CreateCompositeKey(eventKeyType, []string{medication.ID, eventSeqKey(medication.EventCount)})
+	if err != nil {
+		return err
+	}
+
+	eventJSON, err := chainEvent(medication, &event)
+	if err != nil {
+		return err
+	}
+
+	err = stub.PutState(eventKey, eventJSON)
+	if err != nil {
+		return err
+	}
+
+	medication.EventCount++
+	return nil
+}
+
+// chainEvent links an event to the head of the medication's event chain, moves the head to
+// it and returns the event JSON as it must be stored
+func chainEvent(medication *MedicationData, event *TrackingEvent) ([]byte, error) {
+	event.PrevHash = medication.HeadHash
+	event.Hash = ""
+
+	unhashedJSON, err := json.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+
+	event.Hash, err = eventchain.Hash(unhashedJSON)
 	if err != nil {
 		return nil, err
 	}
+
+	eventJSON, err := json.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+
+	medication.HeadHash = event.Hash
+	return eventJSON, nil
+}
+
+// Helper function to verify the stored event chain of a medication against its head hash.
+// Events are checked as stored, so fields unknown to TrackingEvent are covered too.
+func (s *SmartContract) verifyEventChain(stub shim.ChaincodeStubInterface, medication *MedicationData) (eventchain.Report, error) {
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(eventKeyType, []string{medication.ID})
+	if err != nil {
+		return eventchain.Report{}, err
+	}
 	defer resultsIterator.Close()
 
-	var trackingEvents []TrackingEvent
+	var events []json.RawMessage
 	for resultsIterator.HasNext() {
 		queryResponse, err := resultsIterator.Next()
 		if err != nil {
-			return nil, err
+			return eventchain.Report{}, err
 		}
 
-		// Only process tracking events for this medication
-		if len(queryResponse.Key) > 9 && queryResponse.Key[:9] == "tracking_" {
-			var event TrackingEvent
-			err = json.Unmarshal(queryResponse.Value, &event)
-			if err != nil {
-				continue // Skip invalid records
-			}
+		events = append(events, json.RawMessage(queryResponse.Value))
+	}
 
-			if event.MedicationID == medicationID {
-				trackingEvents = append(trackingEvents, event)
-			}
-		}
+	return eventchain.Verify(events, medication.HeadHash), nil
+}
+
+// Helper function to get the transaction timestamp in Unix seconds.
+// Every endorser sees the same value, unlike the peer's local clock.
+func getTxTime(stub shim.ChaincodeStubInterface) (int64, error) {
+	txTimestamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return 0, err
 	}
+	return txTimestamp.Seconds, nil
+}
 
-	return trackingEvents, nil
+// newEventID returns the ID of the next tracking event of a medication, derived from the
+// transaction ID and the sequence number the event will be stored under, so all endorsers
+// agree on it and events of one transaction never collide
+func newEventID(stub shim.ChaincodeStubInterface, medication *MedicationData) string {
+	return fmt.Sprintf("evt_%s_%s_%d", stub.GetTxID(), medication.ID, medication.EventCount)
+}
+
+// eventSeqKey zero-pads a sequence number so composite keys sort in event order
+func eventSeqKey(seq int) string {
+	return fmt.Sprintf("%010d", seq)
+}
+
+// parseMedicationRecord decodes a plain world state entry found by a range scan if it is a
+// medication record: valid JSON stored under its own ID, with the GTIN, serial number and
+// manufacturer every commissioned unit has. Legacy tracking events and other records are rejected.
+func parseMedicationRecord(key string, value []byte) (*MedicationData, bool) {
+	if isLegacyTrackingKey(key) {
+		return nil, false
+	}
+
+	var medication MedicationData
+	err := json.Unmarshal(value, &medication)
+	if err != nil {
+		return nil, false
+	}
+	if medication.ID != key || medication.GTIN == "" || medication.SerialNumber == "" || medication.Manufacturer == "" {
+		return nil, false
+	}
+
+	return &medication, true
 }
 
-// Helper function for case-insensitive string search
-func (s *SmartContract) containsIgnoreCase(str, substr string) bool {
-	return len(str) >= len(substr) &&
-		(str == substr ||
-			len(str) > len(substr) &&
-				(str[:len(substr)] == substr ||
-					str[len(str)-len(substr):] == substr ||
-					bytes.Contains([]byte(str), []byte(substr))))
+// isLegacyTrackingKey reports whether a key uses the pre-composite tracking_<medicationId>_<eventId> layout
+func isLegacyTrackingKey(key string) bool {
+	return len(key) > len(legacyTrackingPrefix) && key[:len(legacyTrackingPrefix)] == legacyTrackingPrefix
 }
 
 // Main function
@@ -0,0 +1,136 @@
+// Package eventchain hash-chains the tracking events of a medication so that an exported
+// history can be checked for completeness and tampering without trusting whoever exported it.
+//
+// Each event carries prevHash, the hash of the event before it (absent on the first event),
+// and hash, the lowercase hex SHA-256 of the event's canonical encoding. The canonical
+// encoding is the event's JSON object without its hash field, with object keys sorted,
+// no insignificant whitespace and no HTML escaping. The medication record stores the hash
+// of its last event as headHash.
+package eventchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+)
+
+// HashField is the JSON field carrying an event's own hash, left out of its canonical encoding
+const HashField = "hash"
+
+// Break describes one point where a history fails verification
+type Break struct {
+	Index   int    `json:"index"` // position of the event in the history, starting at 0
+	EventID string `json:"eventId,omitempty"`
+	Reason  string `json:"reason"`
+}
+
+// Report is the outcome of verifying a history against a head hash.
+// UnchainedEvents counts leading events written before hash chaining existed; they are not
+// covered by the chain and are reported rather than treated as breaks.
+type Report struct {
+	Valid           bool    `json:"valid"`
+	EventCount      int     `json:"eventCount"`
+	UnchainedEvents int     `json:"unchainedEvents"`
+	HeadHash        string  `json:"headHash"`
+	ComputedHead    string  `json:"computedHead"`
+	Breaks          []Break `json:"breaks"`
+}
+
+// Canonicalize returns the canonical encoding of an event: its JSON object without the
+// hash field, keys sorted, compact and without HTML escaping
+func Canonicalize(eventJSON []byte) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(eventJSON))
+	decoder.UseNumber()
+
+	var fields map[string]interface{}
+	err := decoder.Decode(&fields)
+	if err != nil {
+		return nil, fmt.Errorf("event is not a JSON object: %s", err)
+	}
+	delete(fields, HashField)
+
+	// encoding/json writes map keys in sorted order
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	encoder.SetEscapeHTML(false)
+	err = encoder.Encode(fields)
+	if err != nil {
+		return nil, err
+	}
+
+	return bytes.TrimSuffix(buffer.Bytes(), []byte("\n")), nil
+}
+
+// Hash returns the hex SHA-256 of the canonical encoding of an event
+func Hash(eventJSON []byte) (string, error) {
+	canonical, err := Canonicalize(eventJSON)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(canonical)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Verify checks a history, oldest event first, against the head hash stored on the
+// medication record. The history is complete and unaltered when every event's hash matches
+// its contents, every prevHash names the event before it, and the last hash is the head.
+func Verify(events []json.RawMessage, headHash string) Report {
+	report := Report{
+		EventCount: len(events),
+		HeadHash:   headHash,
+		Breaks:     []Break{},
+	}
+
+	previousHash := ""
+	chained := false
+	for i, eventJSON := range events {
+		var header struct {
+			ID       string `json:"id"`
+			Hash     string `json:"hash"`
+			PrevHash string `json:"prevHash"`
+		}
+		err := json.Unmarshal(eventJSON, &header)
+		if err != nil {
+			report.Breaks = append(report.Breaks, Break{Index: i, Reason: "event is not a JSON object: " + err.Error()})
+			continue
+		}
+
+		if header.Hash == "" {
+			if chained {
+				report.Breaks = append(report.Breaks, Break{Index: i, EventID: header.ID, Reason: "event has no hash"})
+			} else {
+				report.UnchainedEvents++
+			}
+			continue
+		}
+
+		if !chained {
+			chained = true
+			if header.PrevHash != "" {
+				report.Breaks = append(report.Breaks, Break{Index: i, EventID: header.ID, Reason: "first chained event has a prevHash; earlier events are missing"})
+			}
+		} else if header.PrevHash != previousHash {
+			report.Breaks = append(report.Breaks, Break{Index: i, EventID: header.ID, Reason: fmt.Sprintf("prevHash %s does not match the previous event's hash %s", header.PrevHash, previousHash)})
+		}
+
+		computed, err := Hash(eventJSON)
+		if err != nil {
+			report.Breaks = append(report.Breaks, Break{Index: i, EventID: header.ID, Reason: err.Error()})
+		} else if computed != header.Hash {
+			report.Breaks = append(report.Breaks, Break{Index: i, EventID: header.ID, Reason: fmt.Sprintf("hash %s does not match the event contents, which hash to %s", header.Hash, computed)})
+		}
+
+		previousHash = header.Hash
+	}
+
+	report.ComputedHead = previousHash
+	if previousHash != headHash {
+		report.Breaks = append(report.Breaks, Break{Index: len(events), Reason: fmt.Sprintf("last event hash %q does not match the head hash %q; events are missing", previousHash, headHash)})
+	}
+
+	report.Valid = len(report.Breaks) == 0
+	return report
+}
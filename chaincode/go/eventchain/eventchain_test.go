@@ -0,0 +1,162 @@
+package eventchain
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestCanonicalize(t *testing.T) {
+	const want = `{"a":1,"b":"<x&y>","id":"evt_1","n":12.50}`
+
+	tests := []struct {
+		name  string
+		event string
+	}{
+		{name: "canonical", event: want},
+		{name: "keys out of order", event: `{"n":12.50,"id":"evt_1","b":"<x&y>","a":1}`},
+		{name: "whitespace", event: "{\n  \"a\": 1,\n  \"b\": \"<x&y>\",\n  \"id\": \"evt_1\",\n  \"n\": 12.50\n}"},
+		{name: "hash field is left out", event: `{"hash":"abc","a":1,"b":"<x&y>","id":"evt_1","n":12.50}`},
+		{name: "escaped HTML characters", event: `{"a":1,"b":"\u003cx\u0026y\u003e","id":"evt_1","n":12.50}`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := Canonicalize([]byte(test.event))
+			if err != nil {
+				t.Fatalf("Canonicalize returned error: %s", err)
+			}
+			if string(got) != want {
+				t.Errorf("Canonicalize(%s) = %s, want %s", test.event, got, want)
+			}
+		})
+	}
+
+	for _, event := range []string{`[]`, `"event"`, `{"a":`} {
+		if _, err := Canonicalize([]byte(event)); err == nil {
+			t.Errorf("Canonicalize(%s) accepted a value that is not a JSON object", event)
+		}
+	}
+}
+
+func TestHashIsStable(t *testing.T) {
+	// SHA-256 of {"a":1,"b":"<x&y>","id":"evt_1","n":12.50}; changing it breaks every stored chain
+	const want = "ddebbf5949a12a9400931ff25bcfa697169c9747013f97079ce06c8185336638"
+
+	for _, event := range []string{
+		`{"n":12.50,"id":"evt_1","b":"<x&y>","a":1}`,
+		`{"hash":"` + want + `","a":1,"b":"<x&y>","id":"evt_1","n":12.50}`,
+	} {
+		got, err := Hash([]byte(event))
+		if err != nil {
+			t.Fatalf("Hash returned error: %s", err)
+		}
+		if got != want {
+			t.Errorf("Hash(%s) = %s, want %s", event, got, want)
+		}
+	}
+}
+
+// chainEvents links events the way the chaincode stores them and returns them with the head hash
+func chainEvents(t *testing.T, events ...map[string]interface{}) ([]json.RawMessage, string) {
+	t.Helper()
+
+	chained := make([]json.RawMessage, 0, len(events))
+	previousHash := ""
+	for _, event := range events {
+		if previousHash != "" {
+			event["prevHash"] = previousHash
+		}
+
+		eventJSON, err := json.Marshal(event)
+		if err != nil {
+			t.Fatal(err)
+		}
+		event["hash"], err = Hash(eventJSON)
+		if err != nil {
+			t.Fatal(err)
+		}
+		previousHash = event["hash"].(string)
+
+		eventJSON, err = json.Marshal(event)
+		if err != nil {
+			t.Fatal(err)
+		}
+		chained = append(chained, eventJSON)
+	}
+	return chained, previousHash
+}
+
+func history(t *testing.T) ([]json.RawMessage, string) {
+	return chainEvents(t,
+		map[string]interface{}{"id": "evt_0", "event": "commission", "location": "Plant"},
+		map[string]interface{}{"id": "evt_1", "event": "ship", "location": "Plant"},
+		map[string]interface{}{"id": "evt_2", "event": "receive", "location": "Warehouse"},
+	)
+}
+
+func TestVerify(t *testing.T) {
+	events, head := history(t)
+	legacy := json.RawMessage(`{"id":"evt_legacy","event":"commission"}`)
+
+	tests := []struct {
+		name          string
+		events        []json.RawMessage
+		head          string
+		wantBreaks    []int // indexes of the expected breaks
+		wantUnchained int
+	}{
+		{name: "intact", events: events, head: head},
+		{name: "empty history", events: nil, head: ""},
+		{
+			name:   "tampered event",
+			events: []json.RawMessage{events[0], json.RawMessage(strings.Replace(string(events[1]), "Plant", "Elsewhere", 1)), events[2]},
+			head:   head, wantBreaks: []int{1},
+		},
+		{name: "missing middle event", events: []json.RawMessage{events[0], events[2]}, head: head, wantBreaks: []int{1}},
+		{name: "missing first event", events: events[1:], head: head, wantBreaks: []int{0}},
+		{name: "missing last event", events: events[:2], head: head, wantBreaks: []int{2}},
+		{name: "reordered events", events: []json.RawMessage{events[1], events[0], events[2]}, head: head, wantBreaks: []int{0, 1, 2}},
+		{
+			name:   "leading unchained events",
+			events: []json.RawMessage{legacy, legacy, events[0], events[1], events[2]},
+			head:   head, wantUnchained: 2,
+		},
+		{
+			name:   "unchained event after the chain started",
+			events: []json.RawMessage{events[0], legacy, events[1], events[2]},
+			head:   head, wantBreaks: []int{1},
+		},
+		{name: "event that is not JSON", events: []json.RawMessage{events[0], json.RawMessage(`{`), events[1], events[2]}, head: head, wantBreaks: []int{1}},
+		{name: "wrong head hash", events: events, head: strings.Repeat("0", 64), wantBreaks: []int{3}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			report := Verify(test.events, test.head)
+
+			var gotBreaks []int
+			for _, b := range report.Breaks {
+				gotBreaks = append(gotBreaks, b.Index)
+			}
+			if len(gotBreaks) != len(test.wantBreaks) {
+				t.Fatalf("Verify breaks at %v, want %v: %+v", gotBreaks, test.wantBreaks, report.Breaks)
+			}
+			for i := range gotBreaks {
+				if gotBreaks[i] != test.wantBreaks[i] {
+					t.Fatalf("Verify breaks at %v, want %v: %+v", gotBreaks, test.wantBreaks, report.Breaks)
+				}
+			}
+
+			if report.Valid != (len(test.wantBreaks) == 0) {
+				t.Errorf("Verify valid = %t with breaks %+v", report.Valid, report.Breaks)
+			}
+			if report.UnchainedEvents != test.wantUnchained {
+				t.Errorf("Verify unchained events = %d, want %d", report.UnchainedEvents, test.wantUnchained)
+			}
+			if report.EventCount != len(test.events) {
+				t.Errorf("Verify event count = %d, want %d", report.EventCount, len(test.events))
+			}
+		})
+	}
+}
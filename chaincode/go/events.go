@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Chaincode event names. Fabric delivers at most one chaincode event per transaction,
+// so each mutating function emits exactly one of these. Payload schemas are documented
+// in events.schema.json.
+const (
+	EventNameMedicationCommissioned      = "MedicationCommissioned"
+	EventNameTrackingEventAdded          = "TrackingEventAdded"
+	EventNameMedicationBatchCommissioned = "MedicationBatchCommissioned"
+	EventNameMedicationRecalled          = "MedicationRecalled"
+	EventNameRecallIssued                = "RecallIssued"
+	EventNameRecallUpdated               = "RecallUpdated"
+	EventNameRecallAcknowledged          = "RecallAcknowledged"
+	EventNameRecallLifted                = "RecallLifted"
+	EventNameContainerPacked             = "ContainerPacked"
+	EventNameContainerUnpacked           = "ContainerUnpacked"
+	EventNameContainerRepacked           = "ContainerRepacked"
+	EventNameContainerTrackingEventAdded = "ContainerTrackingEventAdded"
+	EventNameTrackingEventsMigrated      = "TrackingEventsMigrated"
+	EventNameMedicationIDsMigrated       = "MedicationIDsMigrated"
+	EventNameSigningKeyRegistered        = "SigningKeyRegistered"
+	EventNameSigningKeyRevoked           = "SigningKeyRevoked"
+	EventNameParticipantRegistered       = "ParticipantRegistered"
+	EventNameParticipantUpdated          = "ParticipantUpdated"
+	EventNameParticipantStatusChanged    = "ParticipantStatusChanged"
+	EventNameProductRegistered           = "ProductRegistered"
+	EventNameProductUpdated              = "ProductUpdated"
+	EventNameCompanyPrefixRegistered     = "CompanyPrefixRegistered"
+	EventNameCompanyPrefixTransferred    = "CompanyPrefixTransferred"
+	EventNameCompanyPrefixRevoked        = "CompanyPrefixRevoked"
+	EventNameVerificationRecorded        = "VerificationRecorded"
+	EventNameAlertResolved               = "AlertResolved"
+)
+
+// chaincodeEventVersion is bumped whenever a payload changes incompatibly
+const chaincodeEventVersion = 1
+
+// ChaincodeEventEnvelope wraps every chaincode event payload
+type ChaincodeEventEnvelope struct {
+	Type      string      `json:"type"`
+	Version   int         `json:"version"`
+	TxID      string      `json:"txId"`
+	Timestamp int64       `json:"timestamp"`
+	Data      interface{} `json:"data"`
+}
+
+// MedicationCommissionedEvent is emitted by commissionMedication
+type MedicationCommissionedEvent struct {
+	MedicationID    string `json:"medicationId"`
+	GTIN            string `json:"gtin"`
+	Batch           string `json:"batch"`
+	SerialNumber    string `json:"serialNumber"`
+	ExpiryDate      string `json:"expiryDate"`
+	Manufacturer    string `json:"manufacturer"`
+	ManufacturerMSP string `json:"manufacturerMspId"`
+	ManufacturerGLN string `json:"manufacturerGln"`
+	Location        string `json:"location"`
+	EventID         string `json:"eventId"`
+	RecallID        string `json:"recallId,omitempty"` // set when the unit falls under an open recall
+}
+
+// MedicationBatchCommissionedEvent is emitted by commissionBatch. Medication IDs of the
+// individual units are returned to the submitter rather than carried in the event.
+type MedicationBatchCommissionedEvent struct {
+	GTIN              string `json:"gtin"`
+	Batch             string `json:"batch"`
+	ExpiryDate        string `json:"expiryDate"`
+	Manufacturer      string `json:"manufacturer"`
+	ManufacturerMSP   string `json:"manufacturerMspId"`
+	ManufacturerGLN   string `json:"manufacturerGln"`
+	Location          string `json:"location"`
+	UnitCount         int    `json:"unitCount"`
+	FirstMedicationID string `json:"firstMedicationId"`
+	LastMedicationID  string `json:"lastMedicationId"`
+	RecalledUnits     int    `json:"recalledUnits"`
+}
+
+// TrackingEventAddedEvent is emitted by addTrackingEvent
+type TrackingEventAddedEvent struct {
+	MedicationID   string   `json:"medicationId"`
+	EventID        string   `json:"eventId"`
+	Event          string   `json:"event"`
+	Location       string   `json:"location"`
+	Actor          string   `json:"actor"`
+	SubmitterMSPID string   `json:"submitterMspId"`
+	Status         string   `json:"status"`
+	Alerts         []string `json:"alerts,omitempty"` // types of the clone alerts raised
+}
+
+// MedicationRecalledEvent is emitted by issueMedicationRecall
+type MedicationRecalledEvent struct {
+	RecallID       string `json:"recallId"`
+	MedicationID   string `json:"medicationId"`
+	GTIN           string `json:"gtin"`
+	Batch          string `json:"batch"`
+	Reason         string `json:"reason"`
+	Issuer         string `json:"issuer"`
+	SubmitterMSPID string `json:"submitterMspId"`
+	EventID        string `json:"eventId"`
+}
+
+// RecallIssuedEvent is emitted by issueRecall
+type RecallIssuedEvent struct {
+	RecallID       string         `json:"recallId"`
+	Class          string         `json:"class"`
+	Reason         string         `json:"reason"`
+	Selector       RecallSelector `json:"selector"`
+	Issuer         string         `json:"issuer"`
+	SubmitterMSPID string         `json:"submitterMspId"`
+	AffectedUnits  int            `json:"affectedUnits"`
+}
+
+// RecallUpdatedEvent is emitted by updateRecall
+type RecallUpdatedEvent struct {
+	RecallID       string `json:"recallId"`
+	Class          string `json:"class"`
+	Reason         string `json:"reason"`
+	SubmitterMSPID string `json:"submitterMspId"`
+}
+
+// RecallAcknowledgedEvent is emitted by acknowledgeRecall
+type RecallAcknowledgedEvent struct {
+	RecallID            string `json:"recallId"`
+	Holder              string `json:"holder"`
+	SubmitterMSPID      string `json:"submitterMspId"`
+	Location            string `json:"location"`
+	QuantityQuarantined int    `json:"quantityQuarantined"`
+	QuantityReturned    int    `json:"quantityReturned"`
+}
+
+// RecallLiftedEvent is emitted by liftRecall
+type RecallLiftedEvent struct {
+	RecallID       string `json:"recallId"`
+	Reason         string `json:"reason"`
+	SubmitterMSPID string `json:"submitterMspId"`
+	RestoredUnits  int    `json:"restoredUnits"`
+}
+
+// ContainerAggregationEvent is emitted by packContainer, unpackContainer and repackContainer.
+// Children lists the unit IDs and SSCCs that were moved in or out of the container.
+type ContainerAggregationEvent struct {
+	SSCC           string   `json:"sscc"`
+	ContainerType  string   `json:"containerType"`
+	Location       string   `json:"location"`
+	Children       []string `json:"children"`
+	SubmitterMSPID string   `json:"submitterMspId"`
+}
+
+// ContainerTrackingEventAddedEvent is emitted by addContainerEvent
+type ContainerTrackingEventAddedEvent struct {
+	SSCC           string `json:"sscc"`
+	Event          string `json:"event"`
+	Location       string `json:"location"`
+	Actor          string `json:"actor"`
+	SubmitterMSPID string `json:"submitterMspId"`
+	Status         string `json:"status"`
+	UnitCount      int    `json:"unitCount"`
+	ContainerCount int    `json:"containerCount"`
+}
+
+// TrackingEventsMigratedEvent is emitted by migrateTrackingEvents
+type TrackingEventsMigratedEvent struct {
+	MigratedEvents      int  `json:"migratedEvents"`
+	MedicationsUpdated  int  `json:"medicationsUpdated"`
+	RemainingLegacyKeys bool `json:"remainingLegacyKeys"`
+}
+
+// MedicationIDsMigratedEvent is emitted by migrateMedicationIDs
+type MedicationIDsMigratedEvent struct {
+	MigratedUnits      int  `json:"migratedUnits"`
+	SkippedUnits       int  `json:"skippedUnits"`
+	RemainingLegacyIDs bool `json:"remainingLegacyIds"`
+}
+
+// SigningKeyEvent is emitted by registerSigningKey and revokeSigningKey
+type SigningKeyEvent struct {
+	Participant    string `json:"participant"`
+	KeyID          string `json:"keyId"`
+	Algorithm      string `json:"algorithm"`
+	SubmitterMSPID string `json:"submitterMspId"`
+}
+
+// ParticipantEvent is emitted by registerParticipant, updateParticipant and setParticipantStatus
+type ParticipantEvent struct {
+	GLN            string `json:"gln"`
+	LegalName      string `json:"legalName"`
+	Role           string `json:"role"`
+	MSPID          string `json:"mspId"`
+	Status         string `json:"status"`
+	SubmitterMSPID string `json:"submitterMspId"`
+}
+
+// ProductEvent is emitted by registerProduct and updateProduct
+type ProductEvent struct {
+	GTIN            string `json:"gtin"`
+	Name            string `json:"name"`
+	ManufacturerGLN string `json:"manufacturerGln"`
+	Version         int    `json:"version"`
+	SubmitterMSPID  string `json:"submitterMspId"`
+}
+
+// CompanyPrefixEvent is emitted by registerCompanyPrefix, transferCompanyPrefix and
+// revokeCompanyPrefix; the previous owner and moved products are only set on transfers,
+// the reason only on revocations
+type CompanyPrefixEvent struct {
+	Prefix             string `json:"prefix"`
+	OwnerGLN           string `json:"ownerGln"`
+	OwnerMSPID         string `json:"ownerMspId"`
+	PreviousOwnerGLN   string `json:"previousOwnerGln,omitempty"`
+	PreviousOwnerMSPID string `json:"previousOwnerMspId,omitempty"`
+	ProductsMoved      int    `json:"productsMoved,omitempty"`
+	Reason             string `json:"reason,omitempty"`
+	SubmitterMSPID     string `json:"submitterMspId"`
+}
+
+// VerificationRecordedEvent is emitted by recordVerification
+type VerificationRecordedEvent struct {
+	MedicationID   string   `json:"medicationId"`
+	Found          bool     `json:"found"`
+	Verdict        string   `json:"verdict"`
+	Location       string   `json:"location"`
+	VerifierGLN    string   `json:"verifierGln,omitempty"`
+	Alerts         []string `json:"alerts,omitempty"` // types of the clone alerts raised
+	SubmitterMSPID string   `json:"submitterMspId"`
+}
+
+// AlertResolvedEvent is emitted by resolveAlert
+type AlertResolvedEvent struct {
+	MedicationID   string `json:"medicationId"`
+	AlertID        string `json:"alertId"`
+	AlertType      string `json:"alertType"`
+	Resolution     string `json:"resolution"`
+	SubmitterMSPID string `json:"submitterMspId"`
+}
+
+// Helper function to emit a chaincode event wrapped in the standard envelope
+func (s *SmartContract) emitEvent(stub shim.ChaincodeStubInterface, eventType string, data interface{}) error {
+	txTime, err := getTxTime(stub)
+	if err != nil {
+		return err
+	}
+
+	payload, err := json.Marshal(ChaincodeEventEnvelope{
+		Type:      eventType,
+		Version:   chaincodeEventVersion,
+		TxID:      stub.GetTxID(),
+		Timestamp: txTime,
+		Data:      data,
+	})
+	if err != nil {
+		return err
+	}
+
+	return stub.SetEvent(eventType, payload)
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// maxExpiryWindowDays caps the window of getExpiringMedications
+const maxExpiryWindowDays = 730
+
+// ExpiringUnit is a unit in the supply chain that expires within the queried window
+type ExpiringUnit struct {
+	MedicationID string `json:"medicationId"`
+	GTIN         string `json:"gtin"`
+	Batch        string `json:"batch"`
+	ProductName  string `json:"productName"`
+	ExpiryDate   string `json:"expiryDate"`
+	DaysToExpiry int    `json:"daysToExpiry"`
+	Status       string `json:"status"`
+	Location     string `json:"location"`
+}
+
+// HolderInventory is the expiring stock of one holder, soonest expiry first
+type HolderInventory struct {
+	Holder      string         `json:"holder"`
+	HolderMSPID string         `json:"holderMspId,omitempty"`
+	UnitCount   int            `json:"unitCount"`
+	Units       []ExpiringUnit `json:"units"`
+}
+
+// ExpiringInventory lists the units expiring between From and Until, both inclusive,
+// grouped by current holder
+type ExpiringInventory struct {
+	Days      int               `json:"days"`
+	From      string            `json:"from"`
+	Until     string            `json:"until"`
+	UnitCount int               `json:"unitCount"`
+	Holders   []HolderInventory `json:"holders"`
+}
+
+// getExpiringMedications lists the units still in the supply chain that expire within the
+// given number of days of the transaction date, grouped by current holder. Dispensed,
+// recalled and destroyed units and units already expired are left out.
+// Args: [days]
+func (s *SmartContract) getExpiringMedications(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1: days")
+	}
+
+	days, err := strconv.Atoi(args[0])
+	if err != nil || days < 0 || days > maxExpiryWindowDays {
+		return shim.Error("Days must be a number from 0 to " + strconv.Itoa(maxExpiryWindowDays))
+	}
+
+	txTime, err := getTxTime(stub)
+	if err != nil {
+		return shim.Error("Failed to read transaction timestamp: " + err.Error())
+	}
+
+	today := time.Unix(txTime, 0).UTC().Truncate(24 * time.Hour)
+	inventory := ExpiringInventory{
+		Days:    days,
+		From:    today.Format(expiryDateLayout),
+		Until:   today.AddDate(0, 0, days).Format(expiryDateLayout),
+		Holders: []HolderInventory{},
+	}
+
+	// Search bounds are exclusive
+	search := &MedicationSearch{
+		ExpiryAfter:  today.AddDate(0, 0, -1).Format(expiryDateLayout),
+		ExpiryBefore: today.AddDate(0, 0, days+1).Format(expiryDateLayout),
+	}
+
+	scan, _, err := s.openMedicationSearch(stub, search, 0, "")
+	if err != nil {
+		return shim.Error("Failed to search medications: " + err.Error())
+	}
+	defer scan.close()
+
+	medications, err := collectSearchMatches(scan, search)
+	if err != nil {
+		return shim.Error("Failed to search medications: " + err.Error())
+	}
+
+	holders := make(map[string]*HolderInventory)
+	for i := range medications {
+		medication := &medications[i]
+
+		trackingHistory, err := s.getTrackingEventsForMedication(stub, medication.ID)
+		if err != nil {
+			return shim.Error("Failed to get tracking history of " + medication.ID + ": " + err.Error())
+		}
+
+		status := medication.Status
+		if status == statusLegacyActive {
+			status = resolveLegacyStatus(trackingHistory)
+		}
+		if status == StatusDispensed || status == StatusRecalled || status == StatusDestroyed {
+			continue
+		}
+
+		expiry, err := time.Parse(expiryDateLayout, medication.ExpiryDate)
+		if err != nil {
+			continue // Skip records with malformed expiry dates
+		}
+
+		holder, holderMSPID := getCurrentHolder(medication, trackingHistory)
+		holderKey := holderMSPID + "\x00" + holder
+		if holders[holderKey] == nil {
+			holders[holderKey] = &HolderInventory{Holder: holder, HolderMSPID: holderMSPID, Units: []ExpiringUnit{}}
+		}
+
+		holderInventory := holders[holderKey]
+		holderInventory.Units = append(holderInventory.Units, ExpiringUnit{
+			MedicationID: medication.ID,
+			GTIN:         medication.GTIN,
+			Batch:        medication.Batch,
+			ProductName:  medication.ProductName,
+			ExpiryDate:   medication.ExpiryDate,
+			DaysToExpiry: int(expiry.Sub(today).Hours() / 24),
+			Status:       status,
+			Location:     medication.Location,
+		})
+		holderInventory.UnitCount++
+		inventory.UnitCount++
+	}
+
+	for _, holderInventory := range holders {
+		sort.Slice(holderInventory.Units, func(i, j int) bool {
+			a, b := holderInventory.Units[i], holderInventory.Units[j]
+			if a.ExpiryDate != b.ExpiryDate {
+				return a.ExpiryDate < b.ExpiryDate
+			}
+			return a.MedicationID < b.MedicationID
+		})
+		inventory.Holders = append(inventory.Holders, *holderInventory)
+	}
+	sort.Slice(inventory.Holders, func(i, j int) bool {
+		a, b := inventory.Holders[i], inventory.Holders[j]
+		if a.Holder != b.Holder {
+			return a.Holder < b.Holder
+		}
+		return a.HolderMSPID < b.HolderMSPID
+	})
+
+	inventoryJSON, err := json.Marshal(inventory)
+	if err != nil {
+		return shim.Error("Failed to marshal expiring inventory: " + err.Error())
+	}
+
+	return shim.Success(inventoryJSON)
+}
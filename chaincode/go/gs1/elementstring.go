@@ -0,0 +1,243 @@
+package gs1
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Application identifiers used for medication packs
+const (
+	AISSCC   = "00"
+	AIGTIN   = "01"
+	AIBatch  = "10"
+	AIExpiry = "17"
+	AISerial = "21"
+)
+
+// GroupSeparator is the ASCII character scanners emit for FNC1 between variable-length fields
+const GroupSeparator = '\x1d'
+
+// symbologyIdentifiers are the prefixes scanners add to GS1 DataMatrix, GS1-128 and GS1 QR data
+var symbologyIdentifiers = []string{"]d2", "]C1", "]Q3", "]e0"}
+
+// aiFormat describes the value of an application identifier: either exactly Length
+// characters, or up to Length characters terminated by FNC1 when Variable is set
+type aiFormat struct {
+	Length   int
+	Variable bool
+	Numeric  bool
+}
+
+// aiFormats lists the application identifiers this parser understands
+var aiFormats = map[string]aiFormat{
+	"00":   {Length: 18, Numeric: true},                // SSCC
+	"01":   {Length: 14, Numeric: true},                // GTIN
+	"02":   {Length: 14, Numeric: true},                // GTIN of contained trade items
+	"10":   {Length: MaxBatchLength, Variable: true},   // batch or lot number
+	"11":   {Length: 6, Numeric: true},                 // production date
+	"13":   {Length: 6, Numeric: true},                 // packaging date
+	"15":   {Length: 6, Numeric: true},                 // best before date
+	"16":   {Length: 6, Numeric: true},                 // sell by date
+	"17":   {Length: 6, Numeric: true},                 // expiration date
+	"20":   {Length: 2, Numeric: true},                 // internal product variant
+	"21":   {Length: MaxSerialLength, Variable: true},  // serial number
+	"22":   {Length: 20, Variable: true},               // consumer product variant
+	"30":   {Length: 8, Variable: true, Numeric: true}, // variable count of items
+	"37":   {Length: 8, Variable: true, Numeric: true}, // count of trade items
+	"240":  {Length: 30, Variable: true},               // additional product identification
+	"241":  {Length: 30, Variable: true},               // customer part number
+	"710":  {Length: 20, Variable: true},               // national healthcare reimbursement number (Germany)
+	"711":  {Length: 20, Variable: true},               // national healthcare reimbursement number (France)
+	"712":  {Length: 20, Variable: true},               // national healthcare reimbursement number (Spain)
+	"713":  {Length: 20, Variable: true},               // national healthcare reimbursement number (Brazil)
+	"714":  {Length: 20, Variable: true},               // national healthcare reimbursement number (Portugal)
+	"7003": {Length: 10, Numeric: true},                // expiration date and time
+	"90":   {Length: 30, Variable: true},               // information mutually agreed between trading partners
+	"91":   {Length: 90, Variable: true},               // company internal information
+	"92":   {Length: 90, Variable: true},               // company internal information
+	"93":   {Length: 90, Variable: true},               // company internal information
+	"94":   {Length: 90, Variable: true},               // company internal information
+	"95":   {Length: 90, Variable: true},               // company internal information
+	"96":   {Length: 90, Variable: true},               // company internal information
+	"97":   {Length: 90, Variable: true},               // company internal information
+	"98":   {Length: 90, Variable: true},               // company internal information
+	"99":   {Length: 90, Variable: true},               // company internal information
+}
+
+// ElementString is a decoded GS1 element string. GTIN is normalized to GTIN-14 and
+// Expiry keeps the raw YYMMDD value; use ParseExpiry to interpret it.
+type ElementString struct {
+	GTIN   string            `json:"gtin,omitempty"`
+	Expiry string            `json:"expiry,omitempty"`
+	Batch  string            `json:"batch,omitempty"`
+	Serial string            `json:"serial,omitempty"`
+	AIs    map[string]string `json:"ais"`
+}
+
+// ParseElementString decodes a GS1 element string, either in human readable form with
+// bracketed AIs, e.g. (01)07501001234560(17)251231(10)BATCH001(21)SN001, or in the raw
+// form scanners produce, with variable-length fields separated by FNC1 (ASCII 29) and an
+// optional symbology identifier such as ]d2. In the bracketed form values cannot contain "(".
+func ParseElementString(data string) (*ElementString, error) {
+	for _, prefix := range symbologyIdentifiers {
+		data = strings.TrimPrefix(data, prefix)
+	}
+	if data == "" {
+		return nil, fmt.Errorf("empty element string")
+	}
+
+	var err error
+	elements := &ElementString{AIs: make(map[string]string)}
+	if data[0] == '(' {
+		err = elements.parseBracketed(data)
+	} else {
+		err = elements.parseRaw(data)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return elements, elements.validate()
+}
+
+// parseBracketed reads the human readable (AI)value form
+func (elements *ElementString) parseBracketed(data string) error {
+	position := 0
+	for position < len(data) {
+		if data[position] != '(' {
+			return fmt.Errorf("expecting \"(\" at position %d", position+1)
+		}
+		end := strings.IndexByte(data[position:], ')')
+		if end < 0 {
+			return fmt.Errorf("unterminated application identifier at position %d", position+1)
+		}
+
+		ai := data[position+1 : position+end]
+		format, ok := aiFormats[ai]
+		if !ok {
+			return fmt.Errorf("unknown application identifier (%s) at position %d", ai, position+1)
+		}
+
+		valueStart := position + end + 1
+		valueEnd := strings.IndexByte(data[valueStart:], '(')
+		if valueEnd < 0 {
+			valueEnd = len(data)
+		} else {
+			valueEnd += valueStart
+		}
+
+		err := elements.set(ai, format, data[valueStart:valueEnd])
+		if err != nil {
+			return err
+		}
+		position = valueEnd
+	}
+
+	return nil
+}
+
+// parseRaw reads concatenated AIs: fixed-length values are read by length, variable-length
+// values run until FNC1 or the end of the data
+func (elements *ElementString) parseRaw(data string) error {
+	position := 0
+	for position < len(data) {
+		if data[position] == GroupSeparator {
+			position++
+			continue
+		}
+
+		ai, format, ok := lookupAI(data[position:])
+		if !ok {
+			return fmt.Errorf("unknown application identifier at position %d", position+1)
+		}
+
+		valueStart := position + len(ai)
+		valueEnd := valueStart + format.Length
+		if format.Variable {
+			separator := strings.IndexByte(data[valueStart:], GroupSeparator)
+			if separator < 0 {
+				valueEnd = len(data)
+			} else {
+				valueEnd = valueStart + separator
+			}
+		}
+		if valueEnd > len(data) {
+			valueEnd = len(data)
+		}
+
+		err := elements.set(ai, format, data[valueStart:valueEnd])
+		if err != nil {
+			return err
+		}
+		position = valueEnd
+	}
+
+	return nil
+}
+
+// lookupAI finds the application identifier at the start of data. GS1 AIs are prefix-free,
+// so at most one of the two, three and four digit candidates matches.
+func lookupAI(data string) (string, aiFormat, bool) {
+	for length := 2; length <= 4 && length <= len(data); length++ {
+		if format, ok := aiFormats[data[:length]]; ok {
+			return data[:length], format, true
+		}
+	}
+	return "", aiFormat{}, false
+}
+
+// set checks a value against its AI format and stores it
+func (elements *ElementString) set(ai string, format aiFormat, value string) error {
+	if value == "" {
+		return fmt.Errorf("AI (%s) has no value", ai)
+	}
+	if format.Variable && len(value) > format.Length {
+		return fmt.Errorf("AI (%s) value %q is %d characters long, at most %d allowed", ai, value, len(value), format.Length)
+	}
+	if !format.Variable && len(value) != format.Length {
+		return fmt.Errorf("AI (%s) value %q must be exactly %d characters long", ai, value, format.Length)
+	}
+	if format.Numeric && !isDigits(value) {
+		return fmt.Errorf("AI (%s) value %q must contain only digits", ai, value)
+	}
+
+	if previous, ok := elements.AIs[ai]; ok && previous != value {
+		return fmt.Errorf("AI (%s) appears twice with different values %q and %q", ai, previous, value)
+	}
+	elements.AIs[ai] = value
+	return nil
+}
+
+// validate checks the medication AIs and fills the named fields
+func (elements *ElementString) validate() error {
+	if gtin, ok := elements.AIs[AIGTIN]; ok {
+		normalized, err := NormalizeGTIN(gtin)
+		if err != nil {
+			return fmt.Errorf("AI (01): %s", err)
+		}
+		elements.GTIN = normalized
+	}
+	if batch, ok := elements.AIs[AIBatch]; ok {
+		err := ValidateBatch(batch)
+		if err != nil {
+			return fmt.Errorf("AI (10): %s", err)
+		}
+		elements.Batch = batch
+	}
+	if serial, ok := elements.AIs[AISerial]; ok {
+		err := ValidateSerial(serial)
+		if err != nil {
+			return fmt.Errorf("AI (21): %s", err)
+		}
+		elements.Serial = serial
+	}
+	if sscc, ok := elements.AIs[AISSCC]; ok {
+		err := ValidateSSCC(sscc)
+		if err != nil {
+			return fmt.Errorf("AI (00): %s", err)
+		}
+	}
+	elements.Expiry = elements.AIs[AIExpiry]
+
+	return nil
+}
@@ -0,0 +1,147 @@
+package gs1
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseElementString(t *testing.T) {
+	const gs = string(GroupSeparator)
+
+	tests := []struct {
+		name string
+		data string
+		want ElementString
+	}{
+		{
+			name: "bracketed",
+			data: "(01)07501001234560(17)251231(10)BATCH001(21)SN001",
+			want: ElementString{
+				GTIN:   "07501001234560",
+				Expiry: "251231",
+				Batch:  "BATCH001",
+				Serial: "SN001",
+				AIs:    map[string]string{"01": "07501001234560", "17": "251231", "10": "BATCH001", "21": "SN001"},
+			},
+		},
+		{
+			name: "raw with variable-length fields separated by FNC1",
+			data: "010750100123456017251231" + "10BATCH001" + gs + "21SN001",
+			want: ElementString{
+				GTIN:   "07501001234560",
+				Expiry: "251231",
+				Batch:  "BATCH001",
+				Serial: "SN001",
+				AIs:    map[string]string{"01": "07501001234560", "17": "251231", "10": "BATCH001", "21": "SN001"},
+			},
+		},
+		{
+			name: "raw with variable-length field last",
+			data: "0107501001234560" + "21SN001" + gs + "10BATCH001",
+			want: ElementString{
+				GTIN:   "07501001234560",
+				Batch:  "BATCH001",
+				Serial: "SN001",
+				AIs:    map[string]string{"01": "07501001234560", "21": "SN001", "10": "BATCH001"},
+			},
+		},
+		{
+			name: "raw with trailing and doubled separators",
+			data: "0107501001234560" + gs + gs + "21SN001" + gs,
+			want: ElementString{
+				GTIN:   "07501001234560",
+				Serial: "SN001",
+				AIs:    map[string]string{"01": "07501001234560", "21": "SN001"},
+			},
+		},
+		{
+			name: "GS1 DataMatrix symbology identifier",
+			data: "]d20107501001234560" + "21SN001",
+			want: ElementString{
+				GTIN:   "07501001234560",
+				Serial: "SN001",
+				AIs:    map[string]string{"01": "07501001234560", "21": "SN001"},
+			},
+		},
+		{
+			name: "GS1-128 symbology identifier",
+			data: "]C100106141411234567897",
+			want: ElementString{
+				AIs: map[string]string{"00": "106141411234567897"},
+			},
+		},
+		{
+			name: "GS1 QR symbology identifier",
+			data: "]Q30107501001234560" + "21SN001",
+			want: ElementString{
+				GTIN:   "07501001234560",
+				Serial: "SN001",
+				AIs:    map[string]string{"01": "07501001234560", "21": "SN001"},
+			},
+		},
+		{
+			name: "three and four digit AIs",
+			data: "0107501001234560" + "240ADDITIONAL-ID" + gs + "7003" + "2512311200" + "21SN001",
+			want: ElementString{
+				GTIN:   "07501001234560",
+				Serial: "SN001",
+				AIs:    map[string]string{"01": "07501001234560", "240": "ADDITIONAL-ID", "7003": "2512311200", "21": "SN001"},
+			},
+		},
+		{
+			name: "repeated AI with the same value",
+			data: "(21)SN001(21)SN001",
+			want: ElementString{
+				Serial: "SN001",
+				AIs:    map[string]string{"21": "SN001"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := ParseElementString(test.data)
+			if err != nil {
+				t.Fatalf("ParseElementString(%q) returned error: %s", test.data, err)
+			}
+			if !reflect.DeepEqual(*got, test.want) {
+				t.Errorf("ParseElementString(%q) = %+v, want %+v", test.data, *got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseElementStringMalformed(t *testing.T) {
+	const gs = string(GroupSeparator)
+
+	tests := []struct {
+		name string
+		data string
+	}{
+		{name: "empty", data: ""},
+		{name: "symbology identifier only", data: "]d2"},
+		{name: "unknown bracketed AI", data: "(01)07501001234560(99999)X"},
+		{name: "unterminated bracketed AI", data: "(01"},
+		{name: "text before the first AI", data: "x(01)07501001234560"},
+		{name: "empty bracketed value", data: "(01)07501001234560(21)"},
+		{name: "unknown raw AI", data: "0107501001234560" + "89ABC"},
+		{name: "truncated fixed-length value", data: "01075010012345"},
+		{name: "letters in a numeric AI", data: "(17)25I231"},
+		{name: "variable-length value too long", data: "21" + "ABCDEFGHIJKLMNOPQRSTU"},
+		{name: "conflicting repeated AI", data: "(21)SN001(21)SN002"},
+		{name: "GTIN-13 in AI (01)", data: "(01)7501001234560(21)SN001"},
+		{name: "GTIN with a bad check digit", data: "(01)07501001234561"},
+		{name: "SSCC with a bad check digit", data: "(00)106141411234567898"},
+		{name: "serial outside character set 82", data: "0107501001234560" + "21SN 001"},
+		{name: "empty raw value before a separator", data: "21" + gs + "10BATCH"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := ParseElementString(test.data)
+			if err == nil {
+				t.Errorf("ParseElementString(%q) = %+v, want an error", test.data, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,120 @@
+package gs1
+
+import (
+	"fmt"
+	"time"
+)
+
+// Maximum lengths of the variable-length application identifiers
+const (
+	MaxBatchLength  = 20 // AI (10) batch or lot number
+	MaxSerialLength = 20 // AI (21) serial number
+)
+
+// Date layouts accepted for expiry dates
+const (
+	ISODateLayout = "2006-01-02"
+	gs1DateLayout = "060102"
+)
+
+// ValidateBatch checks a batch or lot number against the rules of AI (10)
+func ValidateBatch(batch string) error {
+	return validateAlphanumeric("batch", batch, MaxBatchLength)
+}
+
+// ValidateSerial checks a serial number against the rules of AI (21)
+func ValidateSerial(serial string) error {
+	return validateAlphanumeric("serial number", serial, MaxSerialLength)
+}
+
+// validateAlphanumeric checks a value against GS1 AI encodable character set 82
+func validateAlphanumeric(field, value string, maxLength int) error {
+	if value == "" {
+		return fmt.Errorf("%s must not be empty", field)
+	}
+	if len(value) > maxLength {
+		return fmt.Errorf("%s %q is %d characters long, GS1 allows at most %d", field, value, len(value), maxLength)
+	}
+
+	for i := 0; i < len(value); i++ {
+		if !isCharacterSet82(value[i]) {
+			return fmt.Errorf("%s %q contains %q at position %d, which is not in the GS1 character set", field, value, value[i], i+1)
+		}
+	}
+
+	return nil
+}
+
+// isCharacterSet82 reports whether c belongs to GS1 AI encodable character set 82
+func isCharacterSet82(c byte) bool {
+	switch {
+	case c >= '0' && c <= '9', c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z':
+		return true
+	}
+
+	switch c {
+	case '!', '"', '%', '&', '\'', '(', ')', '*', '+', ',', '-', '.', '/', ':', ';', '<', '=', '>', '?', '_':
+		return true
+	}
+	return false
+}
+
+// ParseExpiry parses an expiry date given as an ISO date (YYYY-MM-DD) or as GS1 YYMMDD.
+// For YYMMDD the century is chosen relative to now as the GS1 General Specifications
+// require, and a day of 00 means the last day of the month.
+func ParseExpiry(value string, now time.Time) (time.Time, error) {
+	if len(value) == len(ISODateLayout) {
+		expiry, err := time.Parse(ISODateLayout, value)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid expiry date %q: expecting YYYY-MM-DD or YYMMDD", value)
+		}
+		return expiry, nil
+	}
+
+	if len(value) != len(gs1DateLayout) || !isDigits(value) {
+		return time.Time{}, fmt.Errorf("invalid expiry date %q: expecting YYYY-MM-DD or YYMMDD", value)
+	}
+
+	year := int(value[0]-'0')*10 + int(value[1]-'0')
+	month := int(value[2]-'0')*10 + int(value[3]-'0')
+	day := int(value[4]-'0')*10 + int(value[5]-'0')
+	if month < 1 || month > 12 {
+		return time.Time{}, fmt.Errorf("invalid expiry date %q: month %02d is out of range", value, month)
+	}
+
+	year += centuryFor(year, now.UTC().Year())
+
+	lastDay := time.Date(year, time.Month(month)+1, 0, 0, 0, 0, 0, time.UTC).Day()
+	if day == 0 {
+		day = lastDay
+	}
+	if day > lastDay {
+		return time.Time{}, fmt.Errorf("invalid expiry date %q: day %02d is out of range", value, day)
+	}
+
+	return time.Date(year, time.Month(month), day, 0, 0, 0, 0, time.UTC), nil
+}
+
+// NormalizeExpiry parses an expiry date with ParseExpiry and formats it as YYYY-MM-DD
+func NormalizeExpiry(value string, now time.Time) (string, error) {
+	expiry, err := ParseExpiry(value, now)
+	if err != nil {
+		return "", err
+	}
+	return expiry.Format(ISODateLayout), nil
+}
+
+// centuryFor returns the century to add to a two-digit year: a year more than 50 years
+// ahead of the current year belongs to the previous century, and one more than 49 years
+// behind it to the next century
+func centuryFor(twoDigitYear, currentYear int) int {
+	century := currentYear - currentYear%100
+	difference := twoDigitYear - currentYear%100
+	switch {
+	case difference >= 51:
+		return century - 100
+	case difference <= -50:
+		return century + 100
+	}
+	return century
+}
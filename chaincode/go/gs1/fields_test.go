@@ -0,0 +1,119 @@
+package gs1
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidateSerial(t *testing.T) {
+	tests := []struct {
+		name    string
+		serial  string
+		wantErr bool
+	}{
+		{name: "alphanumeric", serial: "SN001"},
+		{name: "character set 82 punctuation", serial: "A!\"%&'*+,-./:;<=>?_z"},
+		{name: "maximum length", serial: strings.Repeat("9", MaxSerialLength)},
+		{name: "too long", serial: strings.Repeat("9", MaxSerialLength+1), wantErr: true},
+		{name: "empty", serial: "", wantErr: true},
+		{name: "space", serial: "SN 001", wantErr: true},
+		{name: "hash", serial: "SN#001", wantErr: true},
+		{name: "group separator", serial: "SN\x1d001", wantErr: true},
+		{name: "non-ASCII", serial: "SNé01", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := ValidateSerial(test.serial)
+			if (err != nil) != test.wantErr {
+				t.Errorf("ValidateSerial(%q) error = %v, want error %t", test.serial, err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateBatch(t *testing.T) {
+	tests := []struct {
+		batch   string
+		wantErr bool
+	}{
+		{batch: "BATCH-2025/01"},
+		{batch: strings.Repeat("B", MaxBatchLength)},
+		{batch: strings.Repeat("B", MaxBatchLength+1), wantErr: true},
+		{batch: "", wantErr: true},
+		{batch: "LOT 1", wantErr: true},
+	}
+
+	for _, test := range tests {
+		err := ValidateBatch(test.batch)
+		if (err != nil) != test.wantErr {
+			t.Errorf("ValidateBatch(%q) error = %v, want error %t", test.batch, err, test.wantErr)
+		}
+	}
+}
+
+func TestNormalizeExpiry(t *testing.T) {
+	now := time.Date(2026, time.October, 16, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{name: "ISO date", value: "2027-03-31", want: "2027-03-31"},
+		{name: "YYMMDD", value: "271231", want: "2027-12-31"},
+		{name: "day 00 is the last day of the month", value: "270200", want: "2027-02-28"},
+		{name: "day 00 in a leap year", value: "280200", want: "2028-02-29"},
+		{name: "50 years ahead stays in this century", value: "760101", want: "2076-01-01"},
+		{name: "51 years ahead is the previous century", value: "770101", want: "1977-01-01"},
+		{name: "month out of range", value: "271301", wantErr: true},
+		{name: "day out of range", value: "270230", wantErr: true},
+		{name: "invalid ISO date", value: "2027-02-30", wantErr: true},
+		{name: "wrong length", value: "27123", wantErr: true},
+		{name: "letters", value: "27I231", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := NormalizeExpiry(test.value, now)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("NormalizeExpiry(%q) = %q, want an error", test.value, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("NormalizeExpiry(%q) returned error: %s", test.value, err)
+			}
+			if got != test.want {
+				t.Errorf("NormalizeExpiry(%q) = %q, want %q", test.value, got, test.want)
+			}
+		})
+	}
+}
+
+func TestCenturyFor(t *testing.T) {
+	tests := []struct {
+		twoDigitYear int
+		currentYear  int
+		want         int
+	}{
+		{twoDigitYear: 26, currentYear: 2026, want: 2000},
+		{twoDigitYear: 76, currentYear: 2026, want: 2000},
+		{twoDigitYear: 77, currentYear: 2026, want: 1900},
+		{twoDigitYear: 99, currentYear: 2026, want: 1900},
+		{twoDigitYear: 0, currentYear: 2049, want: 2000},
+		{twoDigitYear: 0, currentYear: 2050, want: 2100},
+		{twoDigitYear: 1, currentYear: 2099, want: 2100},
+		{twoDigitYear: 98, currentYear: 2099, want: 2000},
+	}
+
+	for _, test := range tests {
+		got := centuryFor(test.twoDigitYear, test.currentYear)
+		if got != test.want {
+			t.Errorf("centuryFor(%d, %d) = %d, want %d", test.twoDigitYear, test.currentYear, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+// Package gs1 validates and normalizes GS1 identifiers and attributes carried on
+// medication packs: GTINs, SSCCs, GLNs, company prefixes, batch/lot numbers, serial numbers
+// and expiry dates.
+package gs1
+
+import (
+	"fmt"
+	"strings"
+)
+
+// GTIN lengths accepted by NormalizeGTIN
+const (
+	GTIN8Length  = 8
+	GTIN12Length = 12
+	GTIN13Length = 13
+	GTIN14Length = 14
+)
+
+// SSCCLength is the length of a Serial Shipping Container Code
+const SSCCLength = 18
+
+// GLNLength is the length of a Global Location Number
+const GLNLength = 13
+
+// Lengths of a GS1 company prefix accepted by ValidateCompanyPrefix
+const (
+	MinCompanyPrefixLength = 6
+	MaxCompanyPrefixLength = 12
+)
+
+// CheckDigit computes the GS1 mod-10 check digit for a string of digits without its check digit.
+// Weights alternate 3 and 1 starting from the rightmost digit.
+func CheckDigit(digits string) (int, error) {
+	if !isDigits(digits) {
+		return 0, fmt.Errorf("%q is not numeric", digits)
+	}
+
+	sum := 0
+	for i := 0; i < len(digits); i++ {
+		digit := int(digits[len(digits)-1-i] - '0')
+		if i%2 == 0 {
+			digit *= 3
+		}
+		sum += digit
+	}
+
+	return (10 - sum%10) % 10, nil
+}
+
+// validateCheckDigit checks the last digit of code against the GS1 check digit of the rest
+func validateCheckDigit(kind, code string) error {
+	expected, err := CheckDigit(code[:len(code)-1])
+	if err != nil {
+		return fmt.Errorf("invalid %s %q: must contain only digits", kind, code)
+	}
+
+	actual := int(code[len(code)-1] - '0')
+	if actual != expected {
+		return fmt.Errorf("invalid %s %q: check digit is %d, expected %d", kind, code, actual, expected)
+	}
+
+	return nil
+}
+
+// NormalizeGTIN validates a GTIN-8, GTIN-12, GTIN-13 or GTIN-14 and returns it as a
+// GTIN-14, left-padded with zeros
+func NormalizeGTIN(gtin string) (string, error) {
+	switch len(gtin) {
+	case GTIN8Length, GTIN12Length, GTIN13Length, GTIN14Length:
+	default:
+		return "", fmt.Errorf("invalid GTIN %q: expecting 8, 12, 13 or 14 digits, got %d characters", gtin, len(gtin))
+	}
+	if !isDigits(gtin) {
+		return "", fmt.Errorf("invalid GTIN %q: must contain only digits", gtin)
+	}
+
+	err := validateCheckDigit("GTIN", gtin)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.Repeat("0", GTIN14Length-len(gtin)) + gtin, nil
+}
+
+// ValidateSSCC checks that an SSCC has 18 digits and a valid check digit
+func ValidateSSCC(sscc string) error {
+	if len(sscc) != SSCCLength {
+		return fmt.Errorf("invalid SSCC %q: expecting %d digits, got %d characters", sscc, SSCCLength, len(sscc))
+	}
+	if !isDigits(sscc) {
+		return fmt.Errorf("invalid SSCC %q: must contain only digits", sscc)
+	}
+
+	return validateCheckDigit("SSCC", sscc)
+}
+
+// ValidateGLN checks that a GLN has 13 digits and a valid check digit
+func ValidateGLN(gln string) error {
+	if len(gln) != GLNLength {
+		return fmt.Errorf("invalid GLN %q: expecting %d digits, got %d characters", gln, GLNLength, len(gln))
+	}
+	if !isDigits(gln) {
+		return fmt.Errorf("invalid GLN %q: must contain only digits", gln)
+	}
+
+	return validateCheckDigit("GLN", gln)
+}
+
+// ValidateCompanyPrefix checks that a GS1 company prefix has 6 to 12 digits.
+// U.P.C. company prefixes are written with their leading zero, as in a GTIN-13.
+func ValidateCompanyPrefix(prefix string) error {
+	if len(prefix) < MinCompanyPrefixLength || len(prefix) > MaxCompanyPrefixLength {
+		return fmt.Errorf("invalid company prefix %q: expecting %d to %d digits, got %d characters", prefix, MinCompanyPrefixLength, MaxCompanyPrefixLength, len(prefix))
+	}
+	if !isDigits(prefix) {
+		return fmt.Errorf("invalid company prefix %q: must contain only digits", prefix)
+	}
+	return nil
+}
+
+// CompanyPrefixCandidates returns the company prefixes a GTIN may have been allocated under,
+// longest first. The company prefix follows the indicator digit of the GTIN-14; its length is
+// not encoded in the GTIN, so every allowed length is a candidate.
+func CompanyPrefixCandidates(gtin string) ([]string, error) {
+	gtin, err := NormalizeGTIN(gtin)
+	if err != nil {
+		return nil, err
+	}
+
+	candidates := make([]string, 0, MaxCompanyPrefixLength-MinCompanyPrefixLength+1)
+	for length := MaxCompanyPrefixLength; length >= MinCompanyPrefixLength; length-- {
+		candidates = append(candidates, gtin[1:1+length])
+	}
+	return candidates, nil
+}
+
+func isDigits(value string) bool {
+	if value == "" {
+		return false
+	}
+	for i := 0; i < len(value); i++ {
+		if value[i] < '0' || value[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,161 @@
+package gs1
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCheckDigit(t *testing.T) {
+	tests := []struct {
+		digits  string
+		want    int
+		wantErr bool
+	}{
+		{digits: "400638133393", want: 1},
+		{digits: "03600029145", want: 2},
+		{digits: "9638507", want: 4},
+		{digits: "1061414100041", want: 5},
+		{digits: "10614141123456789", want: 7},
+		{digits: "000000000000", want: 0},
+		{digits: "", wantErr: true},
+		{digits: "40063813339A", wantErr: true},
+	}
+
+	for _, test := range tests {
+		got, err := CheckDigit(test.digits)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("CheckDigit(%q) = %d, want an error", test.digits, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("CheckDigit(%q) returned error: %s", test.digits, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("CheckDigit(%q) = %d, want %d", test.digits, got, test.want)
+		}
+	}
+}
+
+func TestNormalizeGTIN(t *testing.T) {
+	tests := []struct {
+		name    string
+		gtin    string
+		want    string
+		wantErr bool
+	}{
+		{name: "GTIN-8", gtin: "96385074", want: "00000096385074"},
+		{name: "GTIN-12", gtin: "036000291452", want: "00036000291452"},
+		{name: "GTIN-13", gtin: "4006381333931", want: "04006381333931"},
+		{name: "GTIN-14", gtin: "10614141000415", want: "10614141000415"},
+		{name: "bad check digit", gtin: "4006381333932", wantErr: true},
+		{name: "unsupported length", gtin: "40063813339", wantErr: true},
+		{name: "letters", gtin: "400638133393A", wantErr: true},
+		{name: "empty", gtin: "", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := NormalizeGTIN(test.gtin)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("NormalizeGTIN(%q) = %q, want an error", test.gtin, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("NormalizeGTIN(%q) returned error: %s", test.gtin, err)
+			}
+			if got != test.want {
+				t.Errorf("NormalizeGTIN(%q) = %q, want %q", test.gtin, got, test.want)
+			}
+		})
+	}
+}
+
+func TestValidateSSCC(t *testing.T) {
+	tests := []struct {
+		sscc    string
+		wantErr bool
+	}{
+		{sscc: "106141411234567897"},
+		{sscc: "106141411234567898", wantErr: true},
+		{sscc: "10614141123456789", wantErr: true},
+		{sscc: "10614141123456789X", wantErr: true},
+	}
+
+	for _, test := range tests {
+		err := ValidateSSCC(test.sscc)
+		if (err != nil) != test.wantErr {
+			t.Errorf("ValidateSSCC(%q) error = %v, want error %t", test.sscc, err, test.wantErr)
+		}
+	}
+}
+
+func TestValidateGLN(t *testing.T) {
+	tests := []struct {
+		gln     string
+		wantErr bool
+	}{
+		{gln: "0614141000005"},
+		{gln: "7501001000004"},
+		{gln: "0614141000006", wantErr: true},
+		{gln: "061414100000", wantErr: true},
+		{gln: "06141410000O5", wantErr: true},
+	}
+
+	for _, test := range tests {
+		err := ValidateGLN(test.gln)
+		if (err != nil) != test.wantErr {
+			t.Errorf("ValidateGLN(%q) error = %v, want error %t", test.gln, err, test.wantErr)
+		}
+	}
+}
+
+func TestValidateCompanyPrefix(t *testing.T) {
+	tests := []struct {
+		prefix  string
+		wantErr bool
+	}{
+		{prefix: "750100"},
+		{prefix: "0614141"},
+		{prefix: "061414112345"},
+		{prefix: "75010", wantErr: true},
+		{prefix: "0614141123456", wantErr: true},
+		{prefix: "06141A1", wantErr: true},
+	}
+
+	for _, test := range tests {
+		err := ValidateCompanyPrefix(test.prefix)
+		if (err != nil) != test.wantErr {
+			t.Errorf("ValidateCompanyPrefix(%q) error = %v, want error %t", test.prefix, err, test.wantErr)
+		}
+	}
+}
+
+func TestCompanyPrefixCandidates(t *testing.T) {
+	got, err := CompanyPrefixCandidates("7501001234560")
+	if err != nil {
+		t.Fatalf("CompanyPrefixCandidates returned error: %s", err)
+	}
+
+	want := []string{
+		"750100123456",
+		"75010012345",
+		"7501001234",
+		"750100123",
+		"75010012",
+		"7501001",
+		"750100",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("CompanyPrefixCandidates = %v, want %v", got, want)
+	}
+
+	_, err = CompanyPrefixCandidates("7501001234561")
+	if err == nil {
+		t.Error("CompanyPrefixCandidates accepted a GTIN with a bad check digit")
+	}
+}
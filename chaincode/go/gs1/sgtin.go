@@ -0,0 +1,115 @@
+package gs1
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// sgtinURNPrefix is the EPC pure identity URI prefix of an SGTIN
+const sgtinURNPrefix = "urn:epc:id:sgtin:"
+
+// SGTIN is a serialised GTIN: a GTIN-14 plus a serial number, which together identify one pack
+type SGTIN struct {
+	GTIN   string `json:"gtin"`
+	Serial string `json:"serial"`
+}
+
+// NewSGTIN validates a GTIN and serial number and returns the SGTIN with the GTIN normalized to GTIN-14.
+// Character set 82 allows brackets, but a serial containing them would make the element string
+// form ambiguous, so such serials are rejected.
+func NewSGTIN(gtin, serial string) (SGTIN, error) {
+	normalized, err := NormalizeGTIN(gtin)
+	if err != nil {
+		return SGTIN{}, err
+	}
+
+	err = ValidateSerial(serial)
+	if err != nil {
+		return SGTIN{}, err
+	}
+	if i := strings.IndexAny(serial, "()"); i >= 0 {
+		return SGTIN{}, fmt.Errorf("serial number %q contains %q at position %d, which cannot be used in an SGTIN", serial, serial[i], i+1)
+	}
+
+	return SGTIN{GTIN: normalized, Serial: serial}, nil
+}
+
+// String returns the SGTIN as a GS1 element string, e.g. (01)07501001234560(21)SN001.
+// This is the canonical form used as the medication key; ParseSGTIN reads it back for any
+// SGTIN built by NewSGTIN.
+func (sgtin SGTIN) String() string {
+	return "(" + AIGTIN + ")" + sgtin.GTIN + "(" + AISerial + ")" + sgtin.Serial
+}
+
+// URN returns the SGTIN as an EPC pure identity URI. The length of the GS1 company prefix
+// cannot be derived from the GTIN and must be supplied.
+func (sgtin SGTIN) URN(companyPrefixLength int) (string, error) {
+	if companyPrefixLength < 6 || companyPrefixLength > 12 {
+		return "", fmt.Errorf("invalid company prefix length %d: expecting 6 to 12", companyPrefixLength)
+	}
+
+	indicator := sgtin.GTIN[:1]
+	companyPrefix := sgtin.GTIN[1 : 1+companyPrefixLength]
+	itemReference := sgtin.GTIN[1+companyPrefixLength : 13]
+
+	return sgtinURNPrefix + companyPrefix + "." + indicator + itemReference + "." + escapeURNSerial(sgtin.Serial), nil
+}
+
+// ParseSGTIN decodes an SGTIN given as a GS1 element string carrying AIs (01) and (21)
+// or as an EPC URI such as urn:epc:id:sgtin:0614141.812345.6789
+func ParseSGTIN(value string) (SGTIN, error) {
+	if strings.HasPrefix(value, sgtinURNPrefix) {
+		return parseSGTINURN(value)
+	}
+
+	elements, err := ParseElementString(value)
+	if err != nil {
+		return SGTIN{}, err
+	}
+	if elements.GTIN == "" || elements.Serial == "" {
+		return SGTIN{}, fmt.Errorf("%q does not carry both AI (01) and AI (21)", value)
+	}
+
+	return NewSGTIN(elements.GTIN, elements.Serial)
+}
+
+func parseSGTINURN(urn string) (SGTIN, error) {
+	parts := strings.Split(strings.TrimPrefix(urn, sgtinURNPrefix), ".")
+	if len(parts) != 3 {
+		return SGTIN{}, fmt.Errorf("invalid SGTIN URI %q: expecting companyPrefix.itemReference.serial", urn)
+	}
+
+	companyPrefix, itemReference := parts[0], parts[1]
+	if len(companyPrefix)+len(itemReference) != 13 || !isDigits(companyPrefix) || !isDigits(itemReference) {
+		return SGTIN{}, fmt.Errorf("invalid SGTIN URI %q: company prefix and item reference must have 13 digits together", urn)
+	}
+
+	serial, err := url.PathUnescape(parts[2])
+	if err != nil {
+		return SGTIN{}, fmt.Errorf("invalid SGTIN URI %q: %s", urn, err)
+	}
+
+	// The first digit of the item reference is the GTIN indicator digit
+	withoutCheckDigit := itemReference[:1] + companyPrefix + itemReference[1:]
+	checkDigit, err := CheckDigit(withoutCheckDigit)
+	if err != nil {
+		return SGTIN{}, err
+	}
+
+	return NewSGTIN(fmt.Sprintf("%s%d", withoutCheckDigit, checkDigit), serial)
+}
+
+// escapeURNSerial percent-encodes the characters that may not appear literally in an EPC URI
+func escapeURNSerial(serial string) string {
+	var escaped strings.Builder
+	for i := 0; i < len(serial); i++ {
+		switch c := serial[i]; c {
+		case '"', '%', '&', '/', '<', '>', '?':
+			fmt.Fprintf(&escaped, "%%%02X", c)
+		default:
+			escaped.WriteByte(c)
+		}
+	}
+	return escaped.String()
+}
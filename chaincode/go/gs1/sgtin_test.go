@@ -0,0 +1,133 @@
+package gs1
+
+import (
+	"testing"
+)
+
+func TestNewSGTIN(t *testing.T) {
+	tests := []struct {
+		name    string
+		gtin    string
+		serial  string
+		want    string
+		wantErr bool
+	}{
+		{name: "GTIN-14", gtin: "07501001234560", serial: "SN001", want: "(01)07501001234560(21)SN001"},
+		{name: "GTIN-13 is normalized", gtin: "7501001234560", serial: "SN001", want: "(01)07501001234560(21)SN001"},
+		{name: "punctuation", gtin: "07501001234560", serial: "A-1/2.3", want: "(01)07501001234560(21)A-1/2.3"},
+		{name: "opening bracket", gtin: "07501001234560", serial: "X(10)Y", wantErr: true},
+		{name: "closing bracket", gtin: "07501001234560", serial: "X)Y", wantErr: true},
+		{name: "bad GTIN", gtin: "07501001234561", serial: "SN001", wantErr: true},
+		{name: "bad serial", gtin: "07501001234560", serial: "SN 001", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := NewSGTIN(test.gtin, test.serial)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("NewSGTIN(%q, %q) = %v, want an error", test.gtin, test.serial, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("NewSGTIN(%q, %q) returned error: %s", test.gtin, test.serial, err)
+			}
+			if got.String() != test.want {
+				t.Errorf("NewSGTIN(%q, %q) = %s, want %s", test.gtin, test.serial, got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseSGTIN(t *testing.T) {
+	want := SGTIN{GTIN: "07501001234560", Serial: "SN/001"}
+
+	tests := []struct {
+		name  string
+		value string
+	}{
+		{name: "canonical key", value: "(01)07501001234560(21)SN/001"},
+		{name: "bracketed with other AIs", value: "(01)07501001234560(17)251231(10)B1(21)SN/001"},
+		{name: "raw", value: "]d20107501001234560" + "21SN/001"},
+		{name: "EPC URI", value: "urn:epc:id:sgtin:7501001.023456.SN%2F001"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := ParseSGTIN(test.value)
+			if err != nil {
+				t.Fatalf("ParseSGTIN(%q) returned error: %s", test.value, err)
+			}
+			if got != want {
+				t.Errorf("ParseSGTIN(%q) = %+v, want %+v", test.value, got, want)
+			}
+		})
+	}
+}
+
+func TestParseSGTINRejects(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+	}{
+		{name: "missing serial", value: "(01)07501001234560"},
+		{name: "missing GTIN", value: "(21)SN001"},
+		{name: "raw serial with a bracket", value: "0107501001234560" + "21X(Y"},
+		{name: "URI with two parts", value: "urn:epc:id:sgtin:7501001.023456"},
+		{name: "URI with too few digits", value: "urn:epc:id:sgtin:7501001.02345.SN001"},
+		{name: "URI with a bad escape", value: "urn:epc:id:sgtin:7501001.023456.SN%ZZ"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := ParseSGTIN(test.value)
+			if err == nil {
+				t.Errorf("ParseSGTIN(%q) = %+v, want an error", test.value, got)
+			}
+		})
+	}
+}
+
+func TestSGTINKeyRoundTrip(t *testing.T) {
+	for _, serial := range []string{"SN001", "A!\"%&'*+,-./:;<=>?_z", "0000"} {
+		sgtin, err := NewSGTIN("07501001234560", serial)
+		if err != nil {
+			t.Fatalf("NewSGTIN(%q) returned error: %s", serial, err)
+		}
+
+		parsed, err := ParseSGTIN(sgtin.String())
+		if err != nil {
+			t.Fatalf("ParseSGTIN(%q) returned error: %s", sgtin.String(), err)
+		}
+		if parsed != sgtin {
+			t.Errorf("ParseSGTIN(%q) = %+v, want %+v", sgtin.String(), parsed, sgtin)
+		}
+	}
+}
+
+func TestSGTINURN(t *testing.T) {
+	sgtin := SGTIN{GTIN: "07501001234560", Serial: "SN/001"}
+
+	urn, err := sgtin.URN(7)
+	if err != nil {
+		t.Fatalf("URN returned error: %s", err)
+	}
+	if want := "urn:epc:id:sgtin:7501001.023456.SN%2F001"; urn != want {
+		t.Errorf("URN(7) = %q, want %q", urn, want)
+	}
+
+	parsed, err := ParseSGTIN(urn)
+	if err != nil {
+		t.Fatalf("ParseSGTIN(%q) returned error: %s", urn, err)
+	}
+	if parsed != sgtin {
+		t.Errorf("ParseSGTIN(%q) = %+v, want %+v", urn, parsed, sgtin)
+	}
+
+	for _, length := range []int{5, 13} {
+		if _, err := sgtin.URN(length); err == nil {
+			t.Errorf("URN(%d) accepted an invalid company prefix length", length)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/chaincode/lib/cid"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// SubmitterIdentity identifies the client that submitted a transaction, as resolved
+// from the transaction creator rather than from caller-supplied arguments
+type SubmitterIdentity struct {
+	MSPID      string `json:"mspId"`
+	ID         string `json:"id"`
+	Subject    string `json:"subject"`
+	CommonName string `json:"commonName"`
+}
+
+// getSubmitterIdentity resolves the MSP ID and certificate subject of the transaction creator
+func getSubmitterIdentity(stub shim.ChaincodeStubInterface) (*SubmitterIdentity, error) {
+	clientIdentity, err := cid.New(stub)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read client identity: %s", err)
+	}
+
+	mspID, err := clientIdentity.GetMSPID()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read client MSP ID: %s", err)
+	}
+
+	id, err := clientIdentity.GetID()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read client ID: %s", err)
+	}
+
+	cert, err := clientIdentity.GetX509Certificate()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read client certificate: %s", err)
+	}
+	if cert == nil {
+		return nil, fmt.Errorf("client identity has no X.509 certificate")
+	}
+
+	return &SubmitterIdentity{
+		MSPID:      mspID,
+		ID:         id,
+		Subject:    cert.Subject.String(),
+		CommonName: cert.Subject.CommonName,
+	}, nil
+}
+
+// displayLabel returns the caller-supplied label, falling back to the certificate common name
+func (identity *SubmitterIdentity) displayLabel(label string) string {
+	if label != "" {
+		return label
+	}
+	if identity.CommonName != "" {
+		return identity.CommonName
+	}
+	return identity.MSPID
+}
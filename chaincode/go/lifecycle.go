@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+)
+
+// Tracking event types
+const (
+	EventCommission = "commission"
+	EventShip       = "ship"
+	EventReceive    = "receive"
+	EventDispense   = "dispense"
+	EventRecall     = "recall"
+	EventDestroy    = "destroy"
+	EventReturn     = "return"
+
+	// EventLiftRecall restores a recalled unit to its status before the recall.
+	// It is only written by liftRecall and is not part of the lifecycle table.
+	EventLiftRecall = "lift_recall"
+
+	// Aggregation events record a unit entering or leaving a container. They do not
+	// change the lifecycle status and are not part of the lifecycle table.
+	EventPack   = "pack"
+	EventUnpack = "unpack"
+	EventRepack = "repack"
+)
+
+// Medication lifecycle statuses
+const (
+	StatusCommissioned = "commissioned"
+	StatusInTransit    = "in_transit"
+	StatusReceived     = "received"
+	StatusDispensed    = "dispensed"
+	StatusRecalled     = "recalled"
+	StatusReturned     = "returned"
+	StatusDestroyed    = "destroyed"
+
+	// statusLegacyActive is the catch-all status written before the lifecycle existed
+	statusLegacyActive = "active"
+)
+
+// lifecycleTransition describes which statuses an event may be applied to and the status it leads to
+type lifecycleTransition struct {
+	From []string
+	To   string
+}
+
+// lifecycle is the supply-chain state machine. Commission is only valid on a new unit,
+// so it has no source statuses here.
+var lifecycle = map[string]lifecycleTransition{
+	EventShip: {
+		From: []string{StatusCommissioned, StatusReceived},
+		To:   StatusInTransit,
+	},
+	EventReceive: {
+		From: []string{StatusInTransit, StatusReturned},
+		To:   StatusReceived,
+	},
+	EventDispense: {
+		From: []string{StatusReceived},
+		To:   StatusDispensed,
+	},
+	EventRecall: {
+		From: []string{StatusCommissioned, StatusInTransit, StatusReceived, StatusDispensed, StatusReturned},
+		To:   StatusRecalled,
+	},
+	EventReturn: {
+		From: []string{StatusReceived, StatusDispensed, StatusRecalled},
+		To:   StatusReturned,
+	},
+	EventDestroy: {
+		From: []string{StatusCommissioned, StatusReceived, StatusRecalled, StatusReturned},
+		To:   StatusDestroyed,
+	},
+}
+
+// nextStatus returns the status a medication moves to when event is applied,
+// or an error if the transition is not allowed from the current status
+func nextStatus(current, event string) (string, error) {
+	if event == EventCommission {
+		return "", fmt.Errorf("medication is already commissioned")
+	}
+
+	transition, ok := lifecycle[event]
+	if !ok {
+		return "", fmt.Errorf("unknown tracking event %q", event)
+	}
+
+	for _, from := range transition.From {
+		if from == current {
+			return transition.To, nil
+		}
+	}
+
+	return "", fmt.Errorf("illegal transition: cannot %s a medication in status %q", event, current)
+}
+
+// resolveLegacyStatus replays the tracking history of a medication written before the
+// lifecycle existed (status "active") to find the status it is actually in
+func resolveLegacyStatus(history []TrackingEvent) string {
+	status := StatusCommissioned
+	statusBeforeRecall := StatusCommissioned
+	for _, event := range history {
+		if event.Event == EventLiftRecall && status == StatusRecalled {
+			status = statusBeforeRecall
+			continue
+		}
+		if transition, ok := lifecycle[event.Event]; ok {
+			if transition.To == StatusRecalled {
+				statusBeforeRecall = status
+			}
+			status = transition.To
+		}
+	}
+	return status
+}
+
+// resolveStatusBeforeLastRecall replays the tracking history up to the most recent recall
+// event to find the status a unit had when it was recalled
+func resolveStatusBeforeLastRecall(history []TrackingEvent) string {
+	for i := len(history) - 1; i >= 0; i-- {
+		if history[i].Event == EventRecall {
+			return resolveLegacyStatus(history[:i])
+		}
+	}
+	return resolveLegacyStatus(history)
+}
+
+// checkCustody checks that the submitter's MSP holds an item before it applies an event to it.
+// A shipped or returned item stays with its sender until it is received, so a receive is the
+// event by which another MSP takes custody and is accepted from anyone. Legacy items with no
+// known holder are not checked.
+func checkCustody(item, holderMSPID, event string, submitter *SubmitterIdentity) error {
+	if event == EventReceive || holderMSPID == "" {
+		return nil
+	}
+	if holderMSPID != submitter.MSPID {
+		return fmt.Errorf("%s is held by MSP %s, not %s", item, holderMSPID, submitter.MSPID)
+	}
+	return nil
+}
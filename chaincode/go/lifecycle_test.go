@@ -0,0 +1,155 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+func TestNextStatus(t *testing.T) {
+	tests := []struct {
+		current string
+		event   string
+		want    string
+		wantErr bool
+	}{
+		{current: StatusCommissioned, event: EventShip, want: StatusInTransit},
+		{current: StatusReceived, event: EventShip, want: StatusInTransit},
+		{current: StatusInTransit, event: EventReceive, want: StatusReceived},
+		{current: StatusReturned, event: EventReceive, want: StatusReceived},
+		{current: StatusReceived, event: EventDispense, want: StatusDispensed},
+		{current: StatusDispensed, event: EventReturn, want: StatusReturned},
+		{current: StatusRecalled, event: EventDestroy, want: StatusDestroyed},
+		{current: StatusCommissioned, event: EventDispense, wantErr: true},
+		{current: StatusInTransit, event: EventShip, wantErr: true},
+		{current: StatusDispensed, event: EventShip, wantErr: true},
+		{current: StatusDestroyed, event: EventReceive, wantErr: true},
+		{current: StatusReceived, event: EventCommission, wantErr: true},
+		{current: StatusReceived, event: "teleport", wantErr: true},
+	}
+
+	for _, test := range tests {
+		got, err := nextStatus(test.current, test.event)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("nextStatus(%q, %q) = %q, want an error", test.current, test.event, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("nextStatus(%q, %q) returned error: %s", test.current, test.event, err)
+		} else if got != test.want {
+			t.Errorf("nextStatus(%q, %q) = %q, want %q", test.current, test.event, got, test.want)
+		}
+	}
+}
+
+func TestResolveLegacyStatus(t *testing.T) {
+	history := func(events ...string) []TrackingEvent {
+		trackingHistory := []TrackingEvent{{Event: EventCommission}}
+		for _, event := range events {
+			trackingHistory = append(trackingHistory, TrackingEvent{Event: event})
+		}
+		return trackingHistory
+	}
+
+	tests := []struct {
+		name    string
+		history []TrackingEvent
+		want    string
+	}{
+		{name: "commissioned", history: history(), want: StatusCommissioned},
+		{name: "received", history: history(EventShip, EventReceive), want: StatusReceived},
+		{name: "recalled", history: history(EventShip, EventRecall), want: StatusRecalled},
+		{name: "recall lifted", history: history(EventShip, EventRecall, EventLiftRecall), want: StatusInTransit},
+		{name: "aggregation events are ignored", history: history(EventPack, EventShip, EventUnpack), want: StatusInTransit},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := resolveLegacyStatus(test.history); got != test.want {
+				t.Errorf("resolveLegacyStatus() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestCheckCustody(t *testing.T) {
+	submitter := &SubmitterIdentity{MSPID: "DistributorMSP"}
+
+	tests := []struct {
+		name        string
+		holderMSPID string
+		event       string
+		wantErr     bool
+	}{
+		{name: "holder ships", holderMSPID: "DistributorMSP", event: EventShip},
+		{name: "other MSP ships", holderMSPID: "ManufacturerMSP", event: EventShip, wantErr: true},
+		{name: "other MSP destroys", holderMSPID: "ManufacturerMSP", event: EventDestroy, wantErr: true},
+		{name: "other MSP receives", holderMSPID: "ManufacturerMSP", event: EventReceive},
+		{name: "legacy item without holder", holderMSPID: "", event: EventShip},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := checkCustody("medication X", test.holderMSPID, test.event, submitter)
+			if test.wantErr && err == nil {
+				t.Errorf("checkCustody(%q, %q) accepted a submitter that does not hold the item", test.holderMSPID, test.event)
+			}
+			if !test.wantErr && err != nil {
+				t.Errorf("checkCustody(%q, %q) returned error: %s", test.holderMSPID, test.event, err)
+			}
+		})
+	}
+}
+
+func TestAddTrackingEventFollowsLifecycleAndCustody(t *testing.T) {
+	network := newTestNetwork(t)
+	medicationID := network.commission("BATCH001", "SN001")
+
+	steps := []struct {
+		name      string
+		identity  []byte
+		event     string
+		actor     string
+		wantError string // empty if the event must be accepted
+		want      string // status after the step
+	}{
+		{name: "non-holder ships", identity: network.distributor, event: EventShip, actor: testDistributorGLN, wantError: "held by MSP ManufacturerMSP", want: StatusCommissioned},
+		{name: "manufacturer dispenses", identity: network.manufacturer, event: EventDispense, actor: testManufacturerGLN, wantError: "Access denied", want: StatusCommissioned},
+		{name: "manufacturer ships", identity: network.manufacturer, event: EventShip, actor: testManufacturerGLN, want: StatusInTransit},
+		{name: "ship while in transit", identity: network.manufacturer, event: EventShip, actor: testManufacturerGLN, wantError: "illegal transition", want: StatusInTransit},
+		{name: "actor of another MSP", identity: network.distributor, event: EventReceive, actor: testPharmacyGLN, wantError: "belongs to MSP PharmacyMSP", want: StatusInTransit},
+		{name: "distributor receives", identity: network.distributor, event: EventReceive, actor: testDistributorGLN, want: StatusReceived},
+		{name: "former holder ships", identity: network.manufacturer, event: EventShip, actor: testManufacturerGLN, wantError: "held by MSP DistributorMSP", want: StatusReceived},
+		{name: "distributor ships", identity: network.distributor, event: EventShip, actor: testDistributorGLN, want: StatusInTransit},
+		{name: "pharmacy receives", identity: network.pharmacy, event: EventReceive, actor: testPharmacyGLN, want: StatusReceived},
+		{name: "pharmacy dispenses", identity: network.pharmacy, event: EventDispense, actor: testPharmacyGLN, want: StatusDispensed},
+		{name: "ship after dispensing", identity: network.pharmacy, event: EventShip, actor: testPharmacyGLN, wantError: "illegal transition", want: StatusDispensed},
+		{name: "recall as tracking event", identity: network.manufacturer, event: EventRecall, actor: testManufacturerGLN, wantError: "issueMedicationRecall", want: StatusDispensed},
+	}
+
+	events := 1 // the commission event
+	for _, step := range steps {
+		network.advance(time.Hour)
+		response := network.invoke(step.identity, "addTrackingEvent", medicationID, step.event, "Location of "+step.actor, step.actor, "")
+		if step.wantError == "" {
+			if response.Status != shim.OK {
+				t.Fatalf("%s: addTrackingEvent failed: %s", step.name, response.Message)
+			}
+			events++
+		} else if response.Status == shim.OK || !strings.Contains(response.Message, step.wantError) {
+			t.Fatalf("%s: addTrackingEvent = %d %q, want an error containing %q", step.name, response.Status, response.Message, step.wantError)
+		}
+
+		medication := network.medication(medicationID)
+		if medication.Status != step.want {
+			t.Fatalf("%s: status = %q, want %q", step.name, medication.Status, step.want)
+		}
+		if medication.EventCount != events {
+			t.Fatalf("%s: %d events stored, want %d", step.name, medication.EventCount, events)
+		}
+	}
+}
@@ -0,0 +1,445 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+
+	"drug-traceability/gs1"
+)
+
+// medicationAliasKeyType maps a legacy batch-serial medication ID to its SGTIN key
+const medicationAliasKeyType = "medicationAlias~legacyId"
+
+// MedicationIDMigration records one medication moved to its SGTIN key
+type MedicationIDMigration struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// MedicationIDSkipped records a medication that could not be moved and why
+type MedicationIDSkipped struct {
+	MedicationID string `json:"medicationId"`
+	Reason       string `json:"reason"`
+}
+
+// Helper function to turn any accepted form of a medication ID into its world state key.
+// SGTIN element strings and EPC URIs are normalized, legacy batch-serial IDs of migrated
+// records are resolved through their alias, and anything else is returned unchanged.
+// A unit stored before serials with brackets were rejected is found under its exact key,
+// which would otherwise parse as a different SGTIN.
+func (s *SmartContract) resolveMedicationID(stub shim.ChaincodeStubInterface, medicationID string) (string, error) {
+	sgtin, err := gs1.ParseSGTIN(medicationID)
+	if err == nil {
+		if sgtin.String() != medicationID {
+			existing, err := stub.GetState(medicationID)
+			if err != nil {
+				return "", err
+			}
+			if existing != nil {
+				return medicationID, nil
+			}
+		}
+		return sgtin.String(), nil
+	}
+
+	aliasKey, err := stub.CreateCompositeKey(medicationAliasKeyType, []string{medicationID})
+	if err != nil {
+		return "", err
+	}
+
+	target, err := stub.GetState(aliasKey)
+	if err != nil {
+		return "", err
+	}
+	if target != nil {
+		return string(target), nil
+	}
+
+	return medicationID, nil
+}
+
+// migrateMedicationIDs moves medications stored under legacy batch-serial keys to SGTIN keys,
+// together with their tracking events and index entries, and leaves an alias behind so the
+// old IDs still resolve. Records whose GTIN or serial number is not valid GS1 are skipped.
+// Legacy tracking_ records must be migrated with migrateTrackingEvents first. Only regulators may run it.
+// Args: [maxUnits] (optional, 0 or omitted migrates everything in one transaction)
+func (s *SmartContract) migrateMedicationIDs(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) > 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 0 or 1: maxUnits")
+	}
+
+	isRegulator, err := s.callerHasRole(stub, RoleRegulator)
+	if err != nil {
+		return shim.Error("Access denied: " + err.Error())
+	}
+	if !isRegulator {
+		return shim.Error("Access denied: only regulators may migrate medication IDs")
+	}
+
+	maxUnits := 0
+	if len(args) == 1 && args[0] != "" {
+		limit, err := strconv.Atoi(args[0])
+		if err != nil || limit < 0 {
+			return shim.Error("maxUnits must be a non-negative integer")
+		}
+		maxUnits = limit
+	}
+
+	legacyIterator, err := stub.GetStateByRange(legacyTrackingPrefix, "tracking`")
+	if err != nil {
+		return shim.Error("Failed to get legacy tracking events: " + err.Error())
+	}
+	pendingLegacyEvents := legacyIterator.HasNext()
+	legacyIterator.Close()
+	if pendingLegacyEvents {
+		return shim.Error("Legacy tracking events remain; run migrateTrackingEvents first")
+	}
+
+	resultsIterator, err := stub.GetStateByRange("", "")
+	if err != nil {
+		return shim.Error("Failed to get state by range: " + err.Error())
+	}
+	defer resultsIterator.Close()
+
+	var migrated []MedicationIDMigration
+	skipped := []MedicationIDSkipped{}
+	renamed := make(map[string]string)
+	remaining := false
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error("Failed to get next result: " + err.Error())
+		}
+
+		medication, ok := parseMedicationRecord(queryResponse.Key, queryResponse.Value)
+		if !ok {
+			continue // Skip records that are not medications
+		}
+
+		sgtin, err := gs1.NewSGTIN(medication.GTIN, medication.SerialNumber)
+		if err != nil {
+			skipped = append(skipped, MedicationIDSkipped{MedicationID: medication.ID, Reason: err.Error()})
+			continue
+		}
+		newID := sgtin.String()
+		if newID == medication.ID {
+			continue // Already keyed by SGTIN
+		}
+
+		if maxUnits > 0 && len(migrated) == maxUnits {
+			remaining = true
+			break
+		}
+
+		existing, err := stub.GetState(newID)
+		if err != nil {
+			return shim.Error("Failed to read medication from world state: " + err.Error())
+		}
+		if existing != nil {
+			skipped = append(skipped, MedicationIDSkipped{MedicationID: medication.ID, Reason: "SGTIN " + newID + " is already taken"})
+			continue
+		}
+
+		err = s.moveMedication(stub, medication, sgtin)
+		if err != nil {
+			return shim.Error("Failed to migrate medication " + medication.ID + ": " + err.Error())
+		}
+
+		migrated = append(migrated, MedicationIDMigration{From: queryResponse.Key, To: newID})
+		renamed[queryResponse.Key] = newID
+	}
+
+	err = s.renameRecallUnits(stub, renamed)
+	if err != nil {
+		return shim.Error("Failed to migrate recall units: " + err.Error())
+	}
+
+	var summary = struct {
+		Migrated        []MedicationIDMigration `json:"migrated"`
+		Skipped         []MedicationIDSkipped   `json:"skipped"`
+		RemainingLegacy bool                    `json:"remainingLegacyIds"`
+	}{
+		Migrated:        migrated,
+		Skipped:         skipped,
+		RemainingLegacy: remaining,
+	}
+
+	summaryJSON, err := json.Marshal(summary)
+	if err != nil {
+		return shim.Error("Failed to marshal migration summary: " + err.Error())
+	}
+
+	err = s.emitEvent(stub, EventNameMedicationIDsMigrated, MedicationIDsMigratedEvent{
+		MigratedUnits:      len(migrated),
+		SkippedUnits:       len(skipped),
+		RemainingLegacyIDs: remaining,
+	})
+	if err != nil {
+		return shim.Error("Failed to emit chaincode event: " + err.Error())
+	}
+
+	fmt.Printf("Migrated %d medications to SGTIN keys, skipped %d\n", len(migrated), len(skipped))
+	return shim.Success(summaryJSON)
+}
+
+// Helper function to move a medication and its tracking events, verification records, clone
+// alerts and index entries to its SGTIN key. The stored GTIN is normalized to GTIN-14 on the way.
+func (s *SmartContract) moveMedication(stub shim.ChaincodeStubInterface, medication *MedicationData, sgtin gs1.SGTIN) error {
+	oldID := medication.ID
+	newID := sgtin.String()
+
+	// Events embed the medication ID, so the chain is rebuilt under the new ID
+	medication.HeadHash = ""
+
+	eventsIterator, err := stub.GetStateByPartialCompositeKey(eventKeyType, []string{oldID})
+	if err != nil {
+		return err
+	}
+	defer eventsIterator.Close()
+
+	for eventsIterator.HasNext() {
+		queryResponse, err := eventsIterator.Next()
+		if err != nil {
+			return err
+		}
+
+		_, keyParts, err := stub.SplitCompositeKey(queryResponse.Key)
+		if err != nil || len(keyParts) != 2 {
+			continue // Skip malformed keys
+		}
+
+		var event TrackingEvent
+		err = json.Unmarshal(queryResponse.Value, &event)
+		if err != nil {
+			return fmt.Errorf("failed to unmarshal tracking event %s: %s", queryResponse.Key, err)
+		}
+		event.keepSignedFields()
+		event.MedicationID = newID
+
+		eventJSON, err := chainEvent(medication, &event)
+		if err != nil {
+			return err
+		}
+
+		eventKey, err := stub.CreateCompositeKey(eventKeyType, []string{newID, keyParts[1]})
+		if err != nil {
+			return err
+		}
+
+		err = stub.PutState(eventKey, eventJSON)
+		if err != nil {
+			return err
+		}
+
+		err = stub.DelState(queryResponse.Key)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = s.moveVerificationRecords(stub, oldID, newID)
+	if err != nil {
+		return err
+	}
+
+	err = s.moveAlerts(stub, oldID, newID)
+	if err != nil {
+		return err
+	}
+
+	// Replace the index entries that carry the medication ID
+	oldIndexKeys := [][]string{
+		{manufacturerKeyType, medication.Manufacturer, oldID},
+		{gtinKeyType, medication.GTIN, medication.Batch, oldID},
+	}
+	if medication.ParentSSCC != "" {
+		oldIndexKeys = append(oldIndexKeys, []string{containerChildKeyType, medication.ParentSSCC, childKindUnit, oldID})
+	}
+	for _, indexKey := range oldIndexKeys {
+		key, err := stub.CreateCompositeKey(indexKey[0], indexKey[1:])
+		if err != nil {
+			return err
+		}
+
+		err = stub.DelState(key)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = s.deleteMedicationStateIndexes(stub, medication, nil)
+	if err != nil {
+		return err
+	}
+
+	medication.ID = newID
+	medication.GTIN = sgtin.GTIN
+	err = s.putMedicationIndexes(stub, medication)
+	if err != nil {
+		return err
+	}
+
+	if medication.ParentSSCC != "" {
+		childKey, err := stub.CreateCompositeKey(containerChildKeyType, []string{medication.ParentSSCC, childKindUnit, newID})
+		if err != nil {
+			return err
+		}
+
+		err = stub.PutState(childKey, []byte{0x00})
+		if err != nil {
+			return err
+		}
+	}
+
+	aliasKey, err := stub.CreateCompositeKey(medicationAliasKeyType, []string{oldID})
+	if err != nil {
+		return err
+	}
+
+	err = stub.PutState(aliasKey, []byte(newID))
+	if err != nil {
+		return err
+	}
+
+	err = s.putMedication(stub, medication)
+	if err != nil {
+		return err
+	}
+
+	return stub.DelState(oldID)
+}
+
+// Helper function to point the verification records of a medication and their index entries at its new ID
+func (s *SmartContract) moveVerificationRecords(stub shim.ChaincodeStubInterface, oldID string, newID string) error {
+	records, err := s.getVerificationRecordsForMedication(stub, oldID)
+	if err != nil {
+		return err
+	}
+
+	for i := range records {
+		record := &records[i]
+		oldKey, err := stub.CreateCompositeKey(verificationMedKeyType, []string{oldID, record.Date, record.ID})
+		if err != nil {
+			return err
+		}
+
+		err = stub.DelState(oldKey)
+		if err != nil {
+			return err
+		}
+
+		record.MedicationID = newID
+		err = s.putVerificationRecord(stub, record)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Helper function to move the clone alerts of a medication to its new ID
+func (s *SmartContract) moveAlerts(stub shim.ChaincodeStubInterface, oldID string, newID string) error {
+	alerts, err := s.getAlertsForMedication(stub, oldID)
+	if err != nil {
+		return err
+	}
+
+	for i := range alerts {
+		alert := &alerts[i]
+		oldKey, err := stub.CreateCompositeKey(alertKeyType, []string{oldID, alert.ID})
+		if err != nil {
+			return err
+		}
+
+		err = stub.DelState(oldKey)
+		if err != nil {
+			return err
+		}
+
+		alert.MedicationID = newID
+		err = s.putAlert(stub, alert)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Helper function to point recall unit index entries and unit recall selectors at renamed medications
+func (s *SmartContract) renameRecallUnits(stub shim.ChaincodeStubInterface, renamed map[string]string) error {
+	if len(renamed) == 0 {
+		return nil
+	}
+
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(recallUnitKeyType, []string{})
+	if err != nil {
+		return err
+	}
+	defer resultsIterator.Close()
+
+	recalls := make(map[string]*Recall)
+	var recallIDs []string
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return err
+		}
+
+		_, keyParts, err := stub.SplitCompositeKey(queryResponse.Key)
+		if err != nil || len(keyParts) != 2 {
+			continue // Skip malformed index entries
+		}
+
+		newID, ok := renamed[keyParts[1]]
+		if !ok {
+			continue
+		}
+
+		unitKey, err := stub.CreateCompositeKey(recallUnitKeyType, []string{keyParts[0], newID})
+		if err != nil {
+			return err
+		}
+
+		err = stub.PutState(unitKey, queryResponse.Value)
+		if err != nil {
+			return err
+		}
+
+		err = stub.DelState(queryResponse.Key)
+		if err != nil {
+			return err
+		}
+
+		if _, seen := recalls[keyParts[0]]; !seen {
+			recall, err := s.readRecall(stub, keyParts[0])
+			if err != nil {
+				return err
+			}
+			recalls[keyParts[0]] = recall
+			recallIDs = append(recallIDs, keyParts[0])
+		}
+	}
+
+	// Unit recalls name their medication in the selector
+	for _, recallID := range recallIDs {
+		recall := recalls[recallID]
+		newID, ok := renamed[recall.Selector.MedicationID]
+		if !ok {
+			continue
+		}
+
+		recall.Selector.MedicationID = newID
+		err = s.putRecall(stub, recall)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"testing"
+	"time"
+)
+
+// commissionLegacy stores a unit under a batch-serial key with a 13-digit GTIN, as units were
+// commissioned before medication IDs were SGTINs
+func (network *testNetwork) commissionLegacy(batch, serial string) string {
+	medication := MedicationData{
+		ID:              batch + "-" + serial,
+		GTIN:            testGTIN[1:],
+		Batch:           batch,
+		SerialNumber:    serial,
+		ExpiryDate:      network.txTime.AddDate(2, 0, 0).Format(expiryDateLayout),
+		Manufacturer:    "PharmaCorp",
+		ManufacturerMSP: "ManufacturerMSP",
+		ManufacturerGLN: testManufacturerGLN,
+		ProductName:     "Paracetamol 500mg",
+		Location:        "Manufacturing Plant A",
+		Timestamp:       network.txTime.Unix(),
+		Status:          StatusCommissioned,
+		CommissionTime:  network.txTime.Unix(),
+	}
+
+	network.transact(network.manufacturer, func() {
+		submitter, err := getSubmitterIdentity(network)
+		if err != nil {
+			network.t.Fatalf("failed to resolve submitter identity: %s", err)
+		}
+		_, _, err = network.cc.commissionUnit(network, &medication, submitter, nil)
+		if err != nil {
+			network.t.Fatalf("failed to commission legacy unit: %s", err)
+		}
+	})
+	return medication.ID
+}
+
+// registerTestSigningKey registers a new ECDSA signing key for the manufacturer participant
+func (network *testNetwork) registerTestSigningKey(keyID string) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		network.t.Fatalf("failed to generate key: %s", err)
+	}
+	publicKeyDER, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		network.t.Fatalf("failed to marshal public key: %s", err)
+	}
+	publicKeyPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicKeyDER})
+
+	network.mustInvoke(network.manufacturer, "registerSigningKey", testManufacturerGLN, keyID, string(publicKeyPEM))
+	return key
+}
+
+// sign returns the keyId:base64Signature argument of a signed tracking event
+func sign(t *testing.T, key *ecdsa.PrivateKey, keyID string, payload SigningPayload) string {
+	digest := sha256.Sum256(payload.bytes())
+	signature, err := ecdsa.SignASN1(rand.Reader, key, digest[:])
+	if err != nil {
+		t.Fatalf("failed to sign payload: %s", err)
+	}
+	return keyID + ":" + base64.StdEncoding.EncodeToString(signature)
+}
+
+func TestMigrateMedicationIDs(t *testing.T) {
+	network := newTestNetwork(t)
+	key := network.registerTestSigningKey("key1")
+
+	legacyID := network.commissionLegacy("BATCH001", "SN001")
+	const newID = "(01)07501001234560(21)SN001"
+
+	// A signed event, signed over the legacy ID and the head hash of that time
+	network.advance(time.Hour)
+	signature := sign(t, key, "key1", SigningPayload{
+		Actor:    testManufacturerGLN,
+		Event:    EventShip,
+		Location: "Manufacturing Plant A",
+		Previous: network.medication(legacyID).HeadHash,
+		Subject:  legacyID,
+	})
+	network.mustInvoke(network.manufacturer, "addTrackingEvent", legacyID, EventShip, "Manufacturing Plant A", testManufacturerGLN, signature)
+
+	network.advance(time.Hour)
+	network.mustInvoke(network.distributor, "addTrackingEvent", legacyID, EventReceive, "Warehouse B", testDistributorGLN, "")
+
+	// Two verifications far apart within the clone detection window raise an alert
+	network.advance(time.Minute)
+	network.mustInvoke(network.distributor, "recordVerification", legacyID, "Warehouse B", testDistributorGLN)
+	network.advance(time.Minute)
+	network.mustInvoke(network.pharmacy, "recordVerification", legacyID, "Street Market", "")
+
+	if response := network.invoke(network.manufacturer, "migrateMedicationIDs"); response.Status == 200 {
+		t.Fatalf("migrateMedicationIDs accepted a manufacturer")
+	}
+	network.mustInvoke(network.regulator, "migrateMedicationIDs")
+
+	if network.State[legacyID] != nil {
+		t.Errorf("medication is still stored under %s", legacyID)
+	}
+	medication := network.medication(newID)
+	if medication.GTIN != testGTIN {
+		t.Errorf("GTIN = %s, want the GTIN-14 %s", medication.GTIN, testGTIN)
+	}
+	if medication.EventCount != 3 {
+		t.Errorf("%d events moved, want 3", medication.EventCount)
+	}
+
+	// The legacy ID still resolves, and the moved history still verifies
+	var result VerificationResult
+	err := json.Unmarshal(network.mustInvoke(network.pharmacy, "verifyMedication", legacyID), &result)
+	if err != nil {
+		t.Fatalf("failed to unmarshal verification result: %s", err)
+	}
+	if result.MedicationData.ID != newID {
+		t.Errorf("verifyMedication(%s) found %s, want %s", legacyID, result.MedicationData.ID, newID)
+	}
+	if !result.EventChain.Valid {
+		t.Errorf("event chain breaks after the migration: %+v", result.EventChain.Breaks)
+	}
+	wantSignatures := []string{SignatureUnsigned, SignatureValid, SignatureUnsigned}
+	if len(result.Signatures) != len(wantSignatures) {
+		t.Fatalf("%d signature checks, want %d", len(result.Signatures), len(wantSignatures))
+	}
+	for i, check := range result.Signatures {
+		if check.Status != wantSignatures[i] {
+			t.Errorf("signature of event %d is %s (%s), want %s", i, check.Status, check.Reason, wantSignatures[i])
+		}
+	}
+
+	// Verification records and clone alerts moved with the unit
+	for _, id := range []string{legacyID, newID} {
+		records, err := network.cc.getVerificationRecordsForMedication(network, id)
+		if err != nil {
+			t.Fatalf("failed to get verification records: %s", err)
+		}
+		alerts, err := network.cc.getAlertsForMedication(network, id)
+		if err != nil {
+			t.Fatalf("failed to get alerts: %s", err)
+		}
+
+		wantRecords, wantAlerts := 0, 0
+		if id == newID {
+			wantRecords, wantAlerts = 2, 1
+		}
+		if len(records) != wantRecords || len(alerts) != wantAlerts {
+			t.Errorf("%s has %d verification records and %d alerts, want %d and %d", id, len(records), len(alerts), wantRecords, wantAlerts)
+		}
+		for _, record := range records {
+			if record.MedicationID != newID {
+				t.Errorf("verification record %s names medication %s, want %s", record.ID, record.MedicationID, newID)
+			}
+		}
+		for _, alert := range alerts {
+			if alert.MedicationID != newID {
+				t.Errorf("alert %s names medication %s, want %s", alert.ID, alert.MedicationID, newID)
+			}
+		}
+	}
+	if len(result.Alerts) != 1 {
+		t.Errorf("verifyMedication reports %d alerts, want 1", len(result.Alerts))
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// maxPageSize bounds the records scanned by one paged query
+const maxPageSize = 500
+
+// MedicationPage is one page of a paged medication query.
+// Bookmark is passed back to fetch the next page. FetchedCount is the number of ledger
+// records read for this page; a count below the page size means this was the last page.
+// A filtered search may return fewer records than it fetched.
+type MedicationPage struct {
+	Records      []MedicationData `json:"records"`
+	Bookmark     string           `json:"bookmark"`
+	FetchedCount int32            `json:"fetchedCount"`
+}
+
+// parsePageSize parses and bounds a pageSize argument
+func parsePageSize(pageSizeArg string) (int32, error) {
+	pageSize, err := strconv.Atoi(pageSizeArg)
+	if err != nil || pageSize <= 0 {
+		return 0, fmt.Errorf("pageSize must be a positive integer")
+	}
+	if pageSize > maxPageSize {
+		return 0, fmt.Errorf("pageSize must not exceed %d", maxPageSize)
+	}
+	return int32(pageSize), nil
+}
+
+// getMedicationsByManufacturerPaged returns one page of a manufacturer's medications
+// Args: [manufacturer, pageSize, bookmark]
+func (s *SmartContract) getMedicationsByManufacturerPaged(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 3: manufacturer, pageSize, bookmark")
+	}
+
+	manufacturer := args[0]
+	if manufacturer == "" {
+		return shim.Error("Missing manufacturer name")
+	}
+
+	pageSize, err := parsePageSize(args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	resultsIterator, metadata, err := stub.GetStateByPartialCompositeKeyWithPagination(manufacturerKeyType, []string{manufacturer}, pageSize, args[2])
+	if err != nil {
+		return shim.Error("Failed to get manufacturer index: " + err.Error())
+	}
+	defer resultsIterator.Close()
+
+	page := MedicationPage{Records: []MedicationData{}}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error("Failed to get next result: " + err.Error())
+		}
+
+		_, keyParts, err := stub.SplitCompositeKey(queryResponse.Key)
+		if err != nil || len(keyParts) != 2 {
+			continue // Skip malformed index entries
+		}
+
+		medicationJSON, err := stub.GetState(keyParts[1])
+		if err != nil {
+			return shim.Error("Failed to read medication from world state: " + err.Error())
+		}
+		if medicationJSON == nil {
+			continue // Stale index entry
+		}
+
+		var medication MedicationData
+		err = json.Unmarshal(medicationJSON, &medication)
+		if err != nil {
+			continue // Skip invalid records
+		}
+
+		page.Records = append(page.Records, medication)
+	}
+
+	return medicationPageResponse(&page, metadata)
+}
+
+// searchMedicationsPaged returns one page of searchMedications results
+// Args: [searchJSON or query, pageSize, bookmark]
+func (s *SmartContract) searchMedicationsPaged(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 3: search, pageSize, bookmark")
+	}
+
+	if args[0] == "" {
+		return shim.Error("Missing search query")
+	}
+
+	search, err := parseMedicationSearch(args[0])
+	if err != nil {
+		return shim.Error("Invalid search: " + err.Error())
+	}
+
+	pageSize, err := parsePageSize(args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	scan, metadata, err := s.openMedicationSearch(stub, search, pageSize, args[2])
+	if err != nil {
+		return shim.Error("Failed to query medications: " + err.Error())
+	}
+	defer scan.close()
+
+	records, err := collectSearchMatches(scan, search)
+	if err != nil {
+		return shim.Error("Failed to get next result: " + err.Error())
+	}
+
+	return medicationPageResponse(&MedicationPage{Records: records}, metadata)
+}
+
+// medicationPageResponse fills in the pagination metadata and marshals a page
+func medicationPageResponse(page *MedicationPage, metadata *pb.QueryResponseMetadata) pb.Response {
+	if metadata != nil {
+		page.Bookmark = metadata.Bookmark
+		page.FetchedCount = metadata.FetchedRecordsCount
+	}
+
+	pageJSON, err := json.Marshal(page)
+	if err != nil {
+		return shim.Error("Failed to marshal medications: " + err.Error())
+	}
+
+	return shim.Success(pageJSON)
+}
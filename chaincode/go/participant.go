@@ -0,0 +1,494 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+
+	"drug-traceability/gs1"
+)
+
+// Composite key object types of the participant registry
+const (
+	participantKeyType    = "participant~gln"
+	participantMSPKeyType = "participantMsp~mspId~gln"
+)
+
+// Participant statuses. Participants an organization registers itself are pending until a
+// regulator activates them, as nothing proves the organization owns the GLN.
+const (
+	ParticipantStatusPending   = "pending"
+	ParticipantStatusActive    = "active"
+	ParticipantStatusSuspended = "suspended"
+)
+
+// Participant is a supply-chain organization identified by its GS1 GLN.
+// Commissioning and tracking functions name manufacturers and actors by GLN; the
+// participant must be active and belong to the submitting MSP.
+type Participant struct {
+	GLN          string             `json:"gln"`
+	LegalName    string             `json:"legalName"`
+	Role         string             `json:"role"`
+	MSPID        string             `json:"mspId"`
+	Licenses     []License          `json:"licenses"`
+	Status       string             `json:"status"`
+	StatusReason string             `json:"statusReason,omitempty"`
+	RegisteredBy *SubmitterIdentity `json:"registeredBy"`
+	RegisteredAt int64              `json:"registeredAt"`
+	UpdatedBy    *SubmitterIdentity `json:"updatedBy,omitempty"`
+	UpdatedAt    int64              `json:"updatedAt,omitempty"`
+}
+
+// License is a regulatory license held by a participant, e.g. a manufacturing or wholesale license
+type License struct {
+	Type       string `json:"type"`
+	Number     string `json:"number"`
+	Issuer     string `json:"issuer"`
+	ValidUntil string `json:"validUntil,omitempty"` // YYYY-MM-DD
+}
+
+// ParticipantRecord is a participant as returned by getParticipant, with its signing keys
+type ParticipantRecord struct {
+	Participant
+	SigningKeys []SigningKey `json:"signingKeys"`
+}
+
+// validate checks the participant fields supplied by the caller
+func (participant *Participant) validate() error {
+	err := gs1.ValidateGLN(participant.GLN)
+	if err != nil {
+		return err
+	}
+	if participant.LegalName == "" {
+		return fmt.Errorf("missing legalName")
+	}
+	if !isKnownRole(participant.Role) {
+		return fmt.Errorf("unknown role %q", participant.Role)
+	}
+	if participant.MSPID == "" {
+		return fmt.Errorf("missing mspId")
+	}
+	for _, license := range participant.Licenses {
+		if license.Type == "" || license.Number == "" {
+			return fmt.Errorf("licenses require a type and a number")
+		}
+		if license.ValidUntil != "" {
+			if _, err := time.Parse(expiryDateLayout, license.ValidUntil); err != nil {
+				return fmt.Errorf("invalid license validUntil %q, expecting YYYY-MM-DD", license.ValidUntil)
+			}
+		}
+	}
+	return nil
+}
+
+// registerParticipant adds an organization to the participant registry.
+// Organizations may register participants for their own MSP and role; these stay pending until
+// a regulator activates them with setParticipantStatus. Regulators may register any participant,
+// which is active at once, and may replace a pending registration of a GLN squatted by another MSP.
+// Args: [participantJSON] with gln, legalName, role, mspId and licenses
+func (s *SmartContract) registerParticipant(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1: participant")
+	}
+
+	var participant Participant
+	err := json.Unmarshal([]byte(args[0]), &participant)
+	if err != nil {
+		return shim.Error("Failed to unmarshal participant: " + err.Error())
+	}
+
+	err = participant.validate()
+	if err != nil {
+		return shim.Error("Invalid participant: " + err.Error())
+	}
+
+	submitter, err := s.checkParticipantAdmin(stub, &participant)
+	if err != nil {
+		return shim.Error("Access denied: " + err.Error())
+	}
+
+	isRegulator, err := s.callerHasRole(stub, RoleRegulator)
+	if err != nil {
+		return shim.Error("Access denied: " + err.Error())
+	}
+
+	existing, err := s.findParticipant(stub, participant.GLN)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if existing != nil && !(isRegulator && existing.Status == ParticipantStatusPending) {
+		return shim.Error("Participant already exists with GLN: " + participant.GLN)
+	}
+
+	txTime, err := getTxTime(stub)
+	if err != nil {
+		return shim.Error("Failed to read transaction timestamp: " + err.Error())
+	}
+
+	participant.Status = ParticipantStatusActive
+	participant.StatusReason = ""
+	if !isRegulator {
+		participant.Status = ParticipantStatusPending
+		participant.StatusReason = "awaiting regulator approval"
+	}
+	participant.RegisteredBy = submitter
+	participant.RegisteredAt = txTime
+	participant.UpdatedBy = nil
+	participant.UpdatedAt = 0
+	if participant.Licenses == nil {
+		participant.Licenses = []License{}
+	}
+
+	err = s.putParticipant(stub, &participant)
+	if err != nil {
+		return shim.Error("Failed to put participant to world state: " + err.Error())
+	}
+
+	err = s.emitEvent(stub, EventNameParticipantRegistered, participant.event(submitter))
+	if err != nil {
+		return shim.Error("Failed to emit chaincode event: " + err.Error())
+	}
+
+	fmt.Printf("Participant registered: %s (%s)\n", participant.GLN, participant.LegalName)
+	return participantResponse(&participant)
+}
+
+// updateParticipant replaces the legal name and licenses of a participant.
+// Only regulators may change its role or MSP; the status is changed with setParticipantStatus.
+// Args: [participantJSON]
+func (s *SmartContract) updateParticipant(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1: participant")
+	}
+
+	var update Participant
+	err := json.Unmarshal([]byte(args[0]), &update)
+	if err != nil {
+		return shim.Error("Failed to unmarshal participant: " + err.Error())
+	}
+
+	err = update.validate()
+	if err != nil {
+		return shim.Error("Invalid participant: " + err.Error())
+	}
+
+	participant, err := s.readParticipant(stub, update.GLN)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// Callers must administer both the participant as stored and as updated
+	_, err = s.checkParticipantAdmin(stub, participant)
+	if err != nil {
+		return shim.Error("Access denied: " + err.Error())
+	}
+	submitter, err := s.checkParticipantAdmin(stub, &update)
+	if err != nil {
+		return shim.Error("Access denied: " + err.Error())
+	}
+
+	txTime, err := getTxTime(stub)
+	if err != nil {
+		return shim.Error("Failed to read transaction timestamp: " + err.Error())
+	}
+
+	participant.LegalName = update.LegalName
+	participant.Role = update.Role
+	participant.MSPID = update.MSPID
+	participant.Licenses = update.Licenses
+	if participant.Licenses == nil {
+		participant.Licenses = []License{}
+	}
+	participant.UpdatedBy = submitter
+	participant.UpdatedAt = txTime
+
+	err = s.putParticipant(stub, participant)
+	if err != nil {
+		return shim.Error("Failed to put participant to world state: " + err.Error())
+	}
+
+	err = s.emitEvent(stub, EventNameParticipantUpdated, participant.event(submitter))
+	if err != nil {
+		return shim.Error("Failed to emit chaincode event: " + err.Error())
+	}
+
+	fmt.Printf("Participant updated: %s\n", participant.GLN)
+	return participantResponse(participant)
+}
+
+// setParticipantStatus activates a pending participant, or suspends or reinstates one. Pending and
+// suspended participants cannot commission units or appear as actors on new tracking events.
+// Only regulators may do this.
+// Args: [gln, status, reason]
+func (s *SmartContract) setParticipantStatus(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 3: gln, status, reason")
+	}
+
+	isRegulator, err := s.callerHasRole(stub, RoleRegulator)
+	if err != nil {
+		return shim.Error("Access denied: " + err.Error())
+	}
+	if !isRegulator {
+		return shim.Error("Access denied: only regulators may change a participant's status")
+	}
+
+	status := args[1]
+	if status != ParticipantStatusActive && status != ParticipantStatusSuspended {
+		return shim.Error("Status must be " + ParticipantStatusActive + " or " + ParticipantStatusSuspended)
+	}
+
+	participant, err := s.readParticipant(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	submitter, err := getSubmitterIdentity(stub)
+	if err != nil {
+		return shim.Error("Failed to resolve submitter identity: " + err.Error())
+	}
+
+	txTime, err := getTxTime(stub)
+	if err != nil {
+		return shim.Error("Failed to read transaction timestamp: " + err.Error())
+	}
+
+	participant.Status = status
+	participant.StatusReason = args[2]
+	participant.UpdatedBy = submitter
+	participant.UpdatedAt = txTime
+
+	err = s.putParticipant(stub, participant)
+	if err != nil {
+		return shim.Error("Failed to put participant to world state: " + err.Error())
+	}
+
+	err = s.emitEvent(stub, EventNameParticipantStatusChanged, participant.event(submitter))
+	if err != nil {
+		return shim.Error("Failed to emit chaincode event: " + err.Error())
+	}
+
+	fmt.Printf("Participant %s is now %s\n", participant.GLN, status)
+	return participantResponse(participant)
+}
+
+// getParticipant returns a participant with its signing keys
+// Args: [gln]
+func (s *SmartContract) getParticipant(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1: gln")
+	}
+
+	participant, err := s.readParticipant(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	keys, err := s.getSigningKeysForParticipant(stub, participant.GLN)
+	if err != nil {
+		return shim.Error("Failed to get signing keys: " + err.Error())
+	}
+
+	recordJSON, err := json.Marshal(ParticipantRecord{Participant: *participant, SigningKeys: keys})
+	if err != nil {
+		return shim.Error("Failed to marshal participant: " + err.Error())
+	}
+
+	return shim.Success(recordJSON)
+}
+
+func participantResponse(participant *Participant) pb.Response {
+	participantJSON, err := json.Marshal(participant)
+	if err != nil {
+		return shim.Error("Failed to marshal participant: " + err.Error())
+	}
+	return shim.Success(participantJSON)
+}
+
+// event returns the chaincode event payload describing the participant
+func (participant *Participant) event(submitter *SubmitterIdentity) ParticipantEvent {
+	return ParticipantEvent{
+		GLN:            participant.GLN,
+		LegalName:      participant.LegalName,
+		Role:           participant.Role,
+		MSPID:          participant.MSPID,
+		Status:         participant.Status,
+		SubmitterMSPID: submitter.MSPID,
+	}
+}
+
+// Helper function to check that the caller may administer a participant: regulators may
+// administer any participant, other callers only participants of their own MSP and role
+func (s *SmartContract) checkParticipantAdmin(stub shim.ChaincodeStubInterface, participant *Participant) (*SubmitterIdentity, error) {
+	submitter, err := getSubmitterIdentity(stub)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve submitter identity: %s", err)
+	}
+
+	policy, err := s.getAccessPolicy(stub)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read access policy: %s", err)
+	}
+
+	role, err := s.getCallerRole(stub, policy)
+	if err != nil {
+		return nil, err
+	}
+	if role == RoleRegulator {
+		return submitter, nil
+	}
+
+	if participant.MSPID != submitter.MSPID {
+		return nil, fmt.Errorf("participant %s belongs to MSP %s", participant.GLN, participant.MSPID)
+	}
+	if participant.Role != role {
+		return nil, fmt.Errorf("callers with role %q may not administer %s participants", role, participant.Role)
+	}
+	return submitter, nil
+}
+
+// Helper function to resolve the participant a commissioning or tracking call acts as.
+// An empty GLN selects the submitting MSP's participant when it has exactly one. The
+// participant must be active, belong to the submitting MSP and, if role is set, have that role.
+func (s *SmartContract) resolveActingParticipant(stub shim.ChaincodeStubInterface, gln string, submitter *SubmitterIdentity, role string) (*Participant, error) {
+	if gln == "" {
+		glns, err := s.getParticipantGLNsForMSP(stub, submitter.MSPID)
+		if err != nil {
+			return nil, err
+		}
+		if len(glns) != 1 {
+			return nil, fmt.Errorf("MSP %s has %d registered participants; name the acting participant by GLN", submitter.MSPID, len(glns))
+		}
+		gln = glns[0]
+	}
+
+	participant, err := s.findParticipant(stub, gln)
+	if err != nil {
+		return nil, err
+	}
+	if participant == nil {
+		return nil, fmt.Errorf("unknown participant %s", gln)
+	}
+	if participant.Status != ParticipantStatusActive {
+		return nil, fmt.Errorf("participant %s is %s", gln, participant.Status)
+	}
+	if participant.MSPID != submitter.MSPID {
+		return nil, fmt.Errorf("participant %s belongs to MSP %s, not %s", gln, participant.MSPID, submitter.MSPID)
+	}
+	if role != "" && participant.Role != role {
+		return nil, fmt.Errorf("participant %s is a %s, not a %s", gln, participant.Role, role)
+	}
+
+	return participant, nil
+}
+
+// Helper function to find a participant by GLN, or nil
+func (s *SmartContract) findParticipant(stub shim.ChaincodeStubInterface, gln string) (*Participant, error) {
+	err := gs1.ValidateGLN(gln)
+	if err != nil {
+		return nil, err
+	}
+
+	participantKey, err := stub.CreateCompositeKey(participantKeyType, []string{gln})
+	if err != nil {
+		return nil, err
+	}
+
+	participantJSON, err := stub.GetState(participantKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read participant from world state: %s", err)
+	}
+	if participantJSON == nil {
+		return nil, nil
+	}
+
+	var participant Participant
+	err = json.Unmarshal(participantJSON, &participant)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal participant: %s", err)
+	}
+
+	return &participant, nil
+}
+
+// Helper function to read a participant that must exist
+func (s *SmartContract) readParticipant(stub shim.ChaincodeStubInterface, gln string) (*Participant, error) {
+	participant, err := s.findParticipant(stub, gln)
+	if err != nil {
+		return nil, err
+	}
+	if participant == nil {
+		return nil, fmt.Errorf("participant not found: %s", gln)
+	}
+	return participant, nil
+}
+
+// Helper function to list the GLNs registered for an MSP
+func (s *SmartContract) getParticipantGLNsForMSP(stub shim.ChaincodeStubInterface, mspID string) ([]string, error) {
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(participantMSPKeyType, []string{mspID})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	var glns []string
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		_, keyParts, err := stub.SplitCompositeKey(queryResponse.Key)
+		if err != nil || len(keyParts) != 2 {
+			continue // Skip malformed index entries
+		}
+
+		glns = append(glns, keyParts[1])
+	}
+
+	return glns, nil
+}
+
+// Helper function to store a participant and its MSP index entry, moving the entry if the MSP changed
+func (s *SmartContract) putParticipant(stub shim.ChaincodeStubInterface, participant *Participant) error {
+	participantKey, err := stub.CreateCompositeKey(participantKeyType, []string{participant.GLN})
+	if err != nil {
+		return err
+	}
+
+	previous, err := s.findParticipant(stub, participant.GLN)
+	if err != nil {
+		return err
+	}
+	if previous != nil && previous.MSPID != participant.MSPID {
+		oldMSPKey, err := stub.CreateCompositeKey(participantMSPKeyType, []string{previous.MSPID, participant.GLN})
+		if err != nil {
+			return err
+		}
+
+		err = stub.DelState(oldMSPKey)
+		if err != nil {
+			return err
+		}
+	}
+
+	participantJSON, err := json.Marshal(participant)
+	if err != nil {
+		return err
+	}
+
+	err = stub.PutState(participantKey, participantJSON)
+	if err != nil {
+		return err
+	}
+
+	mspKey, err := stub.CreateCompositeKey(participantMSPKeyType, []string{participant.MSPID, participant.GLN})
+	if err != nil {
+		return err
+	}
+
+	return stub.PutState(mspKey, []byte{0x00})
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/chaincode/lib/cid"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// Participant roles
+const (
+	RoleManufacturer = "manufacturer"
+	RoleDistributor  = "distributor"
+	RolePharmacy     = "pharmacy"
+	RoleRegulator    = "regulator"
+)
+
+const (
+	configKeyType        = "config"
+	accessPolicyName     = "accessPolicy"
+	defaultRoleAttribute = "role"
+)
+
+// functionAliases maps entry points that wrap another function to the function whose
+// roles they require, so stored policies cover them without being updated
+var functionAliases = map[string]string{
+	"commissionFromBarcode": "commissionMedication",
+	"commissionBatch":       "commissionMedication",
+
+	"getMedicationsByManufacturerPaged": "getMedicationsByManufacturer",
+	"searchMedicationsPaged":            "searchMedications",
+}
+
+// AccessPolicy decides which roles may invoke which chaincode functions.
+// It is set at Init time and stored on the ledger. Functions and events a stored policy
+// does not list keep the restrictions of the default policy, so restrictions added by a
+// chaincode upgrade also apply under policies stored before it.
+type AccessPolicy struct {
+	// RoleAttribute is the certificate attribute carrying the caller's role
+	RoleAttribute string `json:"roleAttribute"`
+	// MSPRoles maps MSP IDs to the role of their members. A role attribute is only trusted
+	// if it names this role or one of MSPAttributeRoles, as any MSP's CA can issue any attribute.
+	MSPRoles map[string]string `json:"mspRoles"`
+	// MSPAttributeRoles lists further roles an MSP may grant its members through the role attribute
+	MSPAttributeRoles map[string][]string `json:"mspAttributeRoles,omitempty"`
+	// FunctionRoles restricts functions to the listed roles; functions listed neither here nor
+	// in the default policy are open
+	FunctionRoles map[string][]string `json:"functionRoles"`
+	// EventRoles restricts addTrackingEvent and addContainerEvent event types to the listed roles
+	EventRoles map[string][]string `json:"eventRoles"`
+	// RequireSignatures rejects unsigned addTrackingEvent and addContainerEvent calls
+	RequireSignatures bool `json:"requireSignatures,omitempty"`
+}
+
+// defaultAccessPolicy returns the policy used when Init is called without one
+func defaultAccessPolicy() AccessPolicy {
+	return AccessPolicy{
+		RoleAttribute: defaultRoleAttribute,
+		MSPRoles:      map[string]string{},
+		FunctionRoles: map[string][]string{
+			"commissionMedication":  {RoleManufacturer},
+			"issueMedicationRecall": {RoleManufacturer, RoleRegulator},
+			"issueRecall":           {RoleManufacturer, RoleRegulator},
+			"updateRecall":          {RoleManufacturer, RoleRegulator},
+			"liftRecall":            {RoleRegulator},
+			"setParticipantStatus":  {RoleRegulator},
+			"registerProduct":       {RoleManufacturer},
+			"updateProduct":         {RoleManufacturer},
+			"registerCompanyPrefix": {RoleRegulator},
+			"transferCompanyPrefix": {RoleManufacturer, RoleRegulator},
+			"revokeCompanyPrefix":   {RoleRegulator},
+			"resolveAlert":          {RoleManufacturer, RoleRegulator},
+			"migrateTrackingEvents": {RoleRegulator},
+			"migrateMedicationIDs":  {RoleRegulator},
+		},
+		EventRoles: map[string][]string{
+			EventDispense: {RolePharmacy},
+		},
+	}
+}
+
+// mergeDefaults adds the default restrictions of every function and event the policy does not list
+func (policy *AccessPolicy) mergeDefaults() {
+	defaults := defaultAccessPolicy()
+
+	if policy.FunctionRoles == nil {
+		policy.FunctionRoles = map[string][]string{}
+	}
+	for function, roles := range defaults.FunctionRoles {
+		if _, ok := policy.FunctionRoles[function]; !ok {
+			policy.FunctionRoles[function] = roles
+		}
+	}
+
+	if policy.EventRoles == nil {
+		policy.EventRoles = map[string][]string{}
+	}
+	for event, roles := range defaults.EventRoles {
+		if _, ok := policy.EventRoles[event]; !ok {
+			policy.EventRoles[event] = roles
+		}
+	}
+}
+
+// validate checks that the policy only references known roles
+func (policy *AccessPolicy) validate() error {
+	if policy.RoleAttribute == "" {
+		policy.RoleAttribute = defaultRoleAttribute
+	}
+
+	for mspID, role := range policy.MSPRoles {
+		if !isKnownRole(role) {
+			return fmt.Errorf("unknown role %q for MSP %s", role, mspID)
+		}
+	}
+	for mspID, roles := range policy.MSPAttributeRoles {
+		for _, role := range roles {
+			if !isKnownRole(role) {
+				return fmt.Errorf("unknown attribute role %q for MSP %s", role, mspID)
+			}
+		}
+	}
+	for function, roles := range policy.FunctionRoles {
+		for _, role := range roles {
+			if !isKnownRole(role) {
+				return fmt.Errorf("unknown role %q for function %s", role, function)
+			}
+		}
+	}
+	for event, roles := range policy.EventRoles {
+		if _, ok := lifecycle[event]; !ok {
+			return fmt.Errorf("unknown tracking event %q", event)
+		}
+		for _, role := range roles {
+			if !isKnownRole(role) {
+				return fmt.Errorf("unknown role %q for event %s", role, event)
+			}
+		}
+	}
+
+	return nil
+}
+
+func isKnownRole(role string) bool {
+	switch role {
+	case RoleManufacturer, RoleDistributor, RolePharmacy, RoleRegulator:
+		return true
+	}
+	return false
+}
+
+func containsRole(roles []string, role string) bool {
+	for _, allowed := range roles {
+		if allowed == role {
+			return true
+		}
+	}
+	return false
+}
+
+// Helper function to read the access policy, falling back to the default when none is stored
+// and to the default restrictions for anything the stored policy does not list
+func (s *SmartContract) getAccessPolicy(stub shim.ChaincodeStubInterface) (*AccessPolicy, error) {
+	policyKey, err := stub.CreateCompositeKey(configKeyType, []string{accessPolicyName})
+	if err != nil {
+		return nil, err
+	}
+
+	policyJSON, err := stub.GetState(policyKey)
+	if err != nil {
+		return nil, err
+	}
+
+	policy := defaultAccessPolicy()
+	if policyJSON == nil {
+		return &policy, nil
+	}
+
+	policy = AccessPolicy{}
+	err = json.Unmarshal(policyJSON, &policy)
+	if err != nil {
+		return nil, err
+	}
+	policy.mergeDefaults()
+
+	return &policy, nil
+}
+
+// Helper function to store the access policy
+func (s *SmartContract) putAccessPolicy(stub shim.ChaincodeStubInterface, policy *AccessPolicy) error {
+	policyKey, err := stub.CreateCompositeKey(configKeyType, []string{accessPolicyName})
+	if err != nil {
+		return err
+	}
+
+	policyJSON, err := json.Marshal(policy)
+	if err != nil {
+		return err
+	}
+
+	return stub.PutState(policyKey, policyJSON)
+}
+
+// Helper function to resolve the caller's role. The certificate's role attribute counts only
+// if the policy lets the caller's MSP grant that role; otherwise the caller has its MSP's role.
+func (s *SmartContract) getCallerRole(stub shim.ChaincodeStubInterface, policy *AccessPolicy) (string, error) {
+	mspID, err := cid.GetMSPID(stub)
+	if err != nil {
+		return "", fmt.Errorf("failed to read client MSP ID: %s", err)
+	}
+	mspRole := policy.MSPRoles[mspID]
+
+	role, found, err := cid.GetAttributeValue(stub, policy.RoleAttribute)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s attribute: %s", policy.RoleAttribute, err)
+	}
+	if found && (role == mspRole || containsRole(policy.MSPAttributeRoles[mspID], role)) {
+		return role, nil
+	}
+
+	return mspRole, nil
+}
+
+// Helper function to check whether the caller holds a role under the stored access policy
+func (s *SmartContract) callerHasRole(stub shim.ChaincodeStubInterface, role string) (bool, error) {
+	policy, err := s.getAccessPolicy(stub)
+	if err != nil {
+		return false, fmt.Errorf("failed to read access policy: %s", err)
+	}
+
+	callerRole, err := s.getCallerRole(stub, policy)
+	if err != nil {
+		return false, err
+	}
+
+	return callerRole == role, nil
+}
+
+// authorize enforces the access policy for a function invocation before it is dispatched
+func (s *SmartContract) authorize(stub shim.ChaincodeStubInterface, function string, args []string) error {
+	policy, err := s.getAccessPolicy(stub)
+	if err != nil {
+		return fmt.Errorf("failed to read access policy: %s", err)
+	}
+
+	if alias, ok := functionAliases[function]; ok {
+		function = alias
+	}
+
+	allowedRoles, restricted := policy.FunctionRoles[function]
+	if (function == "addTrackingEvent" || function == "addContainerEvent") && len(args) > 1 {
+		if eventRoles, ok := policy.EventRoles[args[1]]; ok {
+			allowedRoles, restricted = eventRoles, true
+			function = args[1]
+		}
+	}
+	if !restricted {
+		return nil
+	}
+
+	role, err := s.getCallerRole(stub, policy)
+	if err != nil {
+		return err
+	}
+	if role == "" {
+		return fmt.Errorf("caller has no role and %s requires one of %v", function, allowedRoles)
+	}
+	if !containsRole(allowedRoles, role) {
+		return fmt.Errorf("role %q may not %s; requires one of %v", role, function, allowedRoles)
+	}
+
+	return nil
+}
+
+// getAccessPolicyConfig returns the access policy in force
+// Args: []
+func (s *SmartContract) getAccessPolicyConfig(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 0 {
+		return shim.Error("Incorrect number of arguments. Expecting 0")
+	}
+
+	policy, err := s.getAccessPolicy(stub)
+	if err != nil {
+		return shim.Error("Failed to read access policy: " + err.Error())
+	}
+
+	policyJSON, err := json.Marshal(policy)
+	if err != nil {
+		return shim.Error("Failed to marshal access policy: " + err.Error())
+	}
+
+	return shim.Success(policyJSON)
+}
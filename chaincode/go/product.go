@@ -0,0 +1,308 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+
+	"drug-traceability/gs1"
+)
+
+// Composite key object type of the product registry
+const productKeyType = "product~gtin"
+
+// Product is the master data of a trade item, keyed by its GTIN. Units can only be
+// commissioned under a registered GTIN, by the manufacturer participant that owns it,
+// and take their product name from it.
+type Product struct {
+	GTIN                   string              `json:"gtin"`
+	Name                   string              `json:"name"`
+	Strength               string              `json:"strength"`   // e.g. 500 mg
+	DosageForm             string              `json:"dosageForm"` // e.g. tablet
+	PackSize               int                 `json:"packSize"`   // dosage units per pack
+	MarketingAuthorization string              `json:"marketingAuthorization"`
+	ManufacturerGLN        string              `json:"manufacturerGln"`
+	Storage                StorageRequirements `json:"storage"`
+	Version                int                 `json:"version"` // incremented by every update
+	RegisteredBy           *SubmitterIdentity  `json:"registeredBy"`
+	RegisteredAt           int64               `json:"registeredAt"`
+	UpdatedBy              *SubmitterIdentity  `json:"updatedBy,omitempty"`
+	UpdatedAt              int64               `json:"updatedAt,omitempty"`
+}
+
+// StorageRequirements are the storage conditions of a product. Temperatures are in degrees Celsius.
+type StorageRequirements struct {
+	MinTemperature *float64 `json:"minTemperatureC,omitempty"`
+	MaxTemperature *float64 `json:"maxTemperatureC,omitempty"`
+	Conditions     string   `json:"conditions,omitempty"` // e.g. protect from light
+}
+
+// validate checks the product fields supplied by the caller and normalizes the GTIN to GTIN-14
+func (product *Product) validate() error {
+	gtin, err := gs1.NormalizeGTIN(product.GTIN)
+	if err != nil {
+		return err
+	}
+	product.GTIN = gtin
+
+	if product.Name == "" || product.DosageForm == "" || product.MarketingAuthorization == "" {
+		return fmt.Errorf("missing required fields: name, dosageForm, marketingAuthorization")
+	}
+	if product.PackSize <= 0 {
+		return fmt.Errorf("packSize must be positive")
+	}
+
+	storage := product.Storage
+	if storage.MinTemperature != nil && storage.MaxTemperature != nil && *storage.MinTemperature > *storage.MaxTemperature {
+		return fmt.Errorf("storage minTemperatureC is above maxTemperatureC")
+	}
+	return nil
+}
+
+// registerProduct adds the master data of a GTIN to the product registry. The owning
+// manufacturer is a manufacturer participant of the submitting MSP, named by GLN, and the
+// GTIN must fall under a company prefix the MSP owns.
+// Args: [productJSON] with gtin, name, strength, dosageForm, packSize, marketingAuthorization, manufacturerGln and storage
+func (s *SmartContract) registerProduct(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1: product")
+	}
+
+	var product Product
+	err := json.Unmarshal([]byte(args[0]), &product)
+	if err != nil {
+		return shim.Error("Failed to unmarshal product: " + err.Error())
+	}
+
+	err = product.validate()
+	if err != nil {
+		return shim.Error("Invalid product: " + err.Error())
+	}
+
+	existing, err := s.findProduct(stub, product.GTIN)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if existing != nil {
+		return shim.Error("Product already registered with GTIN: " + product.GTIN)
+	}
+
+	submitter, err := getSubmitterIdentity(stub)
+	if err != nil {
+		return shim.Error("Failed to resolve submitter identity: " + err.Error())
+	}
+
+	owner, err := s.resolveActingParticipant(stub, product.ManufacturerGLN, submitter, RoleManufacturer)
+	if err != nil {
+		return shim.Error("Invalid manufacturer: " + err.Error())
+	}
+
+	_, err = s.checkCompanyPrefixOwner(stub, product.GTIN, submitter.MSPID)
+	if err != nil {
+		return shim.Error("Access denied: " + err.Error())
+	}
+
+	txTime, err := getTxTime(stub)
+	if err != nil {
+		return shim.Error("Failed to read transaction timestamp: " + err.Error())
+	}
+
+	product.ManufacturerGLN = owner.GLN
+	product.Version = 1
+	product.RegisteredBy = submitter
+	product.RegisteredAt = txTime
+	product.UpdatedBy = nil
+	product.UpdatedAt = 0
+
+	err = s.putProduct(stub, &product)
+	if err != nil {
+		return shim.Error("Failed to put product to world state: " + err.Error())
+	}
+
+	err = s.emitEvent(stub, EventNameProductRegistered, product.event(submitter))
+	if err != nil {
+		return shim.Error("Failed to emit chaincode event: " + err.Error())
+	}
+
+	fmt.Printf("Product registered: %s (%s)\n", product.GTIN, product.Name)
+	return productResponse(&product)
+}
+
+// updateProduct replaces the master data of a registered GTIN. Only the owning manufacturer
+// may update it and ownership does not change. Units already commissioned keep the version
+// they were commissioned under.
+// Args: [productJSON]
+func (s *SmartContract) updateProduct(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1: product")
+	}
+
+	var update Product
+	err := json.Unmarshal([]byte(args[0]), &update)
+	if err != nil {
+		return shim.Error("Failed to unmarshal product: " + err.Error())
+	}
+
+	err = update.validate()
+	if err != nil {
+		return shim.Error("Invalid product: " + err.Error())
+	}
+
+	product, err := s.readProduct(stub, update.GTIN)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if update.ManufacturerGLN != "" && update.ManufacturerGLN != product.ManufacturerGLN {
+		return shim.Error("Product " + product.GTIN + " is owned by " + product.ManufacturerGLN + "; ownership cannot be changed by an update")
+	}
+
+	submitter, err := getSubmitterIdentity(stub)
+	if err != nil {
+		return shim.Error("Failed to resolve submitter identity: " + err.Error())
+	}
+
+	_, err = s.resolveActingParticipant(stub, product.ManufacturerGLN, submitter, RoleManufacturer)
+	if err != nil {
+		return shim.Error("Access denied: " + err.Error())
+	}
+
+	txTime, err := getTxTime(stub)
+	if err != nil {
+		return shim.Error("Failed to read transaction timestamp: " + err.Error())
+	}
+
+	product.Name = update.Name
+	product.Strength = update.Strength
+	product.DosageForm = update.DosageForm
+	product.PackSize = update.PackSize
+	product.MarketingAuthorization = update.MarketingAuthorization
+	product.Storage = update.Storage
+	product.Version++
+	product.UpdatedBy = submitter
+	product.UpdatedAt = txTime
+
+	err = s.putProduct(stub, product)
+	if err != nil {
+		return shim.Error("Failed to put product to world state: " + err.Error())
+	}
+
+	err = s.emitEvent(stub, EventNameProductUpdated, product.event(submitter))
+	if err != nil {
+		return shim.Error("Failed to emit chaincode event: " + err.Error())
+	}
+
+	fmt.Printf("Product updated: %s (version %d)\n", product.GTIN, product.Version)
+	return productResponse(product)
+}
+
+// getProduct returns the master data of a GTIN
+// Args: [gtin]
+func (s *SmartContract) getProduct(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1: gtin")
+	}
+
+	product, err := s.readProduct(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return productResponse(product)
+}
+
+func productResponse(product *Product) pb.Response {
+	productJSON, err := json.Marshal(product)
+	if err != nil {
+		return shim.Error("Failed to marshal product: " + err.Error())
+	}
+	return shim.Success(productJSON)
+}
+
+// event returns the chaincode event payload describing the product
+func (product *Product) event(submitter *SubmitterIdentity) ProductEvent {
+	return ProductEvent{
+		GTIN:            product.GTIN,
+		Name:            product.Name,
+		ManufacturerGLN: product.ManufacturerGLN,
+		Version:         product.Version,
+		SubmitterMSPID:  submitter.MSPID,
+	}
+}
+
+// Helper function to resolve the product a unit is commissioned under. The GTIN must be
+// registered and owned by the commissioning manufacturer; a product name given by the
+// caller must match the registered name.
+func (s *SmartContract) resolveCommissionedProduct(stub shim.ChaincodeStubInterface, gtin string, manufacturer *Participant, productName string) (*Product, error) {
+	product, err := s.findProduct(stub, gtin)
+	if err != nil {
+		return nil, err
+	}
+	if product == nil {
+		return nil, fmt.Errorf("GTIN %s is not registered; register it with registerProduct first", gtin)
+	}
+	if product.ManufacturerGLN != manufacturer.GLN {
+		return nil, fmt.Errorf("GTIN %s is owned by %s, not %s", gtin, product.ManufacturerGLN, manufacturer.GLN)
+	}
+	if productName != "" && productName != product.Name {
+		return nil, fmt.Errorf("product name %q does not match the registered name %q of GTIN %s", productName, product.Name, gtin)
+	}
+	return product, nil
+}
+
+// Helper function to find a product by GTIN, or nil
+func (s *SmartContract) findProduct(stub shim.ChaincodeStubInterface, gtin string) (*Product, error) {
+	gtin, err := gs1.NormalizeGTIN(gtin)
+	if err != nil {
+		return nil, err
+	}
+
+	productKey, err := stub.CreateCompositeKey(productKeyType, []string{gtin})
+	if err != nil {
+		return nil, err
+	}
+
+	productJSON, err := stub.GetState(productKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read product from world state: %s", err)
+	}
+	if productJSON == nil {
+		return nil, nil
+	}
+
+	var product Product
+	err = json.Unmarshal(productJSON, &product)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal product: %s", err)
+	}
+
+	return &product, nil
+}
+
+// Helper function to read a product that must exist
+func (s *SmartContract) readProduct(stub shim.ChaincodeStubInterface, gtin string) (*Product, error) {
+	product, err := s.findProduct(stub, gtin)
+	if err != nil {
+		return nil, err
+	}
+	if product == nil {
+		return nil, fmt.Errorf("product not found: %s", gtin)
+	}
+	return product, nil
+}
+
+// Helper function to store a product
+func (s *SmartContract) putProduct(stub shim.ChaincodeStubInterface, product *Product) error {
+	productKey, err := stub.CreateCompositeKey(productKeyType, []string{product.GTIN})
+	if err != nil {
+		return err
+	}
+
+	productJSON, err := json.Marshal(product)
+	if err != nil {
+		return err
+	}
+
+	return stub.PutState(productKey, productJSON)
+}
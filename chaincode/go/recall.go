@@ -0,0 +1,875 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+
+	"drug-traceability/gs1"
+)
+
+// Composite key object types for recalls
+const (
+	recallKeyType     = "recall~recallId"
+	recallUnitKeyType = "recallUnit~recallId~medicationId"
+	gtinRecallKeyType = "gtinRecall~gtin~recallId"
+	recallAckKeyType  = "recallAck~recallId~mspId"
+)
+
+// Recall statuses
+const (
+	RecallStatusOpen    = "open"
+	RecallStatusUpdated = "updated"
+	RecallStatusClosed  = "closed"
+)
+
+// expiryDateLayout is the ISO date format used for expiry dates
+const expiryDateLayout = gs1.ISODateLayout
+
+// RecallSelector selects the units affected by a recall. A unit recall names a single
+// medication; otherwise GTIN is required and batch and the expiry range narrow it down.
+type RecallSelector struct {
+	MedicationID string `json:"medicationId,omitempty"`
+	GTIN         string `json:"gtin,omitempty"`
+	Batch        string `json:"batch,omitempty"`
+	ExpiryFrom   string `json:"expiryFrom,omitempty"`
+	ExpiryTo     string `json:"expiryTo,omitempty"`
+}
+
+// Recall is a recall record; affected units point back to it through RecallID
+type Recall struct {
+	ID            string             `json:"id"`
+	Class         string             `json:"class,omitempty"` // I, II or III; empty for legacy unit recalls
+	Reason        string             `json:"reason"`
+	Selector      RecallSelector     `json:"selector"`
+	Status        string             `json:"status"`
+	Issuer        string             `json:"issuer"`
+	IssuedBy      *SubmitterIdentity `json:"issuedBy"`
+	IssuedAt      int64              `json:"issuedAt"`
+	TxID          string             `json:"txId"`
+	AffectedUnits int                `json:"affectedUnits"`
+	UpdatedAt     int64              `json:"updatedAt,omitempty"`
+	UpdatedBy     *SubmitterIdentity `json:"updatedBy,omitempty"`
+	ClosedAt      int64              `json:"closedAt,omitempty"`
+	ClosedBy      *SubmitterIdentity `json:"closedBy,omitempty"`
+	CloseReason   string             `json:"closeReason,omitempty"`
+	RestoredUnits int                `json:"restoredUnits,omitempty"`
+}
+
+// RecallAcknowledgement is a holder's response to a recall. Each organization keeps one
+// acknowledgement per recall; reporting again replaces the quantities.
+type RecallAcknowledgement struct {
+	RecallID            string             `json:"recallId"`
+	Holder              string             `json:"holder"`
+	HolderIdentity      *SubmitterIdentity `json:"holderIdentity"`
+	Location            string             `json:"location"`
+	QuantityQuarantined int                `json:"quantityQuarantined"`
+	QuantityReturned    int                `json:"quantityReturned"`
+	Notes               string             `json:"notes,omitempty"`
+	AcknowledgedAt      int64              `json:"acknowledgedAt"`
+	TxID                string             `json:"txId"`
+}
+
+// isActive reports whether a recall still applies to its units
+func (recall *Recall) isActive() bool {
+	return recall.Status == RecallStatusOpen || recall.Status == RecallStatusUpdated
+}
+
+// RecallUnitResult reports the outcome of a recall for a single unit
+type RecallUnitResult struct {
+	MedicationID string `json:"medicationId"`
+	Recalled     bool   `json:"recalled"`
+	Error        string `json:"error,omitempty"`
+}
+
+// validate checks the selector fields and expiry range and normalizes the GTIN to GTIN-14
+func (selector *RecallSelector) validate() error {
+	if selector.MedicationID != "" {
+		return nil
+	}
+	if selector.GTIN == "" {
+		return fmt.Errorf("selector requires a gtin or a medicationId")
+	}
+	gtin, err := gs1.NormalizeGTIN(selector.GTIN)
+	if err != nil {
+		return err
+	}
+	selector.GTIN = gtin
+	if selector.ExpiryFrom != "" {
+		if _, err := time.Parse(expiryDateLayout, selector.ExpiryFrom); err != nil {
+			return fmt.Errorf("invalid expiryFrom %q, expecting YYYY-MM-DD", selector.ExpiryFrom)
+		}
+	}
+	if selector.ExpiryTo != "" {
+		if _, err := time.Parse(expiryDateLayout, selector.ExpiryTo); err != nil {
+			return fmt.Errorf("invalid expiryTo %q, expecting YYYY-MM-DD", selector.ExpiryTo)
+		}
+	}
+	if selector.ExpiryFrom != "" && selector.ExpiryTo != "" && selector.ExpiryFrom > selector.ExpiryTo {
+		return fmt.Errorf("expiryFrom %s is after expiryTo %s", selector.ExpiryFrom, selector.ExpiryTo)
+	}
+	return nil
+}
+
+// matches reports whether a medication falls under the selector
+func (selector *RecallSelector) matches(medication *MedicationData) bool {
+	if selector.MedicationID != "" {
+		return selector.MedicationID == medication.ID
+	}
+	if selector.GTIN != medication.GTIN {
+		return false
+	}
+	if selector.Batch != "" && selector.Batch != medication.Batch {
+		return false
+	}
+	if selector.ExpiryFrom == "" && selector.ExpiryTo == "" {
+		return true
+	}
+
+	// Dates are validated as YYYY-MM-DD, so they compare correctly as strings
+	expiry, err := time.Parse(expiryDateLayout, medication.ExpiryDate)
+	if err != nil {
+		return false
+	}
+	expiryDate := expiry.Format(expiryDateLayout)
+	if selector.ExpiryFrom != "" && expiryDate < selector.ExpiryFrom {
+		return false
+	}
+	if selector.ExpiryTo != "" && expiryDate > selector.ExpiryTo {
+		return false
+	}
+	return true
+}
+
+func normalizeRecallClass(class string) (string, error) {
+	class = strings.ToUpper(strings.TrimSpace(class))
+	switch class {
+	case "I", "II", "III":
+		return class, nil
+	}
+	return "", fmt.Errorf("invalid recall class %q, expecting I, II or III", class)
+}
+
+// issueRecall recalls every unit matching a selector and stores a Recall record.
+// Units commissioned later that match the selector are recalled automatically.
+// Manufacturers may only recall GTINs under a company prefix of their MSP.
+// Args: [class, reason, issuer, selectorJSON]
+func (s *SmartContract) issueRecall(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 4 {
+		return shim.Error("Incorrect number of arguments. Expecting 4: class, reason, issuer, selector")
+	}
+
+	class, err := normalizeRecallClass(args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	reason := args[1]
+	if reason == "" {
+		return shim.Error("Missing recall reason")
+	}
+
+	var selector RecallSelector
+	err = json.Unmarshal([]byte(args[3]), &selector)
+	if err != nil {
+		return shim.Error("Failed to unmarshal recall selector: " + err.Error())
+	}
+	if selector.MedicationID != "" {
+		return shim.Error("Use issueMedicationRecall to recall a single unit")
+	}
+	err = selector.validate()
+	if err != nil {
+		return shim.Error("Invalid recall selector: " + err.Error())
+	}
+
+	submitter, err := getSubmitterIdentity(stub)
+	if err != nil {
+		return shim.Error("Failed to resolve submitter identity: " + err.Error())
+	}
+
+	isRegulator, err := s.callerHasRole(stub, RoleRegulator)
+	if err != nil {
+		return shim.Error("Access denied: " + err.Error())
+	}
+
+	// The recall also applies to units commissioned later, so manufacturers may only recall
+	// GTINs under their own company prefixes, whether or not any unit exists yet
+	if !isRegulator {
+		_, err = s.checkCompanyPrefixOwner(stub, selector.GTIN, submitter.MSPID)
+		if err != nil {
+			return shim.Error("Access denied: " + err.Error())
+		}
+	}
+
+	txTime, err := getTxTime(stub)
+	if err != nil {
+		return shim.Error("Failed to read transaction timestamp: " + err.Error())
+	}
+
+	recall := Recall{
+		ID:       "rcl_" + stub.GetTxID(),
+		Class:    class,
+		Reason:   reason,
+		Selector: selector,
+		Status:   RecallStatusOpen,
+		Issuer:   submitter.displayLabel(args[2]),
+		IssuedBy: submitter,
+		IssuedAt: txTime,
+		TxID:     stub.GetTxID(),
+	}
+
+	medications, err := s.getMedicationsBySelector(stub, &selector)
+	if err != nil {
+		return shim.Error("Failed to find medications for recall: " + err.Error())
+	}
+
+	// Units commissioned before the prefix changed hands must also be the manufacturer's own
+	if !isRegulator {
+		for _, medication := range medications {
+			if medication.ManufacturerMSP == "" || medication.ManufacturerMSP != submitter.MSPID {
+				return shim.Error("Access denied: only the owning manufacturer or a regulator may recall medication " + medication.ID)
+			}
+		}
+	}
+
+	results := make([]RecallUnitResult, 0, len(medications))
+	for i := range medications {
+		medication := &medications[i]
+
+		_, err = s.recallUnit(stub, medication, &recall, submitter, txTime)
+		if err != nil {
+			results = append(results, RecallUnitResult{MedicationID: medication.ID, Error: err.Error()})
+			continue
+		}
+
+		err = s.putMedication(stub, medication)
+		if err != nil {
+			return shim.Error("Failed to update medication in world state: " + err.Error())
+		}
+
+		recall.AffectedUnits++
+		results = append(results, RecallUnitResult{MedicationID: medication.ID, Recalled: true})
+	}
+
+	err = s.putRecall(stub, &recall)
+	if err != nil {
+		return shim.Error("Failed to put recall to world state: " + err.Error())
+	}
+
+	// Index by GTIN so units commissioned later are flagged
+	gtinRecallKey, err := stub.CreateCompositeKey(gtinRecallKeyType, []string{selector.GTIN, recall.ID})
+	if err != nil {
+		return shim.Error("Failed to create recall index key: " + err.Error())
+	}
+
+	err = stub.PutState(gtinRecallKey, []byte{0x00})
+	if err != nil {
+		return shim.Error("Failed to put recall index to world state: " + err.Error())
+	}
+
+	err = s.emitEvent(stub, EventNameRecallIssued, RecallIssuedEvent{
+		RecallID:       recall.ID,
+		Class:          recall.Class,
+		Reason:         recall.Reason,
+		Selector:       recall.Selector,
+		Issuer:         recall.Issuer,
+		SubmitterMSPID: submitter.MSPID,
+		AffectedUnits:  recall.AffectedUnits,
+	})
+	if err != nil {
+		return shim.Error("Failed to emit chaincode event: " + err.Error())
+	}
+
+	var response = struct {
+		Recall  Recall             `json:"recall"`
+		Results []RecallUnitResult `json:"results"`
+	}{
+		Recall:  recall,
+		Results: results,
+	}
+
+	responseJSON, err := json.Marshal(response)
+	if err != nil {
+		return shim.Error("Failed to marshal recall: " + err.Error())
+	}
+
+	fmt.Printf("Recall %s issued for %d units\n", recall.ID, recall.AffectedUnits)
+	return shim.Success(responseJSON)
+}
+
+// getRecall returns a recall record
+// Args: [recallId]
+func (s *SmartContract) getRecall(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1: recallId")
+	}
+
+	if args[0] == "" {
+		return shim.Error("Missing recall ID")
+	}
+
+	recall, err := s.readRecall(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	recallJSON, err := json.Marshal(recall)
+	if err != nil {
+		return shim.Error("Failed to marshal recall: " + err.Error())
+	}
+
+	return shim.Success(recallJSON)
+}
+
+// updateRecall amends the class or reason of an active recall. Empty arguments keep the current value.
+// Only the issuing organization or a regulator may update a recall.
+// Args: [recallId, class, reason]
+func (s *SmartContract) updateRecall(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 3: recallId, class, reason")
+	}
+
+	if args[0] == "" {
+		return shim.Error("Missing recall ID")
+	}
+	if args[1] == "" && args[2] == "" {
+		return shim.Error("Nothing to update: class and reason are both empty")
+	}
+
+	recall, err := s.readRecall(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !recall.isActive() {
+		return shim.Error("Recall " + recall.ID + " is " + recall.Status + " and cannot be updated")
+	}
+
+	submitter, err := getSubmitterIdentity(stub)
+	if err != nil {
+		return shim.Error("Failed to resolve submitter identity: " + err.Error())
+	}
+
+	isRegulator, err := s.callerHasRole(stub, RoleRegulator)
+	if err != nil {
+		return shim.Error("Access denied: " + err.Error())
+	}
+	if !isRegulator && recall.IssuedBy.MSPID != submitter.MSPID {
+		return shim.Error("Access denied: only the issuing organization or a regulator may update recall " + recall.ID)
+	}
+
+	if args[1] != "" {
+		recall.Class, err = normalizeRecallClass(args[1])
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	if args[2] != "" {
+		recall.Reason = args[2]
+	}
+
+	txTime, err := getTxTime(stub)
+	if err != nil {
+		return shim.Error("Failed to read transaction timestamp: " + err.Error())
+	}
+
+	recall.Status = RecallStatusUpdated
+	recall.UpdatedAt = txTime
+	recall.UpdatedBy = submitter
+
+	err = s.putRecall(stub, recall)
+	if err != nil {
+		return shim.Error("Failed to put recall to world state: " + err.Error())
+	}
+
+	err = s.emitEvent(stub, EventNameRecallUpdated, RecallUpdatedEvent{
+		RecallID:       recall.ID,
+		Class:          recall.Class,
+		Reason:         recall.Reason,
+		SubmitterMSPID: submitter.MSPID,
+	})
+	if err != nil {
+		return shim.Error("Failed to emit chaincode event: " + err.Error())
+	}
+
+	recallJSON, err := json.Marshal(recall)
+	if err != nil {
+		return shim.Error("Failed to marshal recall: " + err.Error())
+	}
+
+	fmt.Printf("Recall %s updated\n", recall.ID)
+	return shim.Success(recallJSON)
+}
+
+// acknowledgeRecall records that the caller's organization has acted on a recall,
+// with the quantities it has quarantined and returned so far
+// Args: [recallId, holder, location, quantityQuarantined, quantityReturned, notes]
+func (s *SmartContract) acknowledgeRecall(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 6 {
+		return shim.Error("Incorrect number of arguments. Expecting 6: recallId, holder, location, quantityQuarantined, quantityReturned, notes")
+	}
+
+	if args[0] == "" {
+		return shim.Error("Missing recall ID")
+	}
+
+	quarantined, err := strconv.Atoi(args[3])
+	if err != nil || quarantined < 0 {
+		return shim.Error("quantityQuarantined must be a non-negative integer")
+	}
+
+	returned, err := strconv.Atoi(args[4])
+	if err != nil || returned < 0 {
+		return shim.Error("quantityReturned must be a non-negative integer")
+	}
+
+	recall, err := s.readRecall(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !recall.isActive() {
+		return shim.Error("Recall " + recall.ID + " is " + recall.Status + " and cannot be acknowledged")
+	}
+
+	submitter, err := getSubmitterIdentity(stub)
+	if err != nil {
+		return shim.Error("Failed to resolve submitter identity: " + err.Error())
+	}
+
+	txTime, err := getTxTime(stub)
+	if err != nil {
+		return shim.Error("Failed to read transaction timestamp: " + err.Error())
+	}
+
+	acknowledgement := RecallAcknowledgement{
+		RecallID:            recall.ID,
+		Holder:              submitter.displayLabel(args[1]),
+		HolderIdentity:      submitter,
+		Location:            args[2],
+		QuantityQuarantined: quarantined,
+		QuantityReturned:    returned,
+		Notes:               args[5],
+		AcknowledgedAt:      txTime,
+		TxID:                stub.GetTxID(),
+	}
+
+	ackKey, err := stub.CreateCompositeKey(recallAckKeyType, []string{recall.ID, submitter.MSPID})
+	if err != nil {
+		return shim.Error("Failed to create acknowledgement key: " + err.Error())
+	}
+
+	ackJSON, err := json.Marshal(acknowledgement)
+	if err != nil {
+		return shim.Error("Failed to marshal acknowledgement: " + err.Error())
+	}
+
+	err = stub.PutState(ackKey, ackJSON)
+	if err != nil {
+		return shim.Error("Failed to put acknowledgement to world state: " + err.Error())
+	}
+
+	err = s.emitEvent(stub, EventNameRecallAcknowledged, RecallAcknowledgedEvent{
+		RecallID:            recall.ID,
+		Holder:              acknowledgement.Holder,
+		SubmitterMSPID:      submitter.MSPID,
+		Location:            acknowledgement.Location,
+		QuantityQuarantined: quarantined,
+		QuantityReturned:    returned,
+	})
+	if err != nil {
+		return shim.Error("Failed to emit chaincode event: " + err.Error())
+	}
+
+	fmt.Printf("Recall %s acknowledged by %s\n", recall.ID, submitter.MSPID)
+	return shim.Success(ackJSON)
+}
+
+// getRecallAcknowledgements returns every holder acknowledgement of a recall
+// Args: [recallId]
+func (s *SmartContract) getRecallAcknowledgements(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1: recallId")
+	}
+
+	if args[0] == "" {
+		return shim.Error("Missing recall ID")
+	}
+
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(recallAckKeyType, []string{args[0]})
+	if err != nil {
+		return shim.Error("Failed to get recall acknowledgements: " + err.Error())
+	}
+	defer resultsIterator.Close()
+
+	acknowledgements := []RecallAcknowledgement{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error("Failed to get next result: " + err.Error())
+		}
+
+		var acknowledgement RecallAcknowledgement
+		err = json.Unmarshal(queryResponse.Value, &acknowledgement)
+		if err != nil {
+			continue // Skip invalid records
+		}
+
+		acknowledgements = append(acknowledgements, acknowledgement)
+	}
+
+	acknowledgementsJSON, err := json.Marshal(acknowledgements)
+	if err != nil {
+		return shim.Error("Failed to marshal acknowledgements: " + err.Error())
+	}
+
+	return shim.Success(acknowledgementsJSON)
+}
+
+// liftRecall closes a recall and restores every unit still recalled under it to its
+// status before the recall, adding a lift_recall tracking event that points to the recall.
+// Only regulators may lift a recall.
+// Args: [recallId, reason]
+func (s *SmartContract) liftRecall(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2: recallId, reason")
+	}
+
+	if args[0] == "" {
+		return shim.Error("Missing recall ID")
+	}
+	if args[1] == "" {
+		return shim.Error("Missing reason for lifting the recall")
+	}
+
+	isRegulator, err := s.callerHasRole(stub, RoleRegulator)
+	if err != nil {
+		return shim.Error("Access denied: " + err.Error())
+	}
+	if !isRegulator {
+		return shim.Error("Access denied: only regulators may lift a recall")
+	}
+
+	recall, err := s.readRecall(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !recall.isActive() {
+		return shim.Error("Recall " + recall.ID + " is already " + recall.Status)
+	}
+
+	submitter, err := getSubmitterIdentity(stub)
+	if err != nil {
+		return shim.Error("Failed to resolve submitter identity: " + err.Error())
+	}
+
+	txTime, err := getTxTime(stub)
+	if err != nil {
+		return shim.Error("Failed to read transaction timestamp: " + err.Error())
+	}
+
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(recallUnitKeyType, []string{recall.ID})
+	if err != nil {
+		return shim.Error("Failed to get recalled units: " + err.Error())
+	}
+	defer resultsIterator.Close()
+
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error("Failed to get next result: " + err.Error())
+		}
+
+		_, keyParts, err := stub.SplitCompositeKey(queryResponse.Key)
+		if err != nil || len(keyParts) != 2 {
+			continue // Skip malformed index entries
+		}
+
+		medicationJSON, err := stub.GetState(keyParts[1])
+		if err != nil {
+			return shim.Error("Failed to read medication from world state: " + err.Error())
+		}
+		if medicationJSON == nil {
+			continue // Stale index entry
+		}
+
+		var medication MedicationData
+		err = json.Unmarshal(medicationJSON, &medication)
+		if err != nil {
+			return shim.Error("Failed to unmarshal medication: " + err.Error())
+		}
+
+		// Units returned or destroyed since the recall keep their status
+		if medication.Status != StatusRecalled || medication.RecallID != recall.ID {
+			continue
+		}
+
+		restoredStatus := medication.PreRecallStatus
+		if restoredStatus == "" {
+			trackingHistory, err := s.getTrackingEventsForMedication(stub, medication.ID)
+			if err != nil {
+				return shim.Error("Failed to get tracking history: " + err.Error())
+			}
+			restoredStatus = resolveStatusBeforeLastRecall(trackingHistory)
+		}
+
+		liftEvent := TrackingEvent{
+			ID:           newEventID(stub, &medication),
+			Event:        EventLiftRecall,
+			Location:     medication.Location,
+			Timestamp:    txTime,
+			Actor:        submitter.displayLabel(""),
+			Submitter:    submitter,
+			MedicationID: medication.ID,
+			RecallID:     recall.ID,
+			Signature:    "",
+		}
+
+		err = s.putTrackingEvent(stub, &medication, liftEvent)
+		if err != nil {
+			return shim.Error("Failed to put tracking event to world state: " + err.Error())
+		}
+
+		medication.Status = restoredStatus
+		medication.PreRecallStatus = ""
+		medication.RecallReason = ""
+		medication.RecalledBy = nil
+		medication.RecallID = ""
+
+		err = s.putMedication(stub, &medication)
+		if err != nil {
+			return shim.Error("Failed to update medication in world state: " + err.Error())
+		}
+		recall.RestoredUnits++
+	}
+
+	recall.Status = RecallStatusClosed
+	recall.ClosedAt = txTime
+	recall.ClosedBy = submitter
+	recall.CloseReason = args[1]
+
+	err = s.putRecall(stub, recall)
+	if err != nil {
+		return shim.Error("Failed to put recall to world state: " + err.Error())
+	}
+
+	// Closed recalls no longer flag newly commissioned units
+	if recall.Selector.MedicationID == "" {
+		gtinRecallKey, err := stub.CreateCompositeKey(gtinRecallKeyType, []string{recall.Selector.GTIN, recall.ID})
+		if err != nil {
+			return shim.Error("Failed to create recall index key: " + err.Error())
+		}
+
+		err = stub.DelState(gtinRecallKey)
+		if err != nil {
+			return shim.Error("Failed to delete recall index: " + err.Error())
+		}
+	}
+
+	err = s.emitEvent(stub, EventNameRecallLifted, RecallLiftedEvent{
+		RecallID:       recall.ID,
+		Reason:         recall.CloseReason,
+		SubmitterMSPID: submitter.MSPID,
+		RestoredUnits:  recall.RestoredUnits,
+	})
+	if err != nil {
+		return shim.Error("Failed to emit chaincode event: " + err.Error())
+	}
+
+	recallJSON, err := json.Marshal(recall)
+	if err != nil {
+		return shim.Error("Failed to marshal recall: " + err.Error())
+	}
+
+	fmt.Printf("Recall %s lifted, %d units restored\n", recall.ID, recall.RestoredUnits)
+	return shim.Success(recallJSON)
+}
+
+// Helper function to recall a single unit: applies the lifecycle transition, stores the
+// recall tracking event and indexes the unit under the recall. The caller persists the medication.
+func (s *SmartContract) recallUnit(stub shim.ChaincodeStubInterface, medication *MedicationData, recall *Recall, submitter *SubmitterIdentity, txTime int64) (*TrackingEvent, error) {
+	status, err := s.currentStatus(stub, medication)
+	if err != nil {
+		return nil, err
+	}
+
+	medication.Status, err = nextStatus(status, EventRecall)
+	if err != nil {
+		return nil, err
+	}
+	medication.PreRecallStatus = status
+	medication.RecallReason = recall.Reason
+	medication.RecalledBy = recall.IssuedBy
+	medication.RecallID = recall.ID
+
+	recallEvent := TrackingEvent{
+		ID:           newEventID(stub, medication),
+		Event:        EventRecall,
+		Location:     medication.Location,
+		Timestamp:    txTime,
+		Actor:        recall.Issuer,
+		Submitter:    submitter,
+		MedicationID: medication.ID,
+		RecallID:     recall.ID,
+		Signature:    "",
+	}
+
+	err = s.putTrackingEvent(stub, medication, recallEvent)
+	if err != nil {
+		return nil, err
+	}
+
+	recallUnitKey, err := stub.CreateCompositeKey(recallUnitKeyType, []string{recall.ID, medication.ID})
+	if err != nil {
+		return nil, err
+	}
+
+	err = stub.PutState(recallUnitKey, []byte{0x00})
+	if err != nil {
+		return nil, err
+	}
+
+	return &recallEvent, nil
+}
+
+// Helper function to load the open recalls of a GTIN
+func (s *SmartContract) getActiveRecallsForGTIN(stub shim.ChaincodeStubInterface, gtin string) ([]*Recall, error) {
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(gtinRecallKeyType, []string{gtin})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	var recalls []*Recall
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		_, keyParts, err := stub.SplitCompositeKey(queryResponse.Key)
+		if err != nil || len(keyParts) != 2 {
+			continue // Skip malformed index entries
+		}
+
+		recall, err := s.readRecall(stub, keyParts[1])
+		if err != nil {
+			return nil, err
+		}
+		if recall.isActive() {
+			recalls = append(recalls, recall)
+		}
+	}
+
+	return recalls, nil
+}
+
+// Helper function to recall a newly commissioned unit under the first open recall whose
+// selector matches it. Returns the recall applied, or nil. The recall's AffectedUnits is
+// incremented in memory so that one loaded list can serve a whole batch; the caller persists it.
+func (s *SmartContract) applyMatchingRecall(stub shim.ChaincodeStubInterface, medication *MedicationData, recalls []*Recall, submitter *SubmitterIdentity, txTime int64) (*Recall, error) {
+	for _, recall := range recalls {
+		if !recall.Selector.matches(medication) {
+			continue
+		}
+
+		_, err := s.recallUnit(stub, medication, recall, submitter, txTime)
+		if err != nil {
+			return nil, err
+		}
+
+		recall.AffectedUnits++
+		return recall, nil
+	}
+
+	return nil, nil
+}
+
+// Helper function to get the medications matching a GTIN-based selector via the GTIN index
+func (s *SmartContract) getMedicationsBySelector(stub shim.ChaincodeStubInterface, selector *RecallSelector) ([]MedicationData, error) {
+	indexKeys := []string{selector.GTIN}
+	if selector.Batch != "" {
+		indexKeys = append(indexKeys, selector.Batch)
+	}
+
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(gtinKeyType, indexKeys)
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	var medications []MedicationData
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		_, keyParts, err := stub.SplitCompositeKey(queryResponse.Key)
+		if err != nil || len(keyParts) != 3 {
+			continue // Skip malformed index entries
+		}
+
+		medicationJSON, err := stub.GetState(keyParts[2])
+		if err != nil {
+			return nil, err
+		}
+		if medicationJSON == nil {
+			continue // Stale index entry
+		}
+
+		var medication MedicationData
+		err = json.Unmarshal(medicationJSON, &medication)
+		if err != nil {
+			continue // Skip invalid records
+		}
+
+		if selector.matches(&medication) {
+			medications = append(medications, medication)
+		}
+	}
+
+	return medications, nil
+}
+
+// Helper function to read a recall record
+func (s *SmartContract) readRecall(stub shim.ChaincodeStubInterface, recallID string) (*Recall, error) {
+	recallKey, err := stub.CreateCompositeKey(recallKeyType, []string{recallID})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create recall key: %s", err)
+	}
+
+	recallJSON, err := stub.GetState(recallKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read recall from world state: %s", err)
+	}
+	if recallJSON == nil {
+		return nil, fmt.Errorf("recall not found: %s", recallID)
+	}
+
+	var recall Recall
+	err = json.Unmarshal(recallJSON, &recall)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal recall: %s", err)
+	}
+
+	return &recall, nil
+}
+
+// Helper function to store a recall record
+func (s *SmartContract) putRecall(stub shim.ChaincodeStubInterface, recall *Recall) error {
+	recallKey, err := stub.CreateCompositeKey(recallKeyType, []string{recall.ID})
+	if err != nil {
+		return err
+	}
+
+	recallJSON, err := json.Marshal(recall)
+	if err != nil {
+		return err
+	}
+
+	return stub.PutState(recallKey, recallJSON)
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+
+	"drug-traceability/gs1"
+)
+
+// RecallHolderGroup lists the affected units held by one party at one location
+type RecallHolderGroup struct {
+	Holder       string         `json:"holder"`
+	HolderMSPID  string         `json:"holderMspId,omitempty"`
+	Location     string         `json:"location"`
+	UnitCount    int            `json:"unitCount"`
+	StatusCounts map[string]int `json:"statusCounts"`
+	Units        []string       `json:"units"`
+}
+
+// RecallEffectivenessReport shows where the units affected by a recall or batch are now
+type RecallEffectivenessReport struct {
+	RecallID            string              `json:"recallId,omitempty"`
+	GTIN                string              `json:"gtin"`
+	Batch               string              `json:"batch,omitempty"`
+	TotalUnits          int                 `json:"totalUnits"`
+	OutstandingUnits    int                 `json:"outstandingUnits"`
+	ReturnedUnits       int                 `json:"returnedUnits"`
+	DestroyedUnits      int                 `json:"destroyedUnits"`
+	AcknowledgedHolders int                 `json:"acknowledgedHolders"`
+	ReportedQuarantined int                 `json:"reportedQuarantined"`
+	ReportedReturned    int                 `json:"reportedReturned"`
+	Holders             []RecallHolderGroup `json:"holders"`
+	GeneratedAt         int64               `json:"generatedAt"`
+}
+
+// getRecallEffectiveness reports the current holder of every unit affected by a recall,
+// or of every unit in a batch, grouped by holder and location
+// Args: [recallId] or [gtin, batch]
+func (s *SmartContract) getRecallEffectiveness(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 && len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 1: recallId, or 2: gtin, batch")
+	}
+
+	report := RecallEffectivenessReport{Holders: []RecallHolderGroup{}}
+	var medicationIDs []string
+	var err error
+
+	if len(args) == 1 {
+		if args[0] == "" {
+			return shim.Error("Missing recall ID")
+		}
+
+		recall, err := s.readRecall(stub, args[0])
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		report.RecallID = recall.ID
+		report.GTIN = recall.Selector.GTIN
+		report.Batch = recall.Selector.Batch
+
+		medicationIDs, err = s.getIndexedMedicationIDs(stub, recallUnitKeyType, []string{recall.ID})
+		if err != nil {
+			return shim.Error("Failed to get recalled units: " + err.Error())
+		}
+
+		err = s.addAcknowledgementTotals(stub, &report)
+		if err != nil {
+			return shim.Error("Failed to get recall acknowledgements: " + err.Error())
+		}
+	} else {
+		if args[0] == "" || args[1] == "" {
+			return shim.Error("Missing required fields: gtin, batch")
+		}
+		gtin, err := gs1.NormalizeGTIN(args[0])
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		report.GTIN = gtin
+		report.Batch = args[1]
+
+		medicationIDs, err = s.getIndexedMedicationIDs(stub, gtinKeyType, []string{gtin, args[1]})
+		if err != nil {
+			return shim.Error("Failed to get batch units: " + err.Error())
+		}
+	}
+
+	groups := make(map[string]*RecallHolderGroup)
+	var groupKeys []string
+	for _, medicationID := range medicationIDs {
+		medicationJSON, err := stub.GetState(medicationID)
+		if err != nil {
+			return shim.Error("Failed to read medication from world state: " + err.Error())
+		}
+		if medicationJSON == nil {
+			continue // Stale index entry
+		}
+
+		var medication MedicationData
+		err = json.Unmarshal(medicationJSON, &medication)
+		if err != nil {
+			return shim.Error("Failed to unmarshal medication: " + err.Error())
+		}
+
+		trackingHistory, err := s.getTrackingEventsForMedication(stub, medicationID)
+		if err != nil {
+			return shim.Error("Failed to get tracking history: " + err.Error())
+		}
+
+		status := medication.Status
+		if status == statusLegacyActive {
+			status = resolveLegacyStatus(trackingHistory)
+		}
+
+		report.TotalUnits++
+		switch status {
+		case StatusReturned:
+			report.ReturnedUnits++
+		case StatusDestroyed:
+			report.DestroyedUnits++
+		default:
+			report.OutstandingUnits++
+		}
+
+		holder, holderMSPID := getCurrentHolder(&medication, trackingHistory)
+		groupKey := holderMSPID + "\x00" + holder + "\x00" + medication.Location
+		group, ok := groups[groupKey]
+		if !ok {
+			group = &RecallHolderGroup{
+				Holder:       holder,
+				HolderMSPID:  holderMSPID,
+				Location:     medication.Location,
+				StatusCounts: make(map[string]int),
+			}
+			groups[groupKey] = group
+			groupKeys = append(groupKeys, groupKey)
+		}
+		group.UnitCount++
+		group.StatusCounts[status]++
+		group.Units = append(group.Units, medicationID)
+	}
+
+	// Largest holdings first so recall coordinators see where to act
+	sort.Strings(groupKeys)
+	for _, groupKey := range groupKeys {
+		report.Holders = append(report.Holders, *groups[groupKey])
+	}
+	sort.SliceStable(report.Holders, func(i, j int) bool {
+		return report.Holders[i].UnitCount > report.Holders[j].UnitCount
+	})
+
+	report.GeneratedAt, err = getTxTime(stub)
+	if err != nil {
+		return shim.Error("Failed to read transaction timestamp: " + err.Error())
+	}
+
+	reportJSON, err := json.Marshal(report)
+	if err != nil {
+		return shim.Error("Failed to marshal recall report: " + err.Error())
+	}
+
+	return shim.Success(reportJSON)
+}
+
+// Helper function to sum the quantities reported in a recall's acknowledgements
+func (s *SmartContract) addAcknowledgementTotals(stub shim.ChaincodeStubInterface, report *RecallEffectivenessReport) error {
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(recallAckKeyType, []string{report.RecallID})
+	if err != nil {
+		return err
+	}
+	defer resultsIterator.Close()
+
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return err
+		}
+
+		var acknowledgement RecallAcknowledgement
+		err = json.Unmarshal(queryResponse.Value, &acknowledgement)
+		if err != nil {
+			continue // Skip invalid records
+		}
+
+		report.AcknowledgedHolders++
+		report.ReportedQuarantined += acknowledgement.QuantityQuarantined
+		report.ReportedReturned += acknowledgement.QuantityReturned
+	}
+
+	return nil
+}
+
+// Helper function to list the medication IDs of an index whose last key attribute is the medication ID
+func (s *SmartContract) getIndexedMedicationIDs(stub shim.ChaincodeStubInterface, keyType string, keys []string) ([]string, error) {
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(keyType, keys)
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	var medicationIDs []string
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		_, keyParts, err := stub.SplitCompositeKey(queryResponse.Key)
+		if err != nil || len(keyParts) == 0 {
+			continue // Skip malformed index entries
+		}
+
+		medicationIDs = append(medicationIDs, keyParts[len(keyParts)-1])
+	}
+
+	return medicationIDs, nil
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+
+	"drug-traceability/gs1"
+)
+
+// MedicationSearch is a structured medication search. Every given field must match:
+// identifiers match exactly, Text matches product name, manufacturer, batch, GTIN, serial
+// number or location case-insensitively, and the expiry bounds are exclusive YYYY-MM-DD dates.
+type MedicationSearch struct {
+	Manufacturer string `json:"manufacturer,omitempty"`
+	GTIN         string `json:"gtin,omitempty"`
+	Batch        string `json:"batch,omitempty"`
+	Status       string `json:"status,omitempty"`
+	Location     string `json:"location,omitempty"`
+	ExpiryBefore string `json:"expiryBefore,omitempty"`
+	ExpiryAfter  string `json:"expiryAfter,omitempty"`
+	Text         string `json:"text,omitempty"`
+}
+
+// parseMedicationSearch reads a search argument. A JSON object is a structured search;
+// any other string is a free-text search, as accepted before structured search existed.
+func parseMedicationSearch(query string) (*MedicationSearch, error) {
+	search := &MedicationSearch{}
+	if strings.HasPrefix(strings.TrimSpace(query), "{") {
+		err := json.Unmarshal([]byte(query), search)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal search: %s", err)
+		}
+	} else {
+		search.Text = query
+	}
+
+	err := search.validate()
+	if err != nil {
+		return nil, err
+	}
+	return search, nil
+}
+
+// validate checks the search fields and normalizes the GTIN to GTIN-14
+func (search *MedicationSearch) validate() error {
+	if *search == (MedicationSearch{}) {
+		return fmt.Errorf("search requires at least one criterion")
+	}
+	if search.GTIN != "" {
+		gtin, err := gs1.NormalizeGTIN(search.GTIN)
+		if err != nil {
+			return err
+		}
+		search.GTIN = gtin
+	}
+	if search.Status != "" && !isKnownStatus(search.Status) {
+		return fmt.Errorf("unknown status %q", search.Status)
+	}
+	if search.ExpiryBefore != "" {
+		if _, err := time.Parse(expiryDateLayout, search.ExpiryBefore); err != nil {
+			return fmt.Errorf("invalid expiryBefore %q, expecting YYYY-MM-DD", search.ExpiryBefore)
+		}
+	}
+	if search.ExpiryAfter != "" {
+		if _, err := time.Parse(expiryDateLayout, search.ExpiryAfter); err != nil {
+			return fmt.Errorf("invalid expiryAfter %q, expecting YYYY-MM-DD", search.ExpiryAfter)
+		}
+	}
+	return nil
+}
+
+func isKnownStatus(status string) bool {
+	switch status {
+	case StatusCommissioned, StatusInTransit, StatusReceived, StatusDispensed, StatusRecalled, StatusReturned, StatusDestroyed, statusLegacyActive:
+		return true
+	}
+	return false
+}
+
+// matches reports whether a medication satisfies every criterion of the search
+func (search *MedicationSearch) matches(medication *MedicationData) bool {
+	if search.Manufacturer != "" && search.Manufacturer != medication.Manufacturer {
+		return false
+	}
+	if search.GTIN != "" && search.GTIN != medication.GTIN {
+		return false
+	}
+	if search.Batch != "" && search.Batch != medication.Batch {
+		return false
+	}
+	if search.Status != "" && search.Status != medication.Status {
+		return false
+	}
+	if search.Location != "" && search.Location != medication.Location {
+		return false
+	}
+	if search.ExpiryBefore != "" || search.ExpiryAfter != "" {
+		// Dates are validated as YYYY-MM-DD, so they compare correctly as strings
+		if medication.ExpiryDate == "" {
+			return false
+		}
+		if search.ExpiryBefore != "" && medication.ExpiryDate >= search.ExpiryBefore {
+			return false
+		}
+		if search.ExpiryAfter != "" && medication.ExpiryDate <= search.ExpiryAfter {
+			return false
+		}
+	}
+	if search.Text != "" {
+		searchableText := strings.Join([]string{
+			medication.ProductName, medication.Manufacturer, medication.Batch,
+			medication.GTIN, medication.SerialNumber, medication.Location,
+		}, " ")
+		if !containsIgnoreCase(searchableText, search.Text) {
+			return false
+		}
+	}
+	return true
+}
+
+// couchDBQuery builds the Mango query for the search. Medication documents are told apart
+// from the other JSON records in the state database by their serialNumber field.
+func (search *MedicationSearch) couchDBQuery() (string, error) {
+	selector := map[string]interface{}{
+		"serialNumber": map[string]interface{}{"$exists": true},
+	}
+	if search.Manufacturer != "" {
+		selector["manufacturer"] = search.Manufacturer
+	}
+	if search.GTIN != "" {
+		selector["gtin"] = search.GTIN
+	}
+	if search.Batch != "" {
+		selector["batch"] = search.Batch
+	}
+	if search.Status != "" {
+		selector["status"] = search.Status
+	}
+	if search.Location != "" {
+		selector["location"] = search.Location
+	}
+	if search.ExpiryBefore != "" || search.ExpiryAfter != "" {
+		expiry := map[string]interface{}{"$gt": search.ExpiryAfter}
+		if search.ExpiryBefore != "" {
+			expiry["$lt"] = search.ExpiryBefore
+		}
+		selector["expiryDate"] = expiry
+	}
+	if search.Text != "" {
+		pattern := "(?i)" + regexp.QuoteMeta(search.Text)
+		var fields []interface{}
+		for _, field := range []string{"productName", "manufacturer", "batch", "gtin", "serialNumber", "location"} {
+			fields = append(fields, map[string]interface{}{field: map[string]interface{}{"$regex": pattern}})
+		}
+		selector["$or"] = fields
+	}
+
+	queryJSON, err := json.Marshal(map[string]interface{}{"selector": selector})
+	if err != nil {
+		return "", err
+	}
+	return string(queryJSON), nil
+}
+
+// medicationScan walks the candidates of a search, one medication at a time
+type medicationScan struct {
+	stub     shim.ChaincodeStubInterface
+	iterator shim.StateQueryIteratorInterface
+	indexed  bool // keys are composite index entries whose last attribute is the medication ID
+
+	// Bounds of a scan over the expiry index, which is ordered by date: entries up to
+	// expiryAfter are skipped and the scan ends at the first entry on or after expiryBefore
+	expiryAfter  string
+	expiryBefore string
+	// expiryDays are the dates still to scan when the expiry index is read one day at a time
+	expiryDays []string
+}
+
+// next returns the next readable medication, or nil once the scan is exhausted
+func (scan *medicationScan) next() (*MedicationData, error) {
+	for {
+		if !scan.iterator.HasNext() {
+			if len(scan.expiryDays) == 0 {
+				return nil, nil
+			}
+
+			iterator, err := scan.stub.GetStateByPartialCompositeKey(expiryKeyType, []string{scan.expiryDays[0]})
+			if err != nil {
+				return nil, err
+			}
+			scan.iterator.Close()
+			scan.iterator, scan.expiryDays = iterator, scan.expiryDays[1:]
+			continue
+		}
+
+		queryResponse, err := scan.iterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		medicationID, medicationJSON := queryResponse.Key, queryResponse.Value
+		if scan.indexed {
+			objectType, keyParts, err := scan.stub.SplitCompositeKey(queryResponse.Key)
+			if err != nil || len(keyParts) == 0 {
+				continue // Skip malformed index entries
+			}
+			if objectType == expiryKeyType {
+				if scan.expiryAfter != "" && keyParts[0] <= scan.expiryAfter {
+					continue
+				}
+				if scan.expiryBefore != "" && keyParts[0] >= scan.expiryBefore {
+					scan.expiryDays = nil
+					return nil, nil
+				}
+			}
+
+			medicationID = keyParts[len(keyParts)-1]
+			medicationJSON, err = scan.stub.GetState(medicationID)
+			if err != nil {
+				return nil, err
+			}
+			if medicationJSON == nil {
+				continue // Stale index entry
+			}
+		}
+
+		// Skip legacy tracking events and other records that are not medications
+		medication, ok := parseMedicationRecord(medicationID, medicationJSON)
+		if !ok {
+			continue
+		}
+
+		return medication, nil
+	}
+}
+
+func (scan *medicationScan) close() {
+	scan.iterator.Close()
+}
+
+// richQueryUnsupported reports whether a rich query failed because the state database is
+// LevelDB, as opposed to failing on a malformed query or an unavailable CouchDB
+func richQueryUnsupported(err error) bool {
+	return strings.Contains(err.Error(), "not supported for leveldb")
+}
+
+// expiryDaysBetween lists the dates strictly between two YYYY-MM-DD dates. It returns nil
+// if either bound is missing or malformed, or if the window is empty or longer than the
+// longest window of getExpiringMedications.
+func expiryDaysBetween(after, before string) []string {
+	start, err := time.Parse(expiryDateLayout, after)
+	if err != nil {
+		return nil
+	}
+	end, err := time.Parse(expiryDateLayout, before)
+	if err != nil {
+		return nil
+	}
+
+	var days []string
+	for day := start.AddDate(0, 0, 1); day.Before(end); day = day.AddDate(0, 0, 1) {
+		if len(days) > maxExpiryWindowDays {
+			return nil
+		}
+		days = append(days, day.Format(expiryDateLayout))
+	}
+	return days
+}
+
+// openMedicationSearch starts a scan over the candidates of a search. Rich queries are used
+// where the state database is CouchDB. LevelDB peers reject them, and the scan then falls back
+// to the GTIN, manufacturer, status or expiry composite-key index, or to a range over all
+// medication records when the search has none of those criteria. A pageSize of 0 scans
+// everything. Candidates still have to be checked with search.matches.
+func (s *SmartContract) openMedicationSearch(stub shim.ChaincodeStubInterface, search *MedicationSearch, pageSize int32, bookmark string) (*medicationScan, *pb.QueryResponseMetadata, error) {
+	query, err := search.couchDBQuery()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var iterator shim.StateQueryIteratorInterface
+	var metadata *pb.QueryResponseMetadata
+	if pageSize > 0 {
+		iterator, metadata, err = stub.GetQueryResultWithPagination(query, pageSize, bookmark)
+	} else {
+		iterator, err = stub.GetQueryResult(query)
+	}
+	if err == nil {
+		return &medicationScan{stub: stub, iterator: iterator}, metadata, nil
+	}
+	if !richQueryUnsupported(err) {
+		return nil, nil, err
+	}
+
+	scan := &medicationScan{stub: stub, indexed: true}
+	keyType, keys := "", []string(nil)
+	switch {
+	case search.GTIN != "" && search.Batch != "":
+		keyType, keys = gtinKeyType, []string{search.GTIN, search.Batch}
+	case search.GTIN != "":
+		keyType, keys = gtinKeyType, []string{search.GTIN}
+	case search.Manufacturer != "":
+		keyType, keys = manufacturerKeyType, []string{search.Manufacturer}
+	case search.Status != "":
+		keyType, keys = statusKeyType, []string{search.Status}
+	case search.ExpiryBefore != "" || search.ExpiryAfter != "":
+		keyType, keys = expiryKeyType, []string{}
+		scan.expiryAfter, scan.expiryBefore = search.ExpiryAfter, search.ExpiryBefore
+
+		// A bounded window without paging is read one day at a time, so that units which
+		// expired before it are never visited
+		if days := expiryDaysBetween(search.ExpiryAfter, search.ExpiryBefore); pageSize == 0 && days != nil {
+			keys, scan.expiryDays = []string{days[0]}, days[1:]
+		}
+	}
+
+	if keyType != "" {
+		if pageSize > 0 {
+			scan.iterator, metadata, err = stub.GetStateByPartialCompositeKeyWithPagination(keyType, keys, pageSize, bookmark)
+		} else {
+			scan.iterator, err = stub.GetStateByPartialCompositeKey(keyType, keys)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		return scan, metadata, nil
+	}
+
+	if pageSize > 0 {
+		iterator, metadata, err = stub.GetStateByRangeWithPagination("", "", pageSize, bookmark)
+	} else {
+		iterator, err = stub.GetStateByRange("", "")
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return &medicationScan{stub: stub, iterator: iterator}, metadata, nil
+}
+
+// Helper function to collect the medications matching a search from an open scan
+func collectSearchMatches(scan *medicationScan, search *MedicationSearch) ([]MedicationData, error) {
+	medications := []MedicationData{}
+	for {
+		medication, err := scan.next()
+		if err != nil {
+			return nil, err
+		}
+		if medication == nil {
+			return medications, nil
+		}
+
+		if search.matches(medication) {
+			medications = append(medications, *medication)
+		}
+	}
+}
+
+// Helper function for case-insensitive string search
+func containsIgnoreCase(str, substr string) bool {
+	return strings.Contains(strings.ToLower(str), strings.ToLower(substr))
+}
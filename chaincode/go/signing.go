@@ -0,0 +1,520 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// signingKeyKeyType indexes the public keys participants sign tracking events with
+const signingKeyKeyType = "signingKey~participant~keyId"
+
+// Signing key algorithms
+const (
+	SigningAlgorithmECDSA   = "ecdsa"
+	SigningAlgorithmEd25519 = "ed25519"
+)
+
+// Signing key statuses
+const (
+	SigningKeyStatusActive  = "active"
+	SigningKeyStatusRevoked = "revoked"
+)
+
+// Outcomes of checking a tracking event signature. Legacy signatures were stored before
+// signatures were checked and cannot be verified; they do not affect the verdict.
+const (
+	SignatureValid      = "valid"
+	SignatureInvalid    = "invalid"
+	SignatureUnsigned   = "unsigned"
+	SignatureUnknownKey = "unknown_key"
+	SignatureRevokedKey = "revoked_key"
+	SignatureLegacy     = "legacy"
+)
+
+// SigningKey is a public key a registered participant signs tracking events with.
+// OwnerMSP is the MSP of the participant when the key was registered.
+type SigningKey struct {
+	Participant  string             `json:"participant"`
+	KeyID        string             `json:"keyId"`
+	Algorithm    string             `json:"algorithm"`
+	PublicKey    string             `json:"publicKey"` // PEM encoded PKIX public key
+	OwnerMSP     string             `json:"ownerMspId"`
+	Status       string             `json:"status"`
+	RegisteredBy *SubmitterIdentity `json:"registeredBy"`
+	RegisteredAt int64              `json:"registeredAt"`
+	RevokedBy    *SubmitterIdentity `json:"revokedBy,omitempty"`
+	RevokedAt    int64              `json:"revokedAt,omitempty"`
+}
+
+// SigningPayload is what a participant signs for a tracking event. Its JSON encoding, with
+// fields in the order below (which is sorted) and no whitespace, is the signed message.
+// Subject is the medication ID in its SGTIN element string form, or the container SSCC
+// for addContainerEvent. Previous is the subject's state the event applies to: the medication's
+// headHash, or the container's lastTxId. It changes with every event, so a signature cannot be
+// replayed as a later event. It is left out when empty, as for medications recorded before
+// event chaining, so signatures made before it was added still verify.
+type SigningPayload struct {
+	Actor    string `json:"actor"`
+	Event    string `json:"event"`
+	Location string `json:"location"`
+	Previous string `json:"previous,omitempty"`
+	Subject  string `json:"subject"`
+}
+
+// SignatureCheck reports whether one tracking event carries a valid signature of its actor
+type SignatureCheck struct {
+	EventID string `json:"eventId"`
+	Status  string `json:"status"`
+	KeyID   string `json:"keyId,omitempty"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+// bytes returns the signed message. HTML characters are not escaped, so the message
+// matches a plain JSON encoder in other languages.
+func (payload SigningPayload) bytes() []byte {
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	encoder.SetEscapeHTML(false)
+	_ = encoder.Encode(payload) // a struct of strings always encodes
+	return bytes.TrimSuffix(buffer.Bytes(), []byte("\n"))
+}
+
+// parseEventSignature splits a signature argument of the form keyId:base64Signature
+func parseEventSignature(signature string) (string, []byte, error) {
+	separator := strings.LastIndex(signature, ":")
+	if separator <= 0 {
+		return "", nil, fmt.Errorf("signature must have the form keyId:base64Signature")
+	}
+
+	signatureBytes, err := base64.StdEncoding.DecodeString(signature[separator+1:])
+	if err != nil {
+		return "", nil, fmt.Errorf("signature is not valid base64: %s", err)
+	}
+
+	return signature[:separator], signatureBytes, nil
+}
+
+// parseSigningKey decodes a PEM public key and reports its algorithm
+func parseSigningKey(publicKeyPEM string) (interface{}, string, error) {
+	block, _ := pem.Decode([]byte(publicKeyPEM))
+	if block == nil {
+		return nil, "", fmt.Errorf("public key is not PEM encoded")
+	}
+
+	publicKey, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to parse public key: %s", err)
+	}
+
+	switch publicKey.(type) {
+	case *ecdsa.PublicKey:
+		return publicKey, SigningAlgorithmECDSA, nil
+	case ed25519.PublicKey:
+		return publicKey, SigningAlgorithmEd25519, nil
+	}
+	return nil, "", fmt.Errorf("unsupported public key type %T: expecting ECDSA or Ed25519", publicKey)
+}
+
+// verify checks a signature over a message. ECDSA signatures are ASN.1 DER over the
+// SHA-256 of the message; Ed25519 signatures are over the message itself.
+func (key *SigningKey) verify(message, signature []byte) error {
+	publicKey, _, err := parseSigningKey(key.PublicKey)
+	if err != nil {
+		return err
+	}
+
+	switch publicKey := publicKey.(type) {
+	case *ecdsa.PublicKey:
+		digest := sha256.Sum256(message)
+		if !ecdsa.VerifyASN1(publicKey, digest[:], signature) {
+			return fmt.Errorf("signature does not verify with key %s", key.KeyID)
+		}
+	case ed25519.PublicKey:
+		if !ed25519.Verify(publicKey, message, signature) {
+			return fmt.Errorf("signature does not verify with key %s", key.KeyID)
+		}
+	}
+	return nil
+}
+
+// registerSigningKey registers a public key a participant signs tracking events with.
+// The participant is named by its GLN and its keys can only be registered by its own MSP.
+// Args: [participantGln, keyId, publicKeyPEM]
+func (s *SmartContract) registerSigningKey(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 3: participant, keyId, publicKey")
+	}
+
+	keyID := args[1]
+	if args[0] == "" || keyID == "" {
+		return shim.Error("Missing required fields: participant, keyId")
+	}
+	if strings.Contains(keyID, ":") {
+		return shim.Error("Key ID must not contain ':'")
+	}
+
+	_, algorithm, err := parseSigningKey(args[2])
+	if err != nil {
+		return shim.Error("Invalid public key: " + err.Error())
+	}
+
+	submitter, err := getSubmitterIdentity(stub)
+	if err != nil {
+		return shim.Error("Failed to resolve submitter identity: " + err.Error())
+	}
+
+	registered, err := s.readParticipant(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if registered.MSPID != submitter.MSPID {
+		return shim.Error("Access denied: participant " + registered.GLN + " belongs to MSP " + registered.MSPID)
+	}
+	if registered.Status == ParticipantStatusPending {
+		return shim.Error("Participant " + registered.GLN + " is pending regulator approval")
+	}
+	participant := registered.GLN
+
+	keys, err := s.getSigningKeysForParticipant(stub, participant)
+	if err != nil {
+		return shim.Error("Failed to get signing keys: " + err.Error())
+	}
+	for _, key := range keys {
+		if key.KeyID == keyID {
+			return shim.Error("Signing key already exists: " + keyID)
+		}
+	}
+
+	txTime, err := getTxTime(stub)
+	if err != nil {
+		return shim.Error("Failed to read transaction timestamp: " + err.Error())
+	}
+
+	key := SigningKey{
+		Participant:  participant,
+		KeyID:        keyID,
+		Algorithm:    algorithm,
+		PublicKey:    args[2],
+		OwnerMSP:     registered.MSPID,
+		Status:       SigningKeyStatusActive,
+		RegisteredBy: submitter,
+		RegisteredAt: txTime,
+	}
+
+	err = s.putSigningKey(stub, &key)
+	if err != nil {
+		return shim.Error("Failed to put signing key to world state: " + err.Error())
+	}
+
+	err = s.emitEvent(stub, EventNameSigningKeyRegistered, SigningKeyEvent{
+		Participant:    participant,
+		KeyID:          keyID,
+		Algorithm:      algorithm,
+		SubmitterMSPID: submitter.MSPID,
+	})
+	if err != nil {
+		return shim.Error("Failed to emit chaincode event: " + err.Error())
+	}
+
+	fmt.Printf("Signing key %s registered for participant %s\n", keyID, participant)
+	return signingKeyResponse(&key)
+}
+
+// revokeSigningKey stops a key from signing new tracking events. Events it signed before
+// the revocation still verify. Only the owning MSP or a regulator may revoke a key.
+// Args: [participant, keyId]
+func (s *SmartContract) revokeSigningKey(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2: participant, keyId")
+	}
+
+	key, err := s.readSigningKey(stub, args[0], args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if key.Status == SigningKeyStatusRevoked {
+		return shim.Error("Signing key " + key.KeyID + " is already revoked")
+	}
+
+	submitter, err := getSubmitterIdentity(stub)
+	if err != nil {
+		return shim.Error("Failed to resolve submitter identity: " + err.Error())
+	}
+
+	isRegulator, err := s.callerHasRole(stub, RoleRegulator)
+	if err != nil {
+		return shim.Error("Access denied: " + err.Error())
+	}
+	if !isRegulator && key.OwnerMSP != submitter.MSPID {
+		return shim.Error("Access denied: only the owning MSP or a regulator may revoke signing key " + key.KeyID)
+	}
+
+	txTime, err := getTxTime(stub)
+	if err != nil {
+		return shim.Error("Failed to read transaction timestamp: " + err.Error())
+	}
+
+	key.Status = SigningKeyStatusRevoked
+	key.RevokedBy = submitter
+	key.RevokedAt = txTime
+
+	err = s.putSigningKey(stub, key)
+	if err != nil {
+		return shim.Error("Failed to put signing key to world state: " + err.Error())
+	}
+
+	err = s.emitEvent(stub, EventNameSigningKeyRevoked, SigningKeyEvent{
+		Participant:    key.Participant,
+		KeyID:          key.KeyID,
+		Algorithm:      key.Algorithm,
+		SubmitterMSPID: submitter.MSPID,
+	})
+	if err != nil {
+		return shim.Error("Failed to emit chaincode event: " + err.Error())
+	}
+
+	fmt.Printf("Signing key %s of participant %s revoked\n", key.KeyID, key.Participant)
+	return signingKeyResponse(key)
+}
+
+// getSigningKeys returns the signing keys registered for a participant
+// Args: [participant]
+func (s *SmartContract) getSigningKeys(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1: participant")
+	}
+
+	if args[0] == "" {
+		return shim.Error("Missing participant")
+	}
+
+	keys, err := s.getSigningKeysForParticipant(stub, args[0])
+	if err != nil {
+		return shim.Error("Failed to get signing keys: " + err.Error())
+	}
+
+	keysJSON, err := json.Marshal(keys)
+	if err != nil {
+		return shim.Error("Failed to marshal signing keys: " + err.Error())
+	}
+
+	return shim.Success(keysJSON)
+}
+
+func signingKeyResponse(key *SigningKey) pb.Response {
+	keyJSON, err := json.Marshal(key)
+	if err != nil {
+		return shim.Error("Failed to marshal signing key: " + err.Error())
+	}
+	return shim.Success(keyJSON)
+}
+
+// Helper function to check the signature of a new tracking event before it is stored.
+// An empty signature is accepted unless the access policy requires signatures; any other
+// signature must verify with an active key of the claimed actor.
+func (s *SmartContract) checkNewEventSignature(stub shim.ChaincodeStubInterface, payload SigningPayload, signature string) error {
+	if signature == "" {
+		policy, err := s.getAccessPolicy(stub)
+		if err != nil {
+			return fmt.Errorf("failed to read access policy: %s", err)
+		}
+		if policy.RequireSignatures {
+			return fmt.Errorf("tracking events must be signed")
+		}
+		return nil
+	}
+
+	if payload.Actor == "" {
+		return fmt.Errorf("signed events must name their actor")
+	}
+
+	check, err := s.checkSignature(stub, payload, signature, 0)
+	if err != nil {
+		return err
+	}
+	if check.Status != SignatureValid {
+		return fmt.Errorf("signature of %s is %s: %s", payload.Actor, check.Status, check.Reason)
+	}
+	return nil
+}
+
+// Helper function to check a signature against the keys of the payload's actor.
+// With signedAt set, a key revoked after that time still counts; otherwise revoked keys fail.
+func (s *SmartContract) checkSignature(stub shim.ChaincodeStubInterface, payload SigningPayload, signature string, signedAt int64) (SignatureCheck, error) {
+	if signature == "" {
+		return SignatureCheck{Status: SignatureUnsigned}, nil
+	}
+
+	keyID, signatureBytes, err := parseEventSignature(signature)
+	if err != nil {
+		return SignatureCheck{Status: SignatureInvalid, Reason: err.Error()}, nil
+	}
+
+	check := SignatureCheck{KeyID: keyID}
+	key, err := s.findSigningKey(stub, payload.Actor, keyID)
+	if err != nil {
+		return check, err
+	}
+	if key == nil {
+		check.Status = SignatureUnknownKey
+		check.Reason = "no key " + keyID + " registered for " + payload.Actor
+		return check, nil
+	}
+
+	if key.Status == SigningKeyStatusRevoked && (signedAt == 0 || signedAt >= key.RevokedAt) {
+		check.Status = SignatureRevokedKey
+		check.Reason = "key " + keyID + " was revoked"
+		return check, nil
+	}
+
+	err = key.verify(payload.bytes(), signatureBytes)
+	if err != nil {
+		check.Status = SignatureInvalid
+		check.Reason = err.Error()
+		return check, nil
+	}
+
+	check.Status = SignatureValid
+	return check, nil
+}
+
+// Helper function to check the signature of every stored tracking event of a medication
+func (s *SmartContract) checkEventSignatures(stub shim.ChaincodeStubInterface, trackingHistory []TrackingEvent) ([]SignatureCheck, error) {
+	checks := []SignatureCheck{}
+	for _, event := range trackingHistory {
+		check, err := s.checkSignature(stub, event.signingPayload(), event.Signature, event.Timestamp)
+		if err != nil {
+			return nil, err
+		}
+
+		// Events that predate the hash chain, or whose signature could never have passed
+		// checkNewEventSignature, hold the free text stored before signatures were checked
+		if check.Status != SignatureUnsigned && check.Status != SignatureValid {
+			if _, _, err := parseEventSignature(event.Signature); event.Hash == "" || err != nil {
+				check = SignatureCheck{Status: SignatureLegacy, Reason: "recorded before tracking event signatures were checked"}
+			}
+		}
+
+		check.EventID = event.ID
+		checks = append(checks, check)
+	}
+	return checks, nil
+}
+
+// signingPayload rebuilds the payload a stored tracking event was signed over
+func (event *TrackingEvent) signingPayload() SigningPayload {
+	subject, previous := event.MedicationID, event.PrevHash
+	if event.ContainerSSCC != "" {
+		subject, previous = event.ContainerSSCC, event.ContainerTxID
+	} else if event.SignedSubject != "" {
+		subject, previous = event.SignedSubject, event.SignedPrevious
+	}
+
+	return SigningPayload{
+		Actor:    event.Actor,
+		Event:    event.Event,
+		Location: event.Location,
+		Previous: previous,
+		Subject:  subject,
+	}
+}
+
+// keepSignedFields records the medication ID and previous hash a stored event was signed over
+// before a migration rewrites them, so its signature still verifies. Container events are
+// signed over fields migrations leave alone.
+func (event *TrackingEvent) keepSignedFields() {
+	if event.Signature == "" || event.ContainerSSCC != "" || event.SignedSubject != "" {
+		return
+	}
+	event.SignedSubject = event.MedicationID
+	event.SignedPrevious = event.PrevHash
+}
+
+// Helper function to find a participant's signing key, or nil
+func (s *SmartContract) findSigningKey(stub shim.ChaincodeStubInterface, participant, keyID string) (*SigningKey, error) {
+	keyKey, err := stub.CreateCompositeKey(signingKeyKeyType, []string{participant, keyID})
+	if err != nil {
+		return nil, err
+	}
+
+	keyJSON, err := stub.GetState(keyKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read signing key from world state: %s", err)
+	}
+	if keyJSON == nil {
+		return nil, nil
+	}
+
+	var key SigningKey
+	err = json.Unmarshal(keyJSON, &key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal signing key: %s", err)
+	}
+
+	return &key, nil
+}
+
+// Helper function to read a signing key that must exist
+func (s *SmartContract) readSigningKey(stub shim.ChaincodeStubInterface, participant, keyID string) (*SigningKey, error) {
+	key, err := s.findSigningKey(stub, participant, keyID)
+	if err != nil {
+		return nil, err
+	}
+	if key == nil {
+		return nil, fmt.Errorf("signing key not found: %s of %s", keyID, participant)
+	}
+	return key, nil
+}
+
+// Helper function to list the signing keys of a participant
+func (s *SmartContract) getSigningKeysForParticipant(stub shim.ChaincodeStubInterface, participant string) ([]SigningKey, error) {
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(signingKeyKeyType, []string{participant})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	keys := []SigningKey{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		var key SigningKey
+		err = json.Unmarshal(queryResponse.Value, &key)
+		if err != nil {
+			continue // Skip invalid records
+		}
+
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
+
+// Helper function to store a signing key
+func (s *SmartContract) putSigningKey(stub shim.ChaincodeStubInterface, key *SigningKey) error {
+	keyKey, err := stub.CreateCompositeKey(signingKeyKeyType, []string{key.Participant, key.KeyID})
+	if err != nil {
+		return err
+	}
+
+	keyJSON, err := json.Marshal(key)
+	if err != nil {
+		return err
+	}
+
+	return stub.PutState(keyKey, keyJSON)
+}
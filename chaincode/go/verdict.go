@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Verification verdicts, from the most to the least severe
+const (
+	VerdictSuspect        = "suspect"
+	VerdictRecalled       = "recalled"
+	VerdictDecommissioned = "decommissioned"
+	VerdictDispensed      = "dispensed"
+	VerdictExpired        = "expired"
+	VerdictAuthentic      = "authentic"
+)
+
+// verdictSeverity ranks verdicts; a unit gets the most severe verdict any of its findings calls for
+var verdictSeverity = map[string]int{
+	VerdictSuspect:        5,
+	VerdictRecalled:       4,
+	VerdictDecommissioned: 3,
+	VerdictDispensed:      2,
+	VerdictExpired:        1,
+	VerdictAuthentic:      0,
+}
+
+// Verdict is the outcome of a verification. Reasons lists every finding, including those
+// less severe than the verdict, e.g. a recalled unit that has also expired.
+type Verdict struct {
+	Status  string          `json:"status"`
+	Reasons []VerdictReason `json:"reasons"`
+}
+
+// VerdictReason is one finding of a verification and the verdict it calls for
+type VerdictReason struct {
+	Verdict string `json:"verdict"`
+	Detail  string `json:"detail"`
+}
+
+// add records a finding, raising the verdict if the finding is more severe
+func (verdict *Verdict) add(status string, detail string) {
+	verdict.Reasons = append(verdict.Reasons, VerdictReason{Verdict: status, Detail: detail})
+	if verdictSeverity[status] > verdictSeverity[verdict.Status] {
+		verdict.Status = status
+	}
+}
+
+// assessVerdict computes the verdict of a verification result from the medication status,
+// its tracking history, the event chain and signature checks, any scanned attribute
+// mismatches, open clone alerts, and the expiry date at the verification time. A unit is
+// only valid when it is authentic.
+func (result *VerificationResult) assessVerdict() {
+	verdict := Verdict{Status: VerdictAuthentic, Reasons: []VerdictReason{}}
+	medication := result.MedicationData
+
+	// Tampering and counterfeit indicators
+	if !result.EventChain.Valid {
+		verdict.add(VerdictSuspect, fmt.Sprintf("tracking history fails hash chain verification with %d breaks", len(result.EventChain.Breaks)))
+	}
+	for _, check := range result.Signatures {
+		if check.Status == SignatureInvalid || check.Status == SignatureUnknownKey {
+			verdict.add(VerdictSuspect, fmt.Sprintf("tracking event %s has a %s signature: %s", check.EventID, check.Status, check.Reason))
+		}
+	}
+	for _, mismatch := range result.Mismatches {
+		verdict.add(VerdictSuspect, "scanned attribute differs from the commissioned record: "+mismatch)
+	}
+	for _, alert := range result.Alerts {
+		if alert.Status == AlertStatusOpen {
+			verdict.add(VerdictSuspect, "possible clone, alert "+alert.ID+": "+alert.Detail)
+		}
+	}
+
+	// Recalls, also for legacy records whose status predates recall tracking
+	recalled := medication.Status == StatusRecalled
+	for _, event := range result.TrackingHistory {
+		switch event.Event {
+		case EventRecall:
+			recalled = true
+		case EventLiftRecall:
+			recalled = false
+		}
+	}
+	if recalled {
+		detail := "recalled"
+		if medication.RecallID != "" {
+			detail += " under recall " + medication.RecallID
+		}
+		if medication.RecallReason != "" {
+			detail += ": " + medication.RecallReason
+		}
+		verdict.add(VerdictRecalled, detail)
+	}
+
+	switch medication.Status {
+	case StatusDestroyed:
+		verdict.add(VerdictDecommissioned, "destroyed")
+	case StatusDispensed:
+		verdict.add(VerdictDispensed, "dispensed to a patient")
+	}
+
+	// Units are usable through their expiry date, compared in UTC. A date that cannot be
+	// parsed cannot show the unit is still in date.
+	if medication.ExpiryDate != "" {
+		expiry, err := time.Parse(expiryDateLayout, medication.ExpiryDate)
+		verificationDay := time.Unix(result.VerificationTime, 0).UTC().Truncate(24 * time.Hour)
+		if err != nil {
+			verdict.add(VerdictExpired, fmt.Sprintf("unparseable expiry date %q", medication.ExpiryDate))
+		} else if verificationDay.After(expiry) {
+			verdict.add(VerdictExpired, "expired on "+medication.ExpiryDate)
+		}
+	}
+
+	result.Verdict = verdict
+	result.IsValid = verdict.Status == VerdictAuthentic
+}
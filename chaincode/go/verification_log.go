@@ -0,0 +1,416 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// Composite key object types of the verification log. Records are keyed by day so stats can
+// bucket them; the medication index lists the verifications of one unit.
+const (
+	verificationKeyType    = "verification~date~txId"
+	verificationMedKeyType = "verificationMed~medicationId~date~txId"
+)
+
+// Stats window of getVerificationStats, in days
+const (
+	defaultStatsDays = 30
+	maxStatsDays     = 366
+)
+
+// VerificationRecord is one logged verification of a unit. The verdict is computed by the
+// chaincode when the verification is recorded, not supplied by the verifier. Scans of IDs that
+// were never commissioned are logged as suspect with Found false.
+type VerificationRecord struct {
+	ID           string             `json:"id"` // transaction ID
+	MedicationID string             `json:"medicationId"`
+	Found        bool               `json:"found"`
+	Location     string             `json:"location"`
+	VerifierGLN  string             `json:"verifierGln,omitempty"`
+	Submitter    *SubmitterIdentity `json:"submitter"`
+	Timestamp    int64              `json:"timestamp"`
+	Date         string             `json:"date"` // YYYY-MM-DD in UTC
+	Verdict      string             `json:"verdict"`
+	Reasons      []VerdictReason    `json:"reasons"`
+	AlertIDs     []string           `json:"alertIds,omitempty"` // clone alerts this verification raised
+}
+
+// DailyVerifications counts the verifications of one day
+type DailyVerifications struct {
+	Date      string `json:"date"`
+	Total     int    `json:"total"`
+	Authentic int    `json:"authentic"`
+	Failed    int    `json:"failed"`
+}
+
+// VerificationStats summarizes the verification log over the last Days days (UTC, today
+// included); the totals, ratios and verdict counts cover only that window. AuthenticMedications
+// counts verifications with an authentic verdict and FailedVerifications all others. Daily
+// has one entry per day of the window, oldest first, including days without verifications.
+// AlertsActive is the current count, whatever the window.
+type VerificationStats struct {
+	TotalVerifications   int                  `json:"totalVerifications"`
+	AuthenticMedications int                  `json:"authenticMedications"`
+	FailedVerifications  int                  `json:"failedVerifications"`
+	AuthenticRatio       float64              `json:"authenticRatio"`
+	FailedRatio          float64              `json:"failedRatio"`
+	Verdicts             map[string]int       `json:"verdicts"`
+	AlertsActive         int                  `json:"alertsActive"`
+	Days                 int                  `json:"days"`
+	Daily                []DailyVerifications `json:"daily"`
+}
+
+// recordVerification verifies a unit and logs who verified it, where, when and with what
+// verdict. verifyMedication stays a read-only query; this is the transaction to submit when
+// a verification should count. The verification is checked for signs of a cloned serial and
+// any clone alerts are stored and reflected in the verdict. The verifier GLN is optional and,
+// if given, must be a registered participant of the submitting MSP.
+// Args: [medicationId, location, verifierGln]
+func (s *SmartContract) recordVerification(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 3: medicationId, location, verifierGln")
+	}
+
+	if args[0] == "" || args[1] == "" {
+		return shim.Error("Missing required fields: medicationId, location")
+	}
+
+	// Accept SGTIN and EPC forms, and legacy batch-serial IDs
+	medicationID, err := s.resolveMedicationID(stub, args[0])
+	if err != nil {
+		return shim.Error("Failed to resolve medication ID: " + err.Error())
+	}
+
+	submitter, err := getSubmitterIdentity(stub)
+	if err != nil {
+		return shim.Error("Failed to resolve submitter identity: " + err.Error())
+	}
+
+	verifierGLN := ""
+	if args[2] != "" {
+		verifier, err := s.resolveActingParticipant(stub, args[2], submitter, "")
+		if err != nil {
+			return shim.Error("Invalid verifier: " + err.Error())
+		}
+		verifierGLN = verifier.GLN
+	}
+
+	txTime, err := getTxTime(stub)
+	if err != nil {
+		return shim.Error("Failed to read transaction timestamp: " + err.Error())
+	}
+
+	record := VerificationRecord{
+		ID:           stub.GetTxID(),
+		MedicationID: medicationID,
+		Location:     args[1],
+		VerifierGLN:  verifierGLN,
+		Submitter:    submitter,
+		Timestamp:    txTime,
+		Date:         time.Unix(txTime, 0).UTC().Format(expiryDateLayout),
+	}
+
+	var alertTypes []string
+	medication, err := s.findMedication(stub, medicationID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if medication == nil {
+		record.Verdict = VerdictSuspect
+		record.Reasons = []VerdictReason{{Verdict: VerdictSuspect, Detail: "no medication was commissioned with this ID"}}
+	} else {
+		verificationResult, err := s.buildVerificationResult(stub, medication)
+		if err != nil {
+			return shim.Error("Failed to verify medication: " + err.Error())
+		}
+		record.Found = true
+
+		// Check this sighting against the earlier ones for signs of a cloned serial
+		previous, err := s.getVerificationRecordsForMedication(stub, medicationID)
+		if err != nil {
+			return shim.Error("Failed to get verification log: " + err.Error())
+		}
+		for _, alert := range detectCloneAlerts(medication, verificationResult.TrackingHistory, previous, &record) {
+			err = s.putAlert(stub, &alert)
+			if err != nil {
+				return shim.Error("Failed to put alert to world state: " + err.Error())
+			}
+			record.AlertIDs = append(record.AlertIDs, alert.ID)
+			alertTypes = append(alertTypes, alert.Type)
+			verificationResult.Alerts = append(verificationResult.Alerts, alert)
+		}
+		verificationResult.assessVerdict()
+
+		record.Verdict = verificationResult.Verdict.Status
+		record.Reasons = verificationResult.Verdict.Reasons
+	}
+
+	err = s.putVerificationRecord(stub, &record)
+	if err != nil {
+		return shim.Error("Failed to put verification record to world state: " + err.Error())
+	}
+
+	err = s.emitEvent(stub, EventNameVerificationRecorded, VerificationRecordedEvent{
+		MedicationID:   record.MedicationID,
+		Found:          record.Found,
+		Verdict:        record.Verdict,
+		Location:       record.Location,
+		VerifierGLN:    record.VerifierGLN,
+		Alerts:         alertTypes,
+		SubmitterMSPID: submitter.MSPID,
+	})
+	if err != nil {
+		return shim.Error("Failed to emit chaincode event: " + err.Error())
+	}
+
+	recordJSON, err := json.Marshal(record)
+	if err != nil {
+		return shim.Error("Failed to marshal verification record: " + err.Error())
+	}
+
+	fmt.Printf("Verification of %s recorded: %s\n", medicationID, record.Verdict)
+	return shim.Success(recordJSON)
+}
+
+// getVerificationLog returns the recorded verifications of a unit, oldest first
+// Args: [medicationId]
+func (s *SmartContract) getVerificationLog(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1: medicationId")
+	}
+
+	if args[0] == "" {
+		return shim.Error("Missing medication ID")
+	}
+
+	medicationID, err := s.resolveMedicationID(stub, args[0])
+	if err != nil {
+		return shim.Error("Failed to resolve medication ID: " + err.Error())
+	}
+
+	records, err := s.getVerificationRecordsForMedication(stub, medicationID)
+	if err != nil {
+		return shim.Error("Failed to get verification log: " + err.Error())
+	}
+
+	recordsJSON, err := json.Marshal(records)
+	if err != nil {
+		return shim.Error("Failed to marshal verification log: " + err.Error())
+	}
+
+	return shim.Success(recordsJSON)
+}
+
+// getVerificationStats reports the verifications recorded in the last days: totals, authentic
+// and failed ratios, counts per verdict and per-day buckets, and the number of active alerts
+// Args: [days] (optional, default 30)
+func (s *SmartContract) getVerificationStats(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) > 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 0 or 1: days")
+	}
+
+	days := defaultStatsDays
+	if len(args) == 1 && args[0] != "" {
+		var err error
+		days, err = strconv.Atoi(args[0])
+		if err != nil || days < 1 || days > maxStatsDays {
+			return shim.Error("Days must be a number from 1 to " + strconv.Itoa(maxStatsDays))
+		}
+	}
+
+	txTime, err := getTxTime(stub)
+	if err != nil {
+		return shim.Error("Failed to read transaction timestamp: " + err.Error())
+	}
+
+	stats := VerificationStats{
+		Verdicts: map[string]int{},
+		Days:     days,
+		Daily:    make([]DailyVerifications, days),
+	}
+
+	// One bucket per day, today last; only the keys of those days are scanned
+	today := time.Unix(txTime, 0).UTC()
+	for i := range stats.Daily {
+		bucket := &stats.Daily[i]
+		bucket.Date = today.AddDate(0, 0, i-days+1).Format(expiryDateLayout)
+
+		err = s.countVerifications(stub, &stats, bucket)
+		if err != nil {
+			return shim.Error("Failed to get verification log: " + err.Error())
+		}
+	}
+
+	if stats.TotalVerifications > 0 {
+		stats.AuthenticRatio = float64(stats.AuthenticMedications) / float64(stats.TotalVerifications)
+		stats.FailedRatio = float64(stats.FailedVerifications) / float64(stats.TotalVerifications)
+	}
+
+	stats.AlertsActive, err = s.countActiveAlerts(stub)
+	if err != nil {
+		return shim.Error("Failed to count active alerts: " + err.Error())
+	}
+
+	statsJSON, err := json.Marshal(stats)
+	if err != nil {
+		return shim.Error("Failed to marshal stats: " + err.Error())
+	}
+
+	return shim.Success(statsJSON)
+}
+
+// Helper function to add the verifications recorded on a bucket's date to it and to the totals
+func (s *SmartContract) countVerifications(stub shim.ChaincodeStubInterface, stats *VerificationStats, bucket *DailyVerifications) error {
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(verificationKeyType, []string{bucket.Date})
+	if err != nil {
+		return err
+	}
+	defer resultsIterator.Close()
+
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return err
+		}
+
+		var record VerificationRecord
+		err = json.Unmarshal(queryResponse.Value, &record)
+		if err != nil {
+			continue // Skip invalid records
+		}
+
+		authentic := record.Verdict == VerdictAuthentic
+		stats.TotalVerifications++
+		stats.Verdicts[record.Verdict]++
+		bucket.Total++
+		if authentic {
+			stats.AuthenticMedications++
+			bucket.Authentic++
+		} else {
+			stats.FailedVerifications++
+			bucket.Failed++
+		}
+	}
+
+	return nil
+}
+
+// Helper function to count active alerts: open clone alerts and medications currently recalled.
+// Recalled units are read from the status index rather than by scanning every medication.
+func (s *SmartContract) countActiveAlerts(stub shim.ChaincodeStubInterface) (int, error) {
+	alerts, err := s.countOpenAlerts(stub)
+	if err != nil {
+		return 0, err
+	}
+
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(statusKeyType, []string{StatusRecalled})
+	if err != nil {
+		return 0, err
+	}
+	defer resultsIterator.Close()
+
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return 0, err
+		}
+
+		_, keyParts, err := stub.SplitCompositeKey(queryResponse.Key)
+		if err != nil || len(keyParts) != 2 {
+			continue // Skip malformed index entries
+		}
+
+		medicationJSON, err := stub.GetState(keyParts[1])
+		if err != nil {
+			return 0, err
+		}
+
+		// An entry is stale if the status changed more than once in a single transaction
+		medication, ok := parseMedicationRecord(keyParts[1], medicationJSON)
+		if ok && medication.Status == StatusRecalled {
+			alerts++
+		}
+	}
+
+	return alerts, nil
+}
+
+// Helper function to read the verification records of a unit, oldest first
+func (s *SmartContract) getVerificationRecordsForMedication(stub shim.ChaincodeStubInterface, medicationID string) ([]VerificationRecord, error) {
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(verificationMedKeyType, []string{medicationID})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	records := []VerificationRecord{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		_, keyParts, err := stub.SplitCompositeKey(queryResponse.Key)
+		if err != nil || len(keyParts) != 3 {
+			continue // Skip malformed index entries
+		}
+
+		recordKey, err := stub.CreateCompositeKey(verificationKeyType, keyParts[1:])
+		if err != nil {
+			return nil, err
+		}
+
+		recordJSON, err := stub.GetState(recordKey)
+		if err != nil {
+			return nil, err
+		}
+		if recordJSON == nil {
+			continue // Stale index entry
+		}
+
+		var record VerificationRecord
+		err = json.Unmarshal(recordJSON, &record)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal verification record %s: %s", keyParts[2], err)
+		}
+		records = append(records, record)
+	}
+
+	// Transaction IDs do not sort by time within a day
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Timestamp < records[j].Timestamp
+	})
+
+	return records, nil
+}
+
+// Helper function to store a verification record and its medication index entry
+func (s *SmartContract) putVerificationRecord(stub shim.ChaincodeStubInterface, record *VerificationRecord) error {
+	recordKey, err := stub.CreateCompositeKey(verificationKeyType, []string{record.Date, record.ID})
+	if err != nil {
+		return err
+	}
+
+	recordJSON, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	err = stub.PutState(recordKey, recordJSON)
+	if err != nil {
+		return err
+	}
+
+	medicationKey, err := stub.CreateCompositeKey(verificationMedKeyType, []string{record.MedicationID, record.Date, record.ID})
+	if err != nil {
+		return err
+	}
+
+	return stub.PutState(medicationKey, []byte{0x00})
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// stats returns the verification stats over the last days, as of the current transaction time
+func (network *testNetwork) stats(days string) VerificationStats {
+	network.t.Helper()
+	var stats VerificationStats
+	err := json.Unmarshal(network.mustInvoke(network.regulator, "getVerificationStats", days), &stats)
+	if err != nil {
+		network.t.Fatalf("failed to unmarshal verification stats: %s", err)
+	}
+	return stats
+}
+
+func TestGetVerificationStats(t *testing.T) {
+	network := newTestNetwork(t)
+	authentic := network.commission("BATCH001", "SN001")
+	recalled := network.commission("BATCH001", "SN002")
+
+	// 2030-03-10: one authentic unit and one serial that was never commissioned
+	network.txTime = time.Date(2030, time.March, 10, 23, 59, 59, 0, time.UTC)
+	network.mustInvoke(network.manufacturer, "recordVerification", authentic, "Manufacturing Plant A", "")
+	network.mustInvoke(network.manufacturer, "recordVerification", "(01)"+testGTIN+"(21)UNKNOWN", "Manufacturing Plant A", "")
+
+	// 2030-03-11: the authentic unit again, and a recalled one
+	network.txTime = time.Date(2030, time.March, 11, 0, 0, 0, 0, time.UTC)
+	network.mustInvoke(network.manufacturer, "recordVerification", authentic, "Manufacturing Plant A", "")
+	network.advance(12 * time.Hour)
+	network.mustInvoke(network.manufacturer, "issueMedicationRecall", recalled, "Contamination", "PharmaCorp")
+	network.mustInvoke(network.manufacturer, "recordVerification", recalled, "Manufacturing Plant A", "")
+
+	// Nothing on 2030-03-12; the stats are taken on 2030-03-13
+	network.txTime = time.Date(2030, time.March, 13, 8, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		days         string
+		wantDaily    []DailyVerifications
+		wantVerdicts map[string]int
+	}{
+		{
+			days: "3",
+			wantDaily: []DailyVerifications{
+				{Date: "2030-03-11", Total: 2, Authentic: 1, Failed: 1},
+				{Date: "2030-03-12"},
+				{Date: "2030-03-13"},
+			},
+			wantVerdicts: map[string]int{VerdictAuthentic: 1, VerdictRecalled: 1},
+		},
+		{
+			days: "4",
+			wantDaily: []DailyVerifications{
+				{Date: "2030-03-10", Total: 2, Authentic: 1, Failed: 1},
+				{Date: "2030-03-11", Total: 2, Authentic: 1, Failed: 1},
+				{Date: "2030-03-12"},
+				{Date: "2030-03-13"},
+			},
+			wantVerdicts: map[string]int{VerdictAuthentic: 2, VerdictRecalled: 1, VerdictSuspect: 1},
+		},
+	}
+
+	for _, test := range tests {
+		stats := network.stats(test.days)
+		if !reflect.DeepEqual(stats.Daily, test.wantDaily) {
+			t.Errorf("%s days: daily buckets = %+v, want %+v", test.days, stats.Daily, test.wantDaily)
+		}
+		if !reflect.DeepEqual(stats.Verdicts, test.wantVerdicts) {
+			t.Errorf("%s days: verdicts = %v, want %v", test.days, stats.Verdicts, test.wantVerdicts)
+		}
+
+		total, authenticCount := 0, 0
+		for _, bucket := range test.wantDaily {
+			total += bucket.Total
+			authenticCount += bucket.Authentic
+		}
+		if stats.TotalVerifications != total || stats.AuthenticMedications != authenticCount || stats.FailedVerifications != total-authenticCount {
+			t.Errorf("%s days: %d verifications, %d authentic and %d failed, want %d, %d and %d", test.days,
+				stats.TotalVerifications, stats.AuthenticMedications, stats.FailedVerifications, total, authenticCount, total-authenticCount)
+		}
+		if stats.AuthenticRatio != 0.5 || stats.FailedRatio != 0.5 {
+			t.Errorf("%s days: ratios = %v authentic and %v failed, want 0.5 each", test.days, stats.AuthenticRatio, stats.FailedRatio)
+		}
+		if stats.AlertsActive != 1 {
+			t.Errorf("%s days: %d active alerts, want 1 for the recalled unit", test.days, stats.AlertsActive)
+		}
+	}
+
+	for _, days := range []string{"0", "-1", "many"} {
+		if response := network.invoke(network.regulator, "getVerificationStats", days); response.Status == 200 {
+			t.Errorf("getVerificationStats(%q) accepted an invalid number of days", days)
+		}
+	}
+
+	// A destroyed unit is no longer an active recall
+	network.mustInvoke(network.manufacturer, "addTrackingEvent", recalled, EventDestroy, "Manufacturing Plant A", testManufacturerGLN, "")
+	if stats := network.stats("1"); stats.AlertsActive != 0 {
+		t.Errorf("%d active alerts after the recalled unit was destroyed, want 0", stats.AlertsActive)
+	}
+}
@@ -3,6 +3,7 @@ module chainmed-bcs-gateway
 go 1.19
 
 require (
+	drug-traceability v0.0.0
 	github.com/bitly/go-simplejson v0.5.0
 	github.com/ghodss/yaml v1.0.0
 	github.com/hyperledger/fabric-sdk-go v1.0.0
@@ -57,3 +58,5 @@ require (
 )
 
 replace github.com/hyperledger/fabric-sdk-go => ../fabric-sdk-go
+
+replace drug-traceability => ../../go
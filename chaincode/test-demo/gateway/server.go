@@ -8,10 +8,13 @@ import (
 	"net/http"
 	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/bitly/go-simplejson"
 	"github.com/ghodss/yaml"
 	"github.com/hyperledger/fabric-sdk-go/pkg/client/channel"
+	"github.com/hyperledger/fabric-sdk-go/pkg/client/event"
 	"github.com/hyperledger/fabric-sdk-go/pkg/client/msp"
 	"github.com/hyperledger/fabric-sdk-go/pkg/common/providers/context"
 	mspapi "github.com/hyperledger/fabric-sdk-go/pkg/common/providers/msp"
@@ -21,6 +24,9 @@ import (
 	"github.com/hyperledger/fabric-sdk-go/pkg/fabsdk"
 	"github.com/pkg/errors"
 	"github.com/spf13/viper"
+
+	"drug-traceability/eventchain"
+	"drug-traceability/gs1"
 )
 
 // Configuration
@@ -42,6 +48,7 @@ func main() {
 		log.Fatalf("failed to load config: %v", err)
 	}
 	initializeSdk()
+	go subscribeChaincodeEvents()
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/api/health", withCORS(func(w http.ResponseWriter, r *http.Request) {
@@ -50,9 +57,32 @@ func main() {
 	}))
 
 	mux.HandleFunc("/api/commissionMedication", withCORS(postJSON(commissionMedicationHandler)))
+	mux.HandleFunc("/api/commissionBatch", withCORS(postJSON(commissionBatchHandler)))
 	mux.HandleFunc("/api/addTrackingEvent", withCORS(postJSON(addTrackingEventHandler)))
+	mux.HandleFunc("/api/registerParticipant", withCORS(postJSON(registerParticipantHandler)))
+	mux.HandleFunc("/api/participant", withCORS(getParticipantHandler))
+	mux.HandleFunc("/api/registerCompanyPrefix", withCORS(postJSON(registerCompanyPrefixHandler)))
+	mux.HandleFunc("/api/transferCompanyPrefix", withCORS(postJSON(transferCompanyPrefixHandler)))
+	mux.HandleFunc("/api/revokeCompanyPrefix", withCORS(postJSON(revokeCompanyPrefixHandler)))
+	mux.HandleFunc("/api/companyPrefix", withCORS(getCompanyPrefixHandler))
+	mux.HandleFunc("/api/registerProduct", withCORS(postJSON(registerProductHandler)))
+	mux.HandleFunc("/api/product", withCORS(getProductHandler))
+	mux.HandleFunc("/api/registerSigningKey", withCORS(postJSON(registerSigningKeyHandler)))
 	mux.HandleFunc("/api/verifyMedication", withCORS(getVerifyMedicationHandler))
+	mux.HandleFunc("/api/recordVerification", withCORS(postJSON(recordVerificationHandler)))
+	mux.HandleFunc("/api/verificationLog", withCORS(getVerificationLogHandler))
+	mux.HandleFunc("/api/resolveAlert", withCORS(postJSON(resolveAlertHandler)))
+	mux.HandleFunc("/api/verifyHistory", withCORS(postJSON(verifyHistoryHandler)))
+	mux.HandleFunc("/api/medicationAudit", withCORS(getMedicationAuditHandler))
+	mux.HandleFunc("/api/commissionFromBarcode", withCORS(postJSON(commissionFromBarcodeHandler)))
+	mux.HandleFunc("/api/verifyByBarcode", withCORS(getVerifyByBarcodeHandler))
+	mux.HandleFunc("/api/parseBarcode", withCORS(getParseBarcodeHandler))
+	mux.HandleFunc("/api/medicationsByManufacturer", withCORS(getMedicationsByManufacturerHandler))
+	mux.HandleFunc("/api/searchMedications", withCORS(getSearchMedicationsHandler))
+	mux.HandleFunc("/api/expiringMedications", withCORS(getExpiringMedicationsHandler))
 	mux.HandleFunc("/api/getVerificationStats", withCORS(getVerificationStatsHandler))
+	mux.HandleFunc("/api/recallEffectiveness", withCORS(getRecallEffectivenessHandler))
+	mux.HandleFunc("/api/events", withCORS(eventsHandler))
 
 	// Preflight
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
@@ -99,6 +129,119 @@ func commissionMedicationHandler(w http.ResponseWriter, r *http.Request) (interf
 	return map[string]string{"medicationId": string(resp.Payload)}, nil
 }
 
+// Batch commissioning
+// A production lot is sent to commissionBatch in chunks, one transaction per chunk, since
+// the chaincode caps the units written by a single transaction. Chunks already committed
+// stay committed if a later chunk fails; the response reports how far the lot got.
+const commissionChunkSize = 1000
+
+type serialRange struct {
+	Prefix string `json:"prefix"`
+	Start  int64  `json:"start"`
+	Count  int    `json:"count"`
+	Width  int    `json:"width,omitempty"`
+}
+
+type commissionBatchReq struct {
+	GTIN         string       `json:"gtin"`
+	Batch        string       `json:"batch"`
+	ExpiryDate   string       `json:"expiryDate"`
+	Manufacturer string       `json:"manufacturer"`
+	ProductName  string       `json:"productName"`
+	Location     string       `json:"location"`
+	Serials      []string     `json:"serials,omitempty"`
+	SerialRange  *serialRange `json:"serialRange,omitempty"`
+}
+
+type commissionBatchResp struct {
+	GTIN          string            `json:"gtin"`
+	Batch         string            `json:"batch"`
+	UnitCount     int               `json:"unitCount"`
+	RecalledUnits int               `json:"recalledUnits"`
+	TxIDs         []string          `json:"txIds"`
+	Results       []json.RawMessage `json:"results"`
+	Error         string            `json:"error,omitempty"`
+}
+
+// chunks splits the request into requests of at most size units each
+func (body commissionBatchReq) chunks(size int) ([]commissionBatchReq, error) {
+	if (len(body.Serials) > 0) == (body.SerialRange != nil) {
+		return nil, errors.New("expecting exactly one of serials and serialRange")
+	}
+	var chunks []commissionBatchReq
+	if body.SerialRange == nil {
+		for start := 0; start < len(body.Serials); start += size {
+			end := start + size
+			if end > len(body.Serials) {
+				end = len(body.Serials)
+			}
+			chunk := body
+			chunk.Serials = body.Serials[start:end]
+			chunks = append(chunks, chunk)
+		}
+		return chunks, nil
+	}
+	if body.SerialRange.Count <= 0 {
+		return nil, errors.New("serialRange count must be positive")
+	}
+	for offset := 0; offset < body.SerialRange.Count; offset += size {
+		count := body.SerialRange.Count - offset
+		if count > size {
+			count = size
+		}
+		rng := *body.SerialRange
+		rng.Start += int64(offset)
+		rng.Count = count
+		chunk := body
+		chunk.SerialRange = &rng
+		chunks = append(chunks, chunk)
+	}
+	return chunks, nil
+}
+
+func commissionBatchHandler(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	var body commissionBatchReq
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	chunks, err := body.chunks(commissionChunkSize)
+	if err != nil {
+		return nil, err
+	}
+
+	result := commissionBatchResp{GTIN: body.GTIN, Batch: body.Batch}
+	for i, chunk := range chunks {
+		chunkJSON, err := json.Marshal(chunk)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := executeCC("commissionBatch", [][]byte{chunkJSON})
+		if err != nil {
+			if i == 0 {
+				return nil, err
+			}
+			result.Error = fmt.Sprintf("chunk %d of %d failed: %v", i+1, len(chunks), err)
+			break
+		}
+		var chunkResult struct {
+			GTIN          string            `json:"gtin"`
+			UnitCount     int               `json:"unitCount"`
+			RecalledUnits int               `json:"recalledUnits"`
+			Results       []json.RawMessage `json:"results"`
+		}
+		if err := json.Unmarshal(resp.Payload, &chunkResult); err != nil {
+			return nil, errors.Wrap(err, "invalid commissionBatch response")
+		}
+		log.Printf("commissioned chunk %d/%d of batch %s: %d units (tx %s)", i+1, len(chunks), body.Batch, chunkResult.UnitCount, resp.TransactionID)
+		result.GTIN = chunkResult.GTIN
+		result.UnitCount += chunkResult.UnitCount
+		result.RecalledUnits += chunkResult.RecalledUnits
+		result.TxIDs = append(result.TxIDs, string(resp.TransactionID))
+		result.Results = append(result.Results, chunkResult.Results...)
+	}
+	return result, nil
+}
+
 type addEventReq struct {
 	MedicationID string `json:"medicationId"`
 	Event        string `json:"event"`
@@ -126,6 +269,239 @@ func addTrackingEventHandler(w http.ResponseWriter, r *http.Request) (interface{
 	return map[string]string{"status": "ok"}, nil
 }
 
+// Tracking event signatures are "keyId:base64Signature" over the chaincode's SigningPayload
+// JSON {"actor","event","location","previous","subject"}, where previous is the medication's
+// headHash or the container's lastTxId; the public keys are registered here.
+type registerSigningKeyReq struct {
+	Participant string `json:"participant"`
+	KeyID       string `json:"keyId"`
+	PublicKey   string `json:"publicKey"`
+}
+
+func registerSigningKeyHandler(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	var body registerSigningKeyReq
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	args := [][]byte{
+		[]byte(body.Participant),
+		[]byte(body.KeyID),
+		[]byte(body.PublicKey),
+	}
+	resp, err := executeCC("registerSigningKey", args)
+	if err != nil {
+		return nil, err
+	}
+	return json.RawMessage(resp.Payload), nil
+}
+
+// Participants
+// The body is the participant record as registerParticipant expects it and is passed through unchanged.
+func registerParticipantHandler(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	var body json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	resp, err := executeCC("registerParticipant", [][]byte{body})
+	if err != nil {
+		return nil, err
+	}
+	return json.RawMessage(resp.Payload), nil
+}
+
+func getParticipantHandler(w http.ResponseWriter, r *http.Request) {
+	addCORS(w)
+	gln := r.URL.Query().Get("gln")
+	if gln == "" {
+		http.Error(w, "missing gln", http.StatusBadRequest)
+		return
+	}
+	payload, err := queryCC("getParticipant", [][]byte{[]byte(gln)})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(payload)
+}
+
+// Company prefixes
+type registerCompanyPrefixReq struct {
+	Prefix   string `json:"prefix"`
+	OwnerGLN string `json:"ownerGln"`
+}
+
+func registerCompanyPrefixHandler(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	var body registerCompanyPrefixReq
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	args := [][]byte{
+		[]byte(body.Prefix),
+		[]byte(body.OwnerGLN),
+	}
+	resp, err := executeCC("registerCompanyPrefix", args)
+	if err != nil {
+		return nil, err
+	}
+	return json.RawMessage(resp.Payload), nil
+}
+
+type transferCompanyPrefixReq struct {
+	Prefix      string `json:"prefix"`
+	NewOwnerGLN string `json:"newOwnerGln"`
+	Reason      string `json:"reason"`
+}
+
+func transferCompanyPrefixHandler(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	var body transferCompanyPrefixReq
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	args := [][]byte{
+		[]byte(body.Prefix),
+		[]byte(body.NewOwnerGLN),
+		[]byte(body.Reason),
+	}
+	resp, err := executeCC("transferCompanyPrefix", args)
+	if err != nil {
+		return nil, err
+	}
+	return json.RawMessage(resp.Payload), nil
+}
+
+type revokeCompanyPrefixReq struct {
+	Prefix string `json:"prefix"`
+	Reason string `json:"reason"`
+}
+
+func revokeCompanyPrefixHandler(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	var body revokeCompanyPrefixReq
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	args := [][]byte{
+		[]byte(body.Prefix),
+		[]byte(body.Reason),
+	}
+	resp, err := executeCC("revokeCompanyPrefix", args)
+	if err != nil {
+		return nil, err
+	}
+	return json.RawMessage(resp.Payload), nil
+}
+
+func getCompanyPrefixHandler(w http.ResponseWriter, r *http.Request) {
+	addCORS(w)
+	prefix := r.URL.Query().Get("prefix")
+	if prefix == "" {
+		http.Error(w, "missing prefix", http.StatusBadRequest)
+		return
+	}
+	payload, err := queryCC("getCompanyPrefix", [][]byte{[]byte(prefix)})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(payload)
+}
+
+// Products
+// The body is the product master data as registerProduct expects it and is passed through unchanged.
+func registerProductHandler(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	var body json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	resp, err := executeCC("registerProduct", [][]byte{body})
+	if err != nil {
+		return nil, err
+	}
+	return json.RawMessage(resp.Payload), nil
+}
+
+func getProductHandler(w http.ResponseWriter, r *http.Request) {
+	addCORS(w)
+	gtin := r.URL.Query().Get("gtin")
+	if gtin == "" {
+		http.Error(w, "missing gtin", http.StatusBadRequest)
+		return
+	}
+	payload, err := queryCC("getProduct", [][]byte{[]byte(gtin)})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(payload)
+}
+
+// Verification log
+// verifyMedication is a query and is not counted; scans that should count are recorded here.
+type recordVerificationReq struct {
+	MedicationID string `json:"medicationId"`
+	Location     string `json:"location"`
+	VerifierGLN  string `json:"verifierGln"`
+}
+
+func recordVerificationHandler(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	var body recordVerificationReq
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	args := [][]byte{
+		[]byte(body.MedicationID),
+		[]byte(body.Location),
+		[]byte(body.VerifierGLN),
+	}
+	resp, err := executeCC("recordVerification", args)
+	if err != nil {
+		return nil, err
+	}
+	return json.RawMessage(resp.Payload), nil
+}
+
+func getVerificationLogHandler(w http.ResponseWriter, r *http.Request) {
+	addCORS(w)
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		http.Error(w, "missing id", http.StatusBadRequest)
+		return
+	}
+	payload, err := queryCC("getVerificationLog", [][]byte{[]byte(id)})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(payload)
+}
+
+// Clone alerts are raised by recordVerification and listed in verifyMedication results
+type resolveAlertReq struct {
+	MedicationID string `json:"medicationId"`
+	AlertID      string `json:"alertId"`
+	Resolution   string `json:"resolution"`
+}
+
+func resolveAlertHandler(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	var body resolveAlertReq
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	args := [][]byte{
+		[]byte(body.MedicationID),
+		[]byte(body.AlertID),
+		[]byte(body.Resolution),
+	}
+	resp, err := executeCC("resolveAlert", args)
+	if err != nil {
+		return nil, err
+	}
+	return json.RawMessage(resp.Payload), nil
+}
+
 func getVerifyMedicationHandler(w http.ResponseWriter, r *http.Request) {
 	addCORS(w)
 	id := r.URL.Query().Get("id")
@@ -142,9 +518,197 @@ func getVerifyMedicationHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write(payload)
 }
 
+// verifyHistoryHandler checks an exported tracking history against a head hash with the
+// chaincode's eventchain package. It does not touch the ledger; verifiers that do not trust
+// the gateway can run eventchain.Verify themselves.
+type verifyHistoryReq struct {
+	Events   []json.RawMessage `json:"events"`
+	HeadHash string            `json:"headHash"`
+}
+
+func verifyHistoryHandler(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	var body verifyHistoryReq
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	return eventchain.Verify(body.Events, body.HeadHash), nil
+}
+
+// getMedicationAuditHandler returns every ledger version of a medication record
+func getMedicationAuditHandler(w http.ResponseWriter, r *http.Request) {
+	addCORS(w)
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		http.Error(w, "missing id", http.StatusBadRequest)
+		return
+	}
+	payload, err := queryCC("getMedicationAudit", [][]byte{[]byte(id)})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(payload)
+}
+
+// Barcodes
+// Scanned GS1 element strings are decoded with the chaincode's gs1 package, so bad scans
+// are rejected before they reach the ledger.
+type commissionFromBarcodeReq struct {
+	Barcode      string `json:"barcode"`
+	Manufacturer string `json:"manufacturer"`
+	ProductName  string `json:"productName"`
+	Location     string `json:"location"`
+}
+
+func commissionFromBarcodeHandler(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	var body commissionFromBarcodeReq
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	elements, err := gs1.ParseElementString(body.Barcode)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid barcode")
+	}
+	args := [][]byte{
+		[]byte(body.Barcode),
+		[]byte(body.Manufacturer),
+		[]byte(body.ProductName),
+		[]byte(body.Location),
+	}
+	resp, err := executeCC("commissionFromBarcode", args)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"medicationId": string(resp.Payload), "barcode": elements}, nil
+}
+
+func getVerifyByBarcodeHandler(w http.ResponseWriter, r *http.Request) {
+	addCORS(w)
+	barcode := r.URL.Query().Get("barcode")
+	if barcode == "" {
+		http.Error(w, "missing barcode", http.StatusBadRequest)
+		return
+	}
+	if _, err := gs1.ParseElementString(barcode); err != nil {
+		http.Error(w, "invalid barcode: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	payload, err := queryCC("verifyByBarcode", [][]byte{[]byte(barcode)})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(payload)
+}
+
+// getParseBarcodeHandler decodes a barcode without touching the ledger
+func getParseBarcodeHandler(w http.ResponseWriter, r *http.Request) {
+	addCORS(w)
+	elements, err := gs1.ParseElementString(r.URL.Query().Get("barcode"))
+	if err != nil {
+		http.Error(w, "invalid barcode: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(elements)
+}
+
+// Paged queries
+// List endpoints take ?pageSize=&bookmark= and return {records, bookmark, fetchedCount};
+// pass the returned bookmark to fetch the next page.
+const defaultPageSize = "50"
+
+func pageArgs(r *http.Request) ([]byte, []byte) {
+	pageSize := r.URL.Query().Get("pageSize")
+	if pageSize == "" {
+		pageSize = defaultPageSize
+	}
+	return []byte(pageSize), []byte(r.URL.Query().Get("bookmark"))
+}
+
+// getMedicationsByManufacturerHandler serves ?manufacturer=&pageSize=&bookmark=
+func getMedicationsByManufacturerHandler(w http.ResponseWriter, r *http.Request) {
+	addCORS(w)
+	manufacturer := r.URL.Query().Get("manufacturer")
+	if manufacturer == "" {
+		http.Error(w, "missing manufacturer", http.StatusBadRequest)
+		return
+	}
+	pageSize, bookmark := pageArgs(r)
+	payload, err := queryCC("getMedicationsByManufacturerPaged", [][]byte{[]byte(manufacturer), pageSize, bookmark})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(payload)
+}
+
+// getSearchMedicationsHandler serves ?manufacturer=&gtin=&batch=&status=&location=
+// &expiryBefore=&expiryAfter=&q=&pageSize=&bookmark=, where q is a free-text match
+func getSearchMedicationsHandler(w http.ResponseWriter, r *http.Request) {
+	addCORS(w)
+	q := r.URL.Query()
+	search := map[string]string{}
+	for param, field := range map[string]string{
+		"manufacturer": "manufacturer",
+		"gtin":         "gtin",
+		"batch":        "batch",
+		"status":       "status",
+		"location":     "location",
+		"expiryBefore": "expiryBefore",
+		"expiryAfter":  "expiryAfter",
+		"q":            "text",
+	} {
+		if value := q.Get(param); value != "" {
+			search[field] = value
+		}
+	}
+	if len(search) == 0 {
+		http.Error(w, "missing search criteria", http.StatusBadRequest)
+		return
+	}
+	searchJSON, err := json.Marshal(search)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	pageSize, bookmark := pageArgs(r)
+	payload, err := queryCC("searchMedicationsPaged", [][]byte{searchJSON, pageSize, bookmark})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(payload)
+}
+
+// getExpiringMedicationsHandler serves ?days=, defaulting to 30 days
+func getExpiringMedicationsHandler(w http.ResponseWriter, r *http.Request) {
+	addCORS(w)
+	days := r.URL.Query().Get("days")
+	if days == "" {
+		days = "30"
+	}
+	payload, err := queryCC("getExpiringMedications", [][]byte{[]byte(days)})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(payload)
+}
+
+// getVerificationStatsHandler serves ?days= for the stats window, defaulting to the chaincode's 30 days
 func getVerificationStatsHandler(w http.ResponseWriter, r *http.Request) {
 	addCORS(w)
-	payload, err := queryCC("getVerificationStats", [][]byte{})
+	var args [][]byte
+	if days := r.URL.Query().Get("days"); days != "" {
+		args = [][]byte{[]byte(days)}
+	}
+	payload, err := queryCC("getVerificationStats", args)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadGateway)
 		return
@@ -153,6 +717,145 @@ func getVerificationStatsHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write(payload)
 }
 
+// getRecallEffectivenessHandler serves ?recallId= or ?gtin=&batch=
+func getRecallEffectivenessHandler(w http.ResponseWriter, r *http.Request) {
+	addCORS(w)
+	q := r.URL.Query()
+	var args [][]byte
+	switch {
+	case q.Get("recallId") != "":
+		args = [][]byte{[]byte(q.Get("recallId"))}
+	case q.Get("gtin") != "" && q.Get("batch") != "":
+		args = [][]byte{[]byte(q.Get("gtin")), []byte(q.Get("batch"))}
+	default:
+		http.Error(w, "missing recallId or gtin and batch", http.StatusBadRequest)
+		return
+	}
+	payload, err := queryCC("getRecallEffectiveness", args)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(payload)
+}
+
+// Chaincode events
+// The chaincode emits one JSON event per transaction (see chaincode/go/events.schema.json).
+// The gateway keeps a single block-event subscription and fans events out to SSE clients.
+type ccEventEnvelope struct {
+	Type      string          `json:"type"`
+	Version   int             `json:"version"`
+	TxID      string          `json:"txId"`
+	Timestamp int64           `json:"timestamp"`
+	Data      json.RawMessage `json:"data"`
+}
+
+type eventBroadcaster struct {
+	mu      sync.Mutex
+	clients map[chan ccEventEnvelope]struct{}
+}
+
+var ccEvents = &eventBroadcaster{clients: map[chan ccEventEnvelope]struct{}{}}
+
+func (b *eventBroadcaster) subscribe() chan ccEventEnvelope {
+	ch := make(chan ccEventEnvelope, 16)
+	b.mu.Lock()
+	b.clients[ch] = struct{}{}
+	b.mu.Unlock()
+	return ch
+}
+
+func (b *eventBroadcaster) unsubscribe(ch chan ccEventEnvelope) {
+	b.mu.Lock()
+	delete(b.clients, ch)
+	b.mu.Unlock()
+}
+
+func (b *eventBroadcaster) publish(evt ccEventEnvelope) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.clients {
+		select {
+		case ch <- evt:
+		default: // drop for slow clients rather than block the subscription
+		}
+	}
+}
+
+// subscribeChaincodeEvents listens for all chaincode events, reconnecting on failure
+func subscribeChaincodeEvents() {
+	for {
+		if err := listenChaincodeEvents(); err != nil {
+			log.Printf("chaincode event subscription failed: %v", err)
+		}
+		time.Sleep(5 * time.Second)
+	}
+}
+
+func listenChaincodeEvents() error {
+	ensurePrivateKey()
+	user, err := UserIdentityWithOrgAndName(org, "Admin", nil, privateKey)
+	if err != nil {
+		return err
+	}
+	evClient, err := EventClient(channelID, user)
+	if err != nil {
+		return err
+	}
+	reg, notifier, err := evClient.RegisterChaincodeEvent(chaincodeID, ".*")
+	if err != nil {
+		return err
+	}
+	defer evClient.Unregister(reg)
+	log.Printf("subscribed to chaincode events of %s on %s", chaincodeID, channelID)
+
+	for ccEvent := range notifier {
+		var evt ccEventEnvelope
+		if err := json.Unmarshal(ccEvent.Payload, &evt); err != nil {
+			log.Printf("skipping undecodable chaincode event %s in tx %s: %v", ccEvent.EventName, ccEvent.TxID, err)
+			continue
+		}
+		log.Printf("chaincode event %s (tx %s, block %d)", evt.Type, evt.TxID, ccEvent.BlockNumber)
+		ccEvents.publish(evt)
+	}
+	return errors.New("event notifier closed")
+}
+
+// eventsHandler streams chaincode events as Server-Sent Events, optionally filtered by ?type=
+func eventsHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	filter := r.URL.Query().Get("type")
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	flusher.Flush()
+
+	ch := ccEvents.subscribe()
+	defer ccEvents.unsubscribe(ch)
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case evt := <-ch:
+			if filter != "" && evt.Type != filter {
+				continue
+			}
+			data, err := json.Marshal(evt)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\nid: %s\ndata: %s\n\n", evt.Type, evt.TxID, data)
+			flusher.Flush()
+		}
+	}
+}
+
 // SDK glue
 func executeCC(fcn string, args [][]byte) (channel.Response, error) {
 	ensurePrivateKey()
@@ -264,6 +967,14 @@ func ChannelClient(channelID string, user mspapi.SigningIdentity) (*channel.Clie
 	return channel.New(channelProvider)
 }
 
+// EventClient creates an event client that receives full blocks, since filtered
+// blocks do not carry chaincode event payloads
+func EventClient(channelID string, user mspapi.SigningIdentity) (*event.Client, error) {
+	session := sdk.Context(fabsdk.WithIdentity(user))
+	channelProvider := func() (context.Channel, error) { return contextImpl.NewChannel(session, channelID) }
+	return event.New(channelProvider, event.WithBlockEvents())
+}
+
 func UserIdentityWithOrgAndName(orgID string, userName string, cert []byte, pvtKey string) (mspapi.SigningIdentity, error) {
 	if userName == "" {
 		return nil, errors.Errorf("No username specified")
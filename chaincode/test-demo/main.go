@@ -5,6 +5,7 @@ import (
 	"io/ioutil"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/bitly/go-simplejson"
 	"github.com/ghodss/yaml"
@@ -31,6 +32,9 @@ var (
 	privateKey  string
 )
 
+// GLN the demo registers its manufacturer participant under
+const demoManufacturerGLN = "7501001000004"
+
 // Force requests to PharmaOrg peer to avoid transient connection to other peers
 const pharmaPeerEndpoint = "peer-3a9d7ece5855a73f17e597fa65a96a4c082254a1-0.peer-3a9d7ece5855a73f17e597fa65a96a4c082254a1.default.svc.cluster.local:30605"
 
@@ -54,14 +58,44 @@ func main() {
 		fmt.Printf("Failed to get stats: %s\n", err)
 	}
 
-	// Test 2: Commission Medication
+	// Test 1.1: Register the manufacturer as a participant of this organization's MSP. Unless the
+	// demo identity is a regulator, it stays pending until a regulator activates it.
+	fmt.Println("\n🏭 TEST 1.1: Register Participant")
+	_, err = insert("registerParticipant", [][]byte{
+		[]byte(fmt.Sprintf(`{"gln":"%s","legalName":"PharmaCorp","role":"manufacturer","mspId":"%s","licenses":[]}`, demoManufacturerGLN, GetDefaultMspId())),
+	})
+	if err != nil {
+		fmt.Printf("Failed to register participant: %s\n", err)
+	}
+
+	// Test 1.2: Register the GS1 company prefix of the demo GTIN. Only regulators may register
+	// prefixes, so this step needs the demo identity's MSP to be allowed the regulator role.
+	fmt.Println("\n🏷️ TEST 1.2: Register Company Prefix")
+	_, err = insert("registerCompanyPrefix", [][]byte{
+		[]byte("7501001"),
+		[]byte(demoManufacturerGLN),
+	})
+	if err != nil {
+		fmt.Printf("Failed to register company prefix: %s\n", err)
+	}
+
+	// Test 1.3: Register the product master data of the demo GTIN
+	fmt.Println("\n💊 TEST 1.3: Register Product")
+	_, err = insert("registerProduct", [][]byte{
+		[]byte(fmt.Sprintf(`{"gtin":"7501001234560","name":"Paracetamol 500mg","strength":"500 mg","dosageForm":"tablet","packSize":20,"marketingAuthorization":"MA-DEMO-001","manufacturerGln":"%s","storage":{"maxTemperatureC":25}}`, demoManufacturerGLN)),
+	})
+	if err != nil {
+		fmt.Printf("Failed to register product: %s\n", err)
+	}
+
+	// Test 2: Commission Medication, expiring two years from today so the unit verifies as authentic
 	fmt.Println("\n📦 TEST 2: Commission Medication")
 	_, err = insert("commissionMedication", [][]byte{
-		[]byte("7501001234567"),
+		[]byte("7501001234560"),
 		[]byte("BATCH001"),
 		[]byte("SN001"),
-		[]byte("2025-12-31"),
-		[]byte("PharmaCorp"),
+		[]byte(time.Now().AddDate(2, 0, 0).Format("2006-01-02")),
+		[]byte(demoManufacturerGLN),
 		[]byte("Paracetamol 500mg"),
 		[]byte("Manufacturing Plant A"),
 	})
@@ -72,10 +106,10 @@ func main() {
 	// Test 2.1: Add Tracking Event (ship)
 	fmt.Println("\n🚚 TEST 2.1: Add Tracking Event (ship)")
 	_, err = insert("addTrackingEvent", [][]byte{
-		[]byte("BATCH001-SN001"),
+		[]byte("(01)07501001234560(21)SN001"),
 		[]byte("ship"),
 		[]byte("Distribution Center B"),
-		[]byte("LogisticsCorp"),
+		[]byte(""), // the MSP's only participant
 		[]byte(""),
 	})
 	if err != nil {
@@ -85,12 +119,29 @@ func main() {
 	// Test 3: Verify Medication
 	fmt.Println("\n🔍 TEST 3: Verify Medication")
 	_, err = query("verifyMedication", [][]byte{
-		[]byte("BATCH001-SN001"),
+		[]byte("(01)07501001234560(21)SN001"),
 	})
 	if err != nil {
 		fmt.Printf("Failed to verify: %s\n", err)
 	}
 
+	// Test 4: Record Verification, counted in the stats
+	fmt.Println("\n📝 TEST 4: Record Verification")
+	_, err = insert("recordVerification", [][]byte{
+		[]byte("(01)07501001234560(21)SN001"),
+		[]byte("Pharmacy C"),
+		[]byte(""),
+	})
+	if err != nil {
+		fmt.Printf("Failed to record verification: %s\n", err)
+	}
+
+	fmt.Println("\n📊 TEST 5: Get Verification Stats")
+	_, err = query("getVerificationStats", [][]byte{})
+	if err != nil {
+		fmt.Printf("Failed to get stats: %s\n", err)
+	}
+
 	fmt.Println("\n✅ All tests completed!")
 }
 
@@ -320,6 +371,11 @@ func GetDefaultChannel() string {
 	return "medchainchannel" // Fallback to our channel name
 }
 
+// GetDefaultMspId is a function to get the MSP ID of the configured organization
+func GetDefaultMspId() string {
+	return sdkfile.Get("organizations").Get(getOrgId(configFile)).Get("mspid").MustString()
+}
+
 func getOrgId(configFile string) string {
 	vc := viper.New()
 	vc.SetConfigFile(configFile)